@@ -0,0 +1,52 @@
+package auth
+
+import persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+
+// APIKeyPrefix starts every API key.
+const APIKeyPrefix = "usk_"
+
+// ActionScopes maps each action to the scope an API key needs to perform it.
+// API keys are never allowed an action that isn't listed, whatever the
+// policy says.
+var ActionScopes = map[string]string{
+	ActionGetUser:     persistence.ScopeRead,
+	ActionVerify:      persistence.ScopeRead,
+	ActionCreateUser:  persistence.ScopeWrite,
+	ActionUpdateUser:  persistence.ScopeWrite,
+	ActionDeleteUser:  persistence.ScopeDelete,
+	ActionSearchUsers: persistence.ScopeSearch,
+}
+
+// Scopes are all the scopes an API key can be given.
+var Scopes = []string{
+	persistence.ScopeRead,
+	persistence.ScopeWrite,
+	persistence.ScopeDelete,
+	persistence.ScopeSearch,
+}
+
+// IsScope reports whether scope is one of Scopes.
+func IsScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NewAPIKey generates a random API key, returning it and the hash to store.
+func NewAPIKey() (key, hash string, err error) {
+	return newSecret(APIKeyPrefix)
+}
+
+// APIKeyPrincipal returns the principal for requests made with an API key.
+func APIKeyPrincipal(key *persistence.Token) *Principal {
+	return &Principal{
+		Subject:  "apikey:" + key.ID,
+		APIKeyID: key.ID,
+		Name:     key.Name,
+		Scopes:   key.Scopes,
+	}
+}
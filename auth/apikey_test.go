@@ -0,0 +1,30 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewAPIKey(t *testing.T) {
+	key, hash, err := NewAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(key, APIKeyPrefix) {
+		t.Errorf("key is missing its prefix: %v", key)
+	}
+
+	if strings.Contains(hash, key) || hash != HashToken(key) {
+		t.Errorf("wrong hash for key: %v", hash)
+	}
+
+	other, _, err := NewAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if other == key {
+		t.Error("generated the same key twice")
+	}
+}
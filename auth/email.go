@@ -0,0 +1,21 @@
+package auth
+
+import "time"
+
+// EmailVerificationTokenPrefix starts every email verification token.
+const EmailVerificationTokenPrefix = "use_"
+
+// EmailVerificationTTL is how long an email verification link works for.
+var EmailVerificationTTL = 24 * time.Hour
+
+// NewEmailVerificationToken generates a random email verification token,
+// returning it and the hash to store.
+func NewEmailVerificationToken() (token, hash string, err error) {
+	return newSecret(EmailVerificationTokenPrefix)
+}
+
+// EmailVerificationFamily is the token family of every email verification
+// token for a user, so they can all be revoked once one has been used.
+func EmailVerificationFamily(userID string) string {
+	return "email_verification:" + userID
+}
@@ -0,0 +1,197 @@
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Principal is who a request was made by, taken from a verified token.
+type Principal struct {
+	// Subject is the token's sub claim, the ID of the user or service.
+	Subject string
+	// Role is the token's role claim, checked against the access policy.
+	Role string
+	// APIKeyID is the ID of the API key the request was made with, or
+	// empty for a JWT. API keys are checked against their Scopes instead
+	// of the access policy.
+	APIKeyID string
+	Name     string
+	Scopes   []string
+}
+
+// String describes the principal for logs and audit entries.
+func (p *Principal) String() string {
+	if p == nil {
+		return "anonymous"
+	}
+
+	if p.APIKeyID != "" {
+		return fmt.Sprintf("api key %s (%s)", p.APIKeyID, p.Name)
+	}
+
+	return fmt.Sprintf("%s (%s)", p.Subject, p.Role)
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying p.
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFromContext returns the principal stored in ctx by WithPrincipal.
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
+
+// Authenticator verifies bearer JWTs. Tokens can be signed with HS256 using
+// a shared secret or RS256 using one of the keys in a JWKS file, depending on
+// which are configured.
+type Authenticator struct {
+	hmacSecret []byte
+	rsaKeys    map[string]*rsa.PublicKey
+}
+
+// NewAuthenticator creates an authenticator that accepts HS256 tokens signed
+// with hmacSecret and RS256 tokens signed by a key in the JWKS file at
+// jwksPath. Either can be left empty to turn that algorithm off, but not
+// both.
+func NewAuthenticator(hmacSecret, jwksPath string) (*Authenticator, error) {
+	if hmacSecret == "" && jwksPath == "" {
+		return nil, errors.New("no jwt secret or jwks file provided")
+	}
+
+	a := &Authenticator{rsaKeys: make(map[string]*rsa.PublicKey)}
+	if hmacSecret != "" {
+		a.hmacSecret = []byte(hmacSecret)
+	}
+
+	if jwksPath != "" {
+		keys, err := loadJWKS(jwksPath)
+		if err != nil {
+			return nil, err
+		}
+
+		a.rsaKeys = keys
+	}
+
+	return a, nil
+}
+
+// Claims are the claims read from a token: the standard ones plus the role
+// of who it was issued to.
+type Claims struct {
+	jwt.StandardClaims
+	Role string `json:"role,omitempty"`
+}
+
+// Authenticate verifies a token's signature and expiry and returns who it
+// was issued to. Tokens must have an exp and a sub claim.
+func (a *Authenticator) Authenticate(token string) (*Principal, error) {
+	claims := Claims{}
+	_, err := jwt.ParseWithClaims(token, &claims, a.key)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.ExpiresAt == 0 {
+		return nil, errors.New("token has no expiry")
+	}
+
+	if claims.Subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+
+	return &Principal{Subject: claims.Subject, Role: claims.Role}, nil
+}
+
+// key picks the key to check a token's signature with. The algorithm is
+// checked against the key type so an RS256 public key can never be used as
+// an HS256 secret.
+func (a *Authenticator) key(token *jwt.Token) (interface{}, error) {
+	switch token.Method {
+	case jwt.SigningMethodHS256:
+		if a.hmacSecret == nil {
+			return nil, errors.New("HS256 tokens are not accepted")
+		}
+
+		return a.hmacSecret, nil
+	case jwt.SigningMethodRS256:
+		kid, _ := token.Header["kid"].(string)
+		if key, ok := a.rsaKeys[kid]; ok {
+			return key, nil
+		}
+
+		// A token without a kid can only mean the one key there is.
+		if kid == "" && len(a.rsaKeys) == 1 {
+			for _, key := range a.rsaKeys {
+				return key, nil
+			}
+		}
+
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	return nil, fmt.Errorf("unsupported signing method %v", token.Header["alg"])
+}
+
+// jwks is the JSON Web Key Set format (RFC 7517). Only the fields needed for
+// RSA public keys are read.
+type jwks struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+func loadJWKS(path string) (map[string]*rsa.PublicKey, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var set jwks
+	if err = json.NewDecoder(file).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("bad modulus for key %q: %s", k.Kid, err)
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("bad exponent for key %q: %s", k.Kid, err)
+		}
+
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no RSA keys found in " + path)
+	}
+
+	return keys, nil
+}
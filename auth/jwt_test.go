@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const testSecret = "s3cr3t"
+
+func signHS256(t *testing.T, claims jwt.StandardClaims) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func validClaims() jwt.StandardClaims {
+	return jwt.StandardClaims{
+		Subject:   "1",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+// writeJWKS writes the public half of key to a JWKS file under kid.
+func writeJWKS(t *testing.T, kid string, key *rsa.PrivateKey) string {
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	set := map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": kid,
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	}
+
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "jwks.json")
+	if err = ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestAuthenticateHS256(t *testing.T) {
+	a, err := NewAuthenticator(testSecret, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := a.Authenticate(signHS256(t, validClaims()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Subject != "1" {
+		t.Errorf("wrong subject: got %v want %v", p.Subject, "1")
+	}
+
+	expired := validClaims()
+	expired.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+
+	noExpiry := validClaims()
+	noExpiry.ExpiresAt = 0
+
+	noSubject := validClaims()
+	noSubject.Subject = ""
+
+	wrongSecret, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims()).SignedString([]byte("wrong"))
+	unsigned, _ := jwt.NewWithClaims(jwt.SigningMethodNone, validClaims()).SignedString(jwt.UnsafeAllowNoneSignatureType)
+
+	tests := map[string]string{
+		"expired":      signHS256(t, expired),
+		"no expiry":    signHS256(t, noExpiry),
+		"no subject":   signHS256(t, noSubject),
+		"wrong secret": wrongSecret,
+		"alg none":     unsigned,
+		"garbage":      "not.a.token",
+	}
+
+	for name, token := range tests {
+		if _, err := a.Authenticate(token); err == nil {
+			t.Errorf("%s: token was accepted", name)
+		}
+	}
+}
+
+func TestAuthenticateRS256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewAuthenticator("", writeJWKS(t, "key-1", key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, validClaims())
+	token.Header["kid"] = "key-1"
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = a.Authenticate(signed); err != nil {
+		t.Fatal(err)
+	}
+
+	// HS256 is off when there is no secret, which also stops the public key
+	// being used as an HMAC secret.
+	if _, err = a.Authenticate(signHS256(t, validClaims())); err == nil {
+		t.Error("HS256 token was accepted without a secret configured")
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed, _ = token.SignedString(other)
+	if _, err = a.Authenticate(signed); err == nil {
+		t.Error("token signed by an unknown key was accepted")
+	}
+}
+
+func TestNewAuthenticatorNeedsAKey(t *testing.T) {
+	if _, err := NewAuthenticator("", ""); err == nil {
+		t.Error("expected an error with no secret or jwks file")
+	}
+}
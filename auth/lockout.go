@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"sync"
+	"time"
+
+	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+)
+
+// LockoutPolicy is how failed password checks in a row lock a user, or a
+// client, out. Reaching Threshold locks them out for Base, and every failure
+// after that doubles the lock up to Max.
+type LockoutPolicy struct {
+	// Threshold is the number of failures that locks them out. Zero turns
+	// locking off.
+	Threshold int
+	Base      time.Duration
+	Max       time.Duration
+	// ResetAfter is how long after the last failure the count starts
+	// again, so a typo every few weeks doesn't add up to a lock.
+	ResetAfter time.Duration
+}
+
+// DefaultLockoutPolicy locks a user out for a minute after 5 failures.
+func DefaultLockoutPolicy() LockoutPolicy {
+	return LockoutPolicy{
+		Threshold:  5,
+		Base:       time.Minute,
+		Max:        time.Hour,
+		ResetAfter: 24 * time.Hour,
+	}
+}
+
+// DefaultIPLockoutPolicy allows more failures from one address than for one
+// user, as many users can be behind the same address.
+func DefaultIPLockoutPolicy() LockoutPolicy {
+	return LockoutPolicy{
+		Threshold:  20,
+		Base:       time.Minute,
+		Max:        time.Hour,
+		ResetAfter: time.Hour,
+	}
+}
+
+// Fail adds a failure at at to l and returns it with the lock it has earned.
+func (p LockoutPolicy) Fail(l persistence.Lockout, at time.Time) persistence.Lockout {
+	if p.ResetAfter > 0 && !l.LastFailure.IsZero() && at.Sub(l.LastFailure) >= p.ResetAfter {
+		l = persistence.Lockout{}
+	}
+
+	l.Failures++
+	l.LastFailure = at
+	l.LockedUntil = nil
+	if d := p.lockFor(l.Failures); d > 0 {
+		until := at.Add(d)
+		l.LockedUntil = &until
+	}
+
+	return l
+}
+
+// lockFor is how long a number of failures locks them out for.
+func (p LockoutPolicy) lockFor(failures int) time.Duration {
+	if p.Threshold <= 0 || failures < p.Threshold {
+		return 0
+	}
+
+	d := p.Base
+	for i := p.Threshold; i < failures && d < p.Max; i++ {
+		d *= 2
+	}
+
+	if d > p.Max {
+		d = p.Max
+	}
+
+	return d
+}
+
+// maxThrottleKeys is how many keys a Throttle holds before it forgets the
+// ones that are no longer locked and have had time to reset.
+const maxThrottleKeys = 10000
+
+// Throttle counts failures in memory by key, such as a client's address,
+// and locks keys out as its policy says. It is safe for concurrent use.
+type Throttle struct {
+	policy LockoutPolicy
+	mu     sync.Mutex
+	keys   map[string]persistence.Lockout
+}
+
+// NewThrottle returns a Throttle that locks keys out with policy.
+func NewThrottle(policy LockoutPolicy) *Throttle {
+	return &Throttle{policy: policy, keys: make(map[string]persistence.Lockout)}
+}
+
+// Locked reports whether key is locked out at now, and until when.
+func (t *Throttle) Locked(key string, now time.Time) (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	l, ok := t.keys[key]
+	if !ok || !l.Locked(now) {
+		return time.Time{}, false
+	}
+
+	return *l.LockedUntil, true
+}
+
+// Fail records a failure for key at at and returns its lockout.
+func (t *Throttle) Fail(key string, at time.Time) persistence.Lockout {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.keys) >= maxThrottleKeys {
+		t.prune(at)
+	}
+
+	l := t.policy.Fail(t.keys[key], at)
+	t.keys[key] = l
+	return l
+}
+
+// prune forgets the keys whose failures would be reset anyway. The lock must
+// be held.
+func (t *Throttle) prune(now time.Time) {
+	for key, l := range t.keys {
+		if !l.Locked(now) && now.Sub(l.LastFailure) >= t.policy.ResetAfter {
+			delete(t.keys, key)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+)
+
+func TestLockoutPolicy(t *testing.T) {
+	p := LockoutPolicy{Threshold: 3, Base: time.Minute, Max: 5 * time.Minute, ResetAfter: time.Hour}
+	at := time.Date(2020, 4, 1, 12, 0, 0, 0, time.UTC)
+
+	// The lock starts at the threshold and doubles up to the max.
+	want := []time.Duration{0, 0, time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute}
+	l := persistence.Lockout{}
+	for i, d := range want {
+		l = p.Fail(l, at)
+		if l.Failures != i+1 {
+			t.Fatalf("wrong failure count: got %v want %v", l.Failures, i+1)
+		}
+
+		if d == 0 {
+			if l.LockedUntil != nil {
+				t.Errorf("%v failures locked the user out", l.Failures)
+			}
+
+			continue
+		}
+
+		if l.LockedUntil == nil || !l.LockedUntil.Equal(at.Add(d)) {
+			t.Errorf("%v failures locked the user out until %v, want %v", l.Failures, l.LockedUntil, at.Add(d))
+		}
+	}
+
+	// A failure long after the last one starts the count again.
+	l = p.Fail(l, at.Add(2*time.Hour))
+	if l.Failures != 1 || l.LockedUntil != nil {
+		t.Errorf("failures were not reset: %+v", l)
+	}
+
+	off := LockoutPolicy{}
+	for i := 0; i < 10; i++ {
+		l = off.Fail(l, at)
+	}
+
+	if l.LockedUntil != nil {
+		t.Errorf("a policy without a threshold locked the user out: %+v", l)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	throttle := NewThrottle(LockoutPolicy{Threshold: 2, Base: time.Minute, Max: time.Hour, ResetAfter: time.Hour})
+	at := time.Date(2020, 4, 1, 12, 0, 0, 0, time.UTC)
+
+	throttle.Fail("192.0.2.1", at)
+	if _, locked := throttle.Locked("192.0.2.1", at); locked {
+		t.Error("locked out below the threshold")
+	}
+
+	throttle.Fail("192.0.2.1", at)
+	if until, locked := throttle.Locked("192.0.2.1", at); !locked || !until.Equal(at.Add(time.Minute)) {
+		t.Errorf("not locked out at the threshold: %v %v", until, locked)
+	}
+
+	if _, locked := throttle.Locked("192.0.2.2", at); locked {
+		t.Error("another address was locked out")
+	}
+
+	if _, locked := throttle.Locked("192.0.2.1", at.Add(time.Minute)); locked {
+		t.Error("still locked out after the lock ended")
+	}
+}
@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordCost is the bcrypt cost new passwords are hashed with. Raising it
+// makes existing hashes get rehashed the next time they are checked.
+var PasswordCost = bcrypt.DefaultCost
+
+// HashPassword hashes a plaintext password with bcrypt, which salts it and is
+// slow on purpose so stolen hashes are expensive to crack.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), PasswordCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+// IsHashed reports whether a stored password is a bcrypt hash. Users created
+// before passwords were hashed still have the plaintext stored.
+func IsHashed(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") ||
+		strings.HasPrefix(stored, "$2b$") ||
+		strings.HasPrefix(stored, "$2y$")
+}
+
+// CheckPassword reports whether password matches the stored password, and if
+// it does whether the stored password should be replaced with a fresh
+// HashPassword: either because it is still plaintext or because it was hashed
+// with a lower cost than PasswordCost. Both checks take the same time however
+// much of the password matches. A user with no stored password never matches.
+func CheckPassword(stored, password string) (ok bool, rehash bool) {
+	// A user without a password can't be logged in as.
+	if stored == "" {
+		return false, false
+	}
+
+	if !IsHashed(stored) {
+		ok = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+		return ok, ok
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) != nil {
+		return false, false
+	}
+
+	cost, err := bcrypt.Cost([]byte(stored))
+	return true, err != nil || cost < PasswordCost
+}
+
+var (
+	dummyHash     string
+	dummyHashOnce sync.Once
+)
+
+// CheckNoUser does the same work as checking a password against a hash and
+// always fails. Call it when there is no user to check a password for, so
+// that the response to an unknown user takes as long as a wrong password and
+// can't be used to find out which users exist.
+func CheckNoUser(password string) bool {
+	dummyHashOnce.Do(func() {
+		hash, _ := bcrypt.GenerateFromPassword([]byte("no user"), PasswordCost)
+		dummyHash = string(hash)
+	})
+
+	bcrypt.CompareHashAndPassword([]byte(dummyHash), []byte(password))
+	return false
+}
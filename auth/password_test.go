@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword("p4ssw0rd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hash == "p4ssw0rd" || !IsHashed(hash) {
+		t.Errorf("password was not hashed: %s", hash)
+	}
+
+	if ok, rehash := CheckPassword(hash, "p4ssw0rd"); !ok || rehash {
+		t.Errorf("wrong result for the right password: got %v, %v want true, false", ok, rehash)
+	}
+
+	if ok, _ := CheckPassword(hash, "password"); ok {
+		t.Error("wrong password was accepted")
+	}
+}
+
+func TestCheckPlaintextPassword(t *testing.T) {
+	if ok, rehash := CheckPassword("p4ssw0rd", "p4ssw0rd"); !ok || !rehash {
+		t.Errorf("wrong result for a plaintext password: got %v, %v want true, true", ok, rehash)
+	}
+
+	if ok, rehash := CheckPassword("p4ssw0rd", "password"); ok || rehash {
+		t.Errorf("wrong result for a wrong plaintext password: got %v, %v want false, false", ok, rehash)
+	}
+}
+
+func TestCheckPasswordRehashesLowCost(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("p4ssw0rd"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, rehash := CheckPassword(string(hash), "p4ssw0rd"); !ok || !rehash {
+		t.Errorf("wrong result for a low cost hash: got %v, %v want true, true", ok, rehash)
+	}
+}
+
+func TestCheckEmptyPassword(t *testing.T) {
+	if ok, _ := CheckPassword("", ""); ok {
+		t.Error("empty password was accepted for a user without a password")
+	}
+}
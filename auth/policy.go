@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"fmt"
+
+	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+)
+
+// The actions the access policy controls.
+const (
+	ActionGetUser    = "user:get"
+	ActionCreateUser = "user:create"
+	ActionUpdateUser = "user:update"
+	ActionDeleteUser = "user:delete"
+	// ActionSetRole is needed on top of create or update to set a role.
+	ActionSetRole     = "user:set_role"
+	ActionSearchUsers = "user:search"
+	ActionVerify      = "auth:verify"
+	ActionReadMetrics = "metrics:read"
+	ActionManageKeys  = "apikey:manage"
+	// ActionResetMFA removes a user's authenticator without a code from
+	// it, for users who have lost it and their recovery codes.
+	ActionResetMFA = "user:reset_mfa"
+	// ActionUnlockUser sees and clears the lockout failed logins put on a
+	// user.
+	ActionUnlockUser = "user:unlock"
+	// ActionReindex rebuilds the search index from the database.
+	ActionReindex = "search:reindex"
+)
+
+// Self can be listed in a policy alongside the roles to allow a principal to
+// act on their own user, whatever their role.
+const Self = "self"
+
+// Policy maps each action to the roles allowed to perform it. An action that
+// isn't in the policy is denied to everyone.
+type Policy map[string][]string
+
+// DefaultPolicy lets admins do anything, lets services look users up, create
+// them and check credentials, and lets a user see and change their own
+// record.
+func DefaultPolicy() Policy {
+	return Policy{
+		ActionGetUser:     {persistence.RoleAdmin, persistence.RoleService, Self},
+		ActionCreateUser:  {persistence.RoleAdmin, persistence.RoleService},
+		ActionUpdateUser:  {persistence.RoleAdmin, Self},
+		ActionDeleteUser:  {persistence.RoleAdmin},
+		ActionSetRole:     {persistence.RoleAdmin},
+		ActionSearchUsers: {persistence.RoleAdmin},
+		ActionVerify:      {persistence.RoleAdmin, persistence.RoleService},
+		ActionReadMetrics: {persistence.RoleAdmin},
+		ActionManageKeys:  {persistence.RoleAdmin},
+		ActionResetMFA:    {persistence.RoleAdmin},
+		ActionUnlockUser:  {persistence.RoleAdmin},
+		ActionReindex:     {persistence.RoleAdmin},
+	}
+}
+
+// NewPolicy returns the default policy with the actions in overrides
+// replaced. It fails if overrides names an action that doesn't exist, so a
+// typo in the config can't silently leave an action on its default.
+func NewPolicy(overrides map[string][]string) (Policy, error) {
+	p := DefaultPolicy()
+	for action, roles := range overrides {
+		if _, ok := p[action]; !ok {
+			return nil, fmt.Errorf("unknown action %q in policy", action)
+		}
+
+		p[action] = roles
+	}
+
+	return p, nil
+}
+
+// Allowed reports whether principal may perform action. ownerID is the ID of
+// the user the action is on, used to match Self, or empty if it isn't on a
+// single user. API keys are allowed the actions their scopes cover, see
+// ActionScopes.
+func (p Policy) Allowed(principal *Principal, action, ownerID string) bool {
+	if principal == nil {
+		return false
+	}
+
+	if principal.APIKeyID != "" {
+		scope, ok := ActionScopes[action]
+		return ok && hasScope(principal.Scopes, scope)
+	}
+
+	for _, role := range p[action] {
+		if role == Self {
+			if ownerID != "" && principal.Subject == ownerID {
+				return true
+			}
+
+			continue
+		}
+
+		if principal.Role != "" && principal.Role == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
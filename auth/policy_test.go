@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"testing"
+
+	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+)
+
+func TestDefaultPolicy(t *testing.T) {
+	admin := &Principal{Subject: "1", Role: persistence.RoleAdmin}
+	user := &Principal{Subject: "2", Role: persistence.RoleUser}
+	service := &Principal{Subject: "billing", Role: persistence.RoleService}
+
+	tests := []struct {
+		principal *Principal
+		action    string
+		ownerID   string
+		want      bool
+	}{
+		{admin, ActionDeleteUser, "2", true},
+		{admin, ActionSearchUsers, "", true},
+		{user, ActionGetUser, "2", true},
+		{user, ActionUpdateUser, "2", true},
+		{user, ActionGetUser, "1", false},
+		{user, ActionUpdateUser, "1", false},
+		{user, ActionDeleteUser, "2", false},
+		{user, ActionSearchUsers, "", false},
+		{user, ActionSetRole, "2", false},
+		{service, ActionGetUser, "2", true},
+		{service, ActionUpdateUser, "2", false},
+		{nil, ActionGetUser, "2", false},
+		{admin, "user:unknown", "", false},
+	}
+
+	p := DefaultPolicy()
+	for _, tt := range tests {
+		if got := p.Allowed(tt.principal, tt.action, tt.ownerID); got != tt.want {
+			t.Errorf("Allowed(%v, %s, %s): got %v want %v",
+				tt.principal, tt.action, tt.ownerID, got, tt.want)
+		}
+	}
+}
+
+func TestNewPolicy(t *testing.T) {
+	p, err := NewPolicy(map[string][]string{
+		ActionSearchUsers: {persistence.RoleAdmin, persistence.RoleService},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := &Principal{Subject: "billing", Role: persistence.RoleService}
+	if !p.Allowed(service, ActionSearchUsers, "") {
+		t.Error("override was not applied")
+	}
+
+	if p.Allowed(service, ActionDeleteUser, "1") {
+		t.Error("actions without an override lost their default")
+	}
+
+	if _, err = NewPolicy(map[string][]string{"user:delte": {"admin"}}); err == nil {
+		t.Error("expected an error for an unknown action")
+	}
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	key := APIKeyPrincipal(&persistence.Token{
+		ID:     "7",
+		Name:   "nightly export",
+		Scopes: []string{persistence.ScopeRead, persistence.ScopeSearch},
+	})
+
+	tests := []struct {
+		action string
+		want   bool
+	}{
+		{ActionGetUser, true},
+		{ActionSearchUsers, true},
+		{ActionVerify, true},
+		{ActionCreateUser, false},
+		{ActionDeleteUser, false},
+		// Nothing scopes these, so no key can do them.
+		{ActionSetRole, false},
+		{ActionManageKeys, false},
+		{ActionReadMetrics, false},
+	}
+
+	// Even a policy that lets everyone do everything can't widen a key's
+	// scopes.
+	p := Policy{}
+	for action := range DefaultPolicy() {
+		p[action] = []string{"", Self}
+	}
+
+	for _, tt := range tests {
+		if got := p.Allowed(key, tt.action, "7"); got != tt.want {
+			t.Errorf("Allowed(%v, %s): got %v want %v", key, tt.action, got, tt.want)
+		}
+	}
+}
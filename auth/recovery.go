@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"crypto/rand"
+	"strings"
+)
+
+// RecoveryCodeCount is how many recovery codes a user is given at a time.
+const RecoveryCodeCount = 10
+
+// NewRecoveryCodes generates a set of recovery codes, which can each be used
+// once in place of a TOTP code. They look like abcd-efgh-ijkl-mnop so they
+// are easy to copy down. The hashes to store are returned with them.
+func NewRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < RecoveryCodeCount; i++ {
+		b := make([]byte, 10)
+		if _, err = rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+
+		raw := strings.ToLower(totpEncoding.EncodeToString(b))
+		code := raw[0:4] + "-" + raw[4:8] + "-" + raw[8:12] + "-" + raw[12:16]
+		codes = append(codes, code)
+		hashes = append(hashes, HashRecoveryCode(code))
+	}
+
+	return codes, hashes, nil
+}
+
+// HashRecoveryCode returns the hash a recovery code is stored by. Case,
+// spaces and dashes are ignored so the code can be typed however it was
+// written down.
+func HashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return HashToken(code)
+}
+
+// RecoveryCodeFamily is the token family of a user's recovery codes, so they
+// can all be replaced at once.
+func RecoveryCodeFamily(userID string) string {
+	return "recovery_code:" + userID
+}
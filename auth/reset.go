@@ -0,0 +1,21 @@
+package auth
+
+import "time"
+
+// PasswordResetTokenPrefix starts every password reset token.
+const PasswordResetTokenPrefix = "usp_"
+
+// PasswordResetTTL is how long a password reset token can be used for.
+var PasswordResetTTL = time.Hour
+
+// NewPasswordResetToken generates a random password reset token, returning
+// it and the hash to store.
+func NewPasswordResetToken() (token, hash string, err error) {
+	return newSecret(PasswordResetTokenPrefix)
+}
+
+// PasswordResetFamily is the token family of every password reset token for
+// a user, so they can all be revoked once one has been used.
+func PasswordResetFamily(userID string) string {
+	return "password_reset:" + userID
+}
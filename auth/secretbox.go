@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+)
+
+// SecretBox encrypts secrets that have to be stored and read back, such as
+// TOTP secrets, with AES-256-GCM.
+type SecretBox struct {
+	aead cipher.AEAD
+}
+
+// NewSecretBox creates a secret box from a base64 encoded 32 byte key.
+func NewSecretBox(key string) (*SecretBox, error) {
+	k, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, errors.New("encryption key is not base64")
+	}
+
+	if len(k) != 32 {
+		return nil, errors.New("encryption key must be 32 bytes")
+	}
+
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SecretBox{aead}, nil
+}
+
+// Seal encrypts plaintext. The result is base64 so it can be stored as text.
+func (b *SecretBox) Seal(plaintext string) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := b.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a secret sealed with the same key.
+func (b *SecretBox) Open(sealed string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+
+	n := b.aead.NonceSize()
+	if len(data) < n {
+		return "", errors.New("sealed secret is too short")
+	}
+
+	plaintext, err := b.aead.Open(nil, data[:n], data[n:], nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
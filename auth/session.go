@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// RefreshTokenPrefix starts every refresh token.
+const RefreshTokenPrefix = "usr_"
+
+// How long the tokens issued at login last. Access tokens can't be revoked,
+// so they are kept short, and refresh tokens are used to get new ones.
+var (
+	AccessTokenTTL  = 15 * time.Minute
+	RefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// CanIssue reports whether the authenticator can issue tokens with Issue.
+func (a *Authenticator) CanIssue() bool {
+	return a.hmacSecret != nil
+}
+
+// Issue signs an HS256 access token for principal that expires after ttl.
+// Only authenticators with an HMAC secret can issue tokens, the JWKS file
+// only holds public keys.
+func (a *Authenticator) Issue(principal *Principal, ttl time.Duration) (string, error) {
+	if a.hmacSecret == nil {
+		return "", errors.New("no jwt secret to sign tokens with")
+	}
+
+	now := time.Now()
+	claims := Claims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   principal.Subject,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(ttl).Unix(),
+		},
+		Role: principal.Role,
+	}
+
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(a.hmacSecret)
+}
+
+// NewRefreshToken generates a random refresh token, returning it and the
+// hash to store.
+func NewRefreshToken() (token, hash string, err error) {
+	return newSecret(RefreshTokenPrefix)
+}
+
+// NewTokenFamily returns a random ID for a new family of refresh tokens.
+func NewTokenFamily() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// HashToken returns the hash a token such as an API key is stored and looked
+// up by. The tokens are long and random, so a fast unsalted hash is enough
+// and lets them be looked up directly.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newSecret generates a random token starting with prefix, so the kind of
+// token is easy to spot in config and secret scanners.
+func newSecret(prefix string) (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		return "", "", err
+	}
+
+	token = prefix + base64.RawURLEncoding.EncodeToString(b)
+	return token, HashToken(token), nil
+}
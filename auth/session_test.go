@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"strings"
+	"testing"
+	"time"
+
+	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+)
+
+func TestIssue(t *testing.T) {
+	a, err := NewAuthenticator(testSecret, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := a.Issue(&Principal{Subject: "3", Role: persistence.RoleAdmin}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := a.Authenticate(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Subject != "3" || p.Role != persistence.RoleAdmin {
+		t.Errorf("wrong principal: got %v", p)
+	}
+
+	expired, err := a.Issue(&Principal{Subject: "3"}, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = a.Authenticate(expired); err == nil {
+		t.Error("expired token was accepted")
+	}
+}
+
+func TestIssueNeedsASecret(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewAuthenticator("", writeJWKS(t, "k1", key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = a.Issue(&Principal{Subject: "3"}, time.Minute); err == nil {
+		t.Error("issued a token without a secret")
+	}
+}
+
+func TestNewRefreshToken(t *testing.T) {
+	token, hash, err := NewRefreshToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(token, RefreshTokenPrefix) || hash != HashToken(token) {
+		t.Errorf("wrong refresh token: %v %v", token, hash)
+	}
+
+	a, err := NewTokenFamily()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewTokenFamily()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a == "" || a == b {
+		t.Errorf("families are not unique: %v %v", a, b)
+	}
+}
@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// The SHA1 test vectors from RFC 6238, truncated to 6 digits.
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, tt := range tests {
+		got, err := TOTPCode(secret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != tt.want {
+			t.Errorf("code at %d: got %v want %v", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestCheckTOTP(t *testing.T) {
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	code, err := TOTPCode(secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	step, ok := CheckTOTP(secret, code, now, 0)
+	if !ok {
+		t.Fatal("current code was refused")
+	}
+
+	if _, ok = CheckTOTP(secret, code, now, step); ok {
+		t.Error("code was accepted twice")
+	}
+
+	if _, ok = CheckTOTP(secret, code, now.Add(30*time.Second), 0); !ok {
+		t.Error("code from the last period was refused")
+	}
+
+	if _, ok = CheckTOTP(secret, code, now.Add(5*time.Minute), 0); ok {
+		t.Error("old code was accepted")
+	}
+
+	if _, ok = CheckTOTP(secret, "12345", now, 0); ok {
+		t.Error("short code was accepted")
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := TOTPURI("user-service", "klay@mail.com", "ABC")
+	if !strings.HasPrefix(uri, "otpauth://totp/user-service:klay@mail.com?") ||
+		!strings.Contains(uri, "secret=ABC") || !strings.Contains(uri, "issuer=user-service") {
+		t.Errorf("wrong uri: %v", uri)
+	}
+}
+
+func TestSecretBox(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	box, err := NewSecretBox(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := box.Seal("JBSWY3DPEHPK3PXP")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(sealed, "JBSWY3DPEHPK3PXP") {
+		t.Errorf("secret was not encrypted: %v", sealed)
+	}
+
+	opened, err := box.Open(sealed)
+	if err != nil || opened != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("wrong secret opened: %v %v", opened, err)
+	}
+
+	other, err := NewSecretBox(base64.StdEncoding.EncodeToString([]byte("fedcba9876543210fedcba9876543210")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = other.Open(sealed); err == nil {
+		t.Error("secret opened with the wrong key")
+	}
+
+	if _, err = NewSecretBox("c2hvcnQ="); err == nil {
+		t.Error("short key was accepted")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := NewRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(codes) != RecoveryCodeCount || len(hashes) != RecoveryCodeCount {
+		t.Fatalf("wrong number of codes: %v", codes)
+	}
+
+	if HashRecoveryCode(strings.ToUpper(strings.ReplaceAll(codes[0], "-", " "))) != hashes[0] {
+		t.Error("code typed differently has a different hash")
+	}
+
+	if codes[0] == codes[1] {
+		t.Error("codes are not unique")
+	}
+}
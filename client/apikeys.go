@@ -0,0 +1,199 @@
+package client
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	auth "github.com/omgitsotis/user-service/auth"
+	"github.com/omgitsotis/user-service/dblayer/persistence"
+)
+
+// apiKeyResponse is an API key along with its secret. The secret is only
+// ever returned when the key is created or rotated.
+type apiKeyResponse struct {
+	*persistence.Token
+	Key string `json:"key"`
+}
+
+// createAPIKeyHandler creates an API key with the name and scopes in the
+// form. Scopes can be given as repeated scope fields or a comma separated
+// list.
+func (ush *userServiceHandler) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("[UserServiceHandler] Recieved POST request on /admin/apikeys")
+
+	if !ush.authorize(w, r, auth.ActionManageKeys, "") {
+		return
+	}
+
+	r.ParseForm()
+	name := r.FormValue("name")
+	if name == "" {
+		log.Println("[UserServiceHandler] no api key name")
+		ush.writeErrorResponse(w, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	scopes := make([]string, 0)
+	for _, field := range r.Form["scope"] {
+		for _, scope := range strings.Split(field, ",") {
+			scope = strings.TrimSpace(scope)
+			if !auth.IsScope(scope) {
+				log.Printf("[UserServiceHandler] invalid scope %s\n", scope)
+				ush.writeErrorResponse(w, "invalid scope "+scope, http.StatusBadRequest)
+				return
+			}
+
+			scopes = append(scopes, scope)
+		}
+	}
+
+	key, hash, err := auth.NewAPIKey()
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error generating api key: %s\n", err.Error())
+		ush.writeErrorResponse(w, "could not create api key", http.StatusInternalServerError)
+		return
+	}
+
+	token, err := ush.dbHandler.AddToken(persistence.Token{
+		Kind:      persistence.TokenAPIKey,
+		Hash:      hash,
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error adding api key: %s\n", err.Error())
+		ush.writeErrorResponse(w, "could not create api key", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[Audit] %v created api key %s (%s)\n", requestPrincipal(r), token.ID, token.Name)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(apiKeyResponse{token, key})
+}
+
+// listAPIKeysHandler returns every API key, including revoked ones, without
+// their secrets.
+func (ush *userServiceHandler) listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("[UserServiceHandler] Recieved GET request on /admin/apikeys")
+
+	if !ush.authorize(w, r, auth.ActionManageKeys, "") {
+		return
+	}
+
+	tokens, err := ush.dbHandler.FindTokensByKind(persistence.TokenAPIKey)
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error listing api keys: %s\n", err.Error())
+		ush.writeErrorResponse(w, "could not list api keys", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(&tokens)
+}
+
+// rotateAPIKeyHandler gives an API key a new secret. The old secret stops
+// working straight away.
+func (ush *userServiceHandler) rotateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[UserServiceHandler] Recieved POST request on %s\n", r.URL.String())
+
+	if !ush.authorize(w, r, auth.ActionManageKeys, "") {
+		return
+	}
+
+	token, ok := ush.findAPIKey(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+
+	if token.Revoked() {
+		log.Printf("[UserServiceHandler] api key %s is revoked\n", token.ID)
+		ush.writeErrorResponse(w, "api key is revoked", http.StatusConflict)
+		return
+	}
+
+	key, hash, err := auth.NewAPIKey()
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error generating api key: %s\n", err.Error())
+		ush.writeErrorResponse(w, "could not rotate api key", http.StatusInternalServerError)
+		return
+	}
+
+	token.Hash = hash
+	token, err = ush.dbHandler.UpdateToken(*token)
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error rotating api key: %s\n", err.Error())
+		ush.writeErrorResponse(w, "could not rotate api key", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[Audit] %v rotated api key %s (%s)\n", requestPrincipal(r), token.ID, token.Name)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(apiKeyResponse{token, key})
+}
+
+// revokeAPIKeyHandler stops an API key from working. The key is kept so it
+// can still be audited. Revoking a revoked key does nothing.
+func (ush *userServiceHandler) revokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[UserServiceHandler] Recieved DELETE request on %s\n", r.URL.String())
+
+	if !ush.authorize(w, r, auth.ActionManageKeys, "") {
+		return
+	}
+
+	token, ok := ush.findAPIKey(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+
+	if !token.Revoked() {
+		var err error
+		now := time.Now().UTC()
+		token.RevokedAt = &now
+		token, err = ush.dbHandler.UpdateToken(*token)
+		if err != nil {
+			log.Printf("[UserServiceHandler] Error revoking api key: %s\n", err.Error())
+			ush.writeErrorResponse(w, "could not revoke api key", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("[Audit] %v revoked api key %s (%s)\n", requestPrincipal(r), token.ID, token.Name)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(token)
+}
+
+// findAPIKey looks up the API key with ID id, writing a 404 if there isn't
+// one.
+func (ush *userServiceHandler) findAPIKey(w http.ResponseWriter, id string) (*persistence.Token, bool) {
+	token, err := ush.dbHandler.FindTokenByID(id)
+	if err == nil && token.Kind != persistence.TokenAPIKey {
+		err = persistence.ErrTokenNotFound
+	}
+
+	if err == persistence.ErrTokenNotFound {
+		log.Printf("[UserServiceHandler] no api key found with ID %s\n", id)
+		ush.writeErrorResponse(w, "no api key found with ID", http.StatusNotFound)
+		return nil, false
+	}
+
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error finding api key: %s\n", err.Error())
+		ush.writeErrorResponse(w, "could not find api key", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return token, true
+}
+
+// requestPrincipal returns who made a request, or nil if the API is open.
+func requestPrincipal(r *http.Request) *auth.Principal {
+	p, _ := auth.PrincipalFromContext(r.Context())
+	return p
+}
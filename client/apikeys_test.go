@@ -0,0 +1,191 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	dblayer "github.com/omgitsotis/user-service/dblayer"
+	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+)
+
+// keyRequest makes a request as the admin when key is empty, or with the API
+// key otherwise.
+func keyRequest(t *testing.T, r *mux.Router, method, path string, form url.Values, key string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	if key == "" {
+		req.Header.Set("Authorization", "Bearer "+testToken(t, "1", persistence.RoleAdmin))
+	} else {
+		req.Header.Set("X-API-Key", key)
+	}
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	return rr
+}
+
+func createKey(t *testing.T, r *mux.Router, form url.Values) apiKeyResponse {
+	rr := keyRequest(t, r, "POST", "/admin/apikeys", form, "")
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v",
+			status, http.StatusCreated)
+	}
+
+	key := apiKeyResponse{}
+	if err := json.NewDecoder(rr.Body).Decode(&key); err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	mockDB, err := dblayer.NewPersistenceLayer(dblayer.MOCKDB, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AddSearchUsers(mockDB)
+	r := Router(mockDB, WithAuthenticator(testAuthenticator(t)))
+
+	created := createKey(t, r, url.Values{"name": {"exporter"}, "scope": {"read,search"}})
+	if created.Key == "" || created.Name != "exporter" || len(created.Scopes) != 2 {
+		t.Fatalf("wrong key created: %+v", created)
+	}
+
+	stored, err := mockDB.FindTokenByID(created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored.Hash == created.Key {
+		t.Error("api key was stored in plaintext")
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		status int
+	}{
+		{"read", "GET", "/user/2", http.StatusOK},
+		{"search", "GET", "/search/country/usa", http.StatusOK},
+		{"delete without scope", "DELETE", "/user/2", http.StatusForbidden},
+		{"update without scope", "PUT", "/user/2", http.StatusForbidden},
+		{"manage keys", "GET", "/admin/apikeys", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		if status := keyRequest(t, r, tt.method, tt.path, nil, created.Key).Code; status != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.name, status, tt.status)
+		}
+	}
+
+	rr := keyRequest(t, r, "POST", "/admin/apikeys/"+created.ID+"/rotate", nil, "")
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	// Times that aren't set are left out rather than zero.
+	if body := rr.Body.String(); strings.Contains(body, "revoked_at") || strings.Contains(body, "expires_at") {
+		t.Errorf("unset times were returned: %s", body)
+	}
+
+	rotated := apiKeyResponse{}
+	if err = json.NewDecoder(rr.Body).Decode(&rotated); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := keyRequest(t, r, "GET", "/user/2", nil, created.Key).Code; status != http.StatusUnauthorized {
+		t.Errorf("old key still works after rotation: got %v want %v",
+			status, http.StatusUnauthorized)
+	}
+
+	if status := keyRequest(t, r, "GET", "/user/2", nil, rotated.Key).Code; status != http.StatusOK {
+		t.Errorf("rotated key doesn't work: got %v want %v", status, http.StatusOK)
+	}
+
+	if status := keyRequest(t, r, "DELETE", "/admin/apikeys/"+created.ID, nil, "").Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	if status := keyRequest(t, r, "GET", "/user/2", nil, rotated.Key).Code; status != http.StatusUnauthorized {
+		t.Errorf("revoked key still works: got %v want %v", status, http.StatusUnauthorized)
+	}
+
+	rr = keyRequest(t, r, "GET", "/admin/apikeys", nil, "")
+	body := rr.Body.String()
+	var keys []*persistence.Token
+	if err = json.Unmarshal([]byte(body), &keys); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 1 || !keys[0].Revoked() {
+		t.Errorf("listed wrong keys: %v", keys)
+	}
+
+	if strings.Contains(body, rotated.Key) || strings.Contains(body, stored.Hash) {
+		t.Errorf("list returned a secret: %s", body)
+	}
+}
+
+func TestAPIKeyAdminRoutes(t *testing.T) {
+	mockDB, err := dblayer.NewPersistenceLayer(dblayer.MOCKDB, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := Router(mockDB, WithAuthenticator(testAuthenticator(t)))
+	created := createKey(t, r, url.Values{"name": {"billing"}, "scope": {"read"}})
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		form   url.Values
+		status int
+	}{
+		{"no name", "POST", "/admin/apikeys", url.Values{"scope": {"read"}}, http.StatusBadRequest},
+		{"bad scope", "POST", "/admin/apikeys", url.Values{"name": {"x"}, "scope": {"admin"}}, http.StatusBadRequest},
+		{"rotate missing key", "POST", "/admin/apikeys/99/rotate", nil, http.StatusNotFound},
+		{"revoke missing key", "DELETE", "/admin/apikeys/99", nil, http.StatusNotFound},
+		{"revoke", "DELETE", "/admin/apikeys/" + created.ID, nil, http.StatusOK},
+		{"revoke again", "DELETE", "/admin/apikeys/" + created.ID, nil, http.StatusOK},
+		{"rotate revoked key", "POST", "/admin/apikeys/" + created.ID + "/rotate", nil, http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		if status := keyRequest(t, r, tt.method, tt.path, tt.form, "").Code; status != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.name, status, tt.status)
+		}
+	}
+
+	// Only admins can manage keys.
+	req, err := http.NewRequest("GET", "/admin/apikeys", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+testToken(t, "2", persistence.RoleService))
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,225 @@
+package client
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	auth "github.com/omgitsotis/user-service/auth"
+	"github.com/omgitsotis/user-service/dblayer/persistence"
+)
+
+// verifyCredentialsHandler checks an email or nickname and password against
+// the stored users. It returns the user when they match, so other services
+// can authenticate users without ever seeing a password.
+func (ush *userServiceHandler) verifyCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("[UserServiceHandler] Recieved POST request on /auth/verify")
+
+	if !ush.authorize(w, r, auth.ActionVerify, "") {
+		return
+	}
+
+	user, ok := ush.formCredentials(w, r)
+	if !ok {
+		return
+	}
+
+	ush.hideLockout(r, user)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(user)
+}
+
+// formCredentials checks the email or nickname and password in a form
+// against the stored users and returns the user they belong to. Users with
+// mfa enabled also need a code or recovery_code. Failures count towards
+// locking out the user and the address they came from, see
+// auth.LockoutPolicy. If they don't match an error response is written and
+// ok is false.
+func (ush *userServiceHandler) formCredentials(w http.ResponseWriter, r *http.Request) (*persistence.User, bool) {
+	r.ParseForm()
+	email := r.FormValue("email")
+	nickname := r.FormValue("nickname")
+	password := r.FormValue("password")
+
+	criteria, value := "email", email
+	if email == "" {
+		criteria, value = "nickname", nickname
+	}
+
+	if value == "" || password == "" {
+		log.Println("[UserServiceHandler] missing credentials")
+		ush.writeErrorResponse(w, "email or nickname and password are required", http.StatusBadRequest)
+		return nil, false
+	}
+
+	users, err := ush.dbHandler.FindUserByCriteria(criteria, value)
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error verifying credentials: %s\n", err.Error())
+		ush.writeErrorResponse(w, "could not verify credentials", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	// Locked out users aren't checked at all, so guesses made while they
+	// are locked can't be right.
+	now := time.Now().UTC()
+	if !ush.checkLockout(w, r, users, now) {
+		return nil, false
+	}
+
+	user := ush.checkCredentials(users, password)
+	if user == nil {
+		log.Printf("[UserServiceHandler] invalid credentials for %s %s\n", criteria, value)
+		ush.recordFailure(r, users, now)
+		ush.writeErrorResponse(w, "invalid credentials", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	if !ush.checkSecondFactor(w, r, user) {
+		// Asking for the code isn't a failure, getting it wrong is.
+		if r.FormValue("code") != "" || r.FormValue("recovery_code") != "" {
+			ush.recordFailure(r, []*persistence.User{user}, now)
+		}
+
+		return nil, false
+	}
+
+	if user.Lockout != nil {
+		if err = ush.clearLockout(user.ID); err != nil {
+			log.Printf("[UserServiceHandler] Error clearing failed logins for user %s: %s\n", user.ID, err.Error())
+		}
+
+		user.Lockout = nil
+	}
+
+	return user, true
+}
+
+// checkCredentials returns the user out of users whose password matches, or
+// nil if there isn't one. A plaintext or outdated password hash is replaced
+// with a fresh hash once it has matched.
+func (ush *userServiceHandler) checkCredentials(users []*persistence.User, password string) *persistence.User {
+	if len(users) == 0 {
+		auth.CheckNoUser(password)
+		return nil
+	}
+
+	for _, user := range users {
+		ok, rehash := auth.CheckPassword(user.Password, password)
+		if !ok {
+			continue
+		}
+
+		if rehash {
+			ush.upgradePassword(user, password)
+		}
+
+		return user
+	}
+
+	return nil
+}
+
+// upgradePassword stores a fresh hash of a password that has just been
+// checked. Failing to is logged but not fatal, it will be tried again on the
+// next check.
+func (ush *userServiceHandler) upgradePassword(user *persistence.User, password string) {
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error rehashing password for user %s: %s\n", user.ID, err.Error())
+		return
+	}
+
+	if _, err = ush.dbHandler.UpdateUser(persistence.User{ID: user.ID, Password: hash}); err != nil {
+		log.Printf("[UserServiceHandler] Error upgrading password for user %s: %s\n", user.ID, err.Error())
+		return
+	}
+
+	log.Printf("[UserServiceHandler] upgraded password hash for user %s\n", user.ID)
+}
+
+// authenticate is middleware that rejects requests without a valid bearer
+// token or API key. The principal the token or key was issued to is added to
+// the request context for the handlers, see auth.PrincipalFromContext.
+func (ush *userServiceHandler) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key := r.Header.Get("X-API-Key"); key != "" {
+			ush.authenticateAPIKey(w, r, key, next)
+			return
+		}
+
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			log.Printf("[UserServiceHandler] no bearer token on %s %s\n", r.Method, r.URL.Path)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			ush.writeErrorResponse(w, "missing bearer token", http.StatusUnauthorized)
+			return
+		}
+
+		principal, err := ush.authenticator.Authenticate(strings.TrimPrefix(header, "Bearer "))
+		if err != nil {
+			log.Printf("[UserServiceHandler] invalid token on %s %s: %s\n", r.Method, r.URL.Path, err.Error())
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			ush.writeErrorResponse(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(auth.WithPrincipal(r.Context(), principal)))
+	})
+}
+
+// authenticateAPIKey looks up the API key a request was made with and passes
+// the request on to next as the key if it is valid.
+func (ush *userServiceHandler) authenticateAPIKey(w http.ResponseWriter, r *http.Request, key string, next http.Handler) {
+	token, err := ush.dbHandler.FindTokenByHash(auth.HashToken(key))
+	if err == persistence.ErrTokenNotFound || (err == nil && (token.Kind != persistence.TokenAPIKey || token.Revoked())) {
+		log.Printf("[UserServiceHandler] invalid api key on %s %s\n", r.Method, r.URL.Path)
+		ush.writeErrorResponse(w, "invalid api key", http.StatusUnauthorized)
+		return
+	}
+
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error looking up api key: %s\n", err.Error())
+		ush.writeErrorResponse(w, "could not check api key", http.StatusInternalServerError)
+		return
+	}
+
+	principal := auth.APIKeyPrincipal(token)
+	log.Printf("[UserServiceHandler] %s %s by %v\n", r.Method, r.URL.Path, principal)
+	next.ServeHTTP(w, r.WithContext(auth.WithPrincipal(r.Context(), principal)))
+}
+
+// authorize checks the principal that made the request may perform action on
+// the user with ID ownerID, writing a 403 if not. Every decision is logged as
+// an audit entry naming the principal. Every request is allowed when there
+// is no authenticator, as the API is open.
+func (ush *userServiceHandler) authorize(w http.ResponseWriter, r *http.Request, action, ownerID string) bool {
+	if ush.authenticator == nil {
+		return true
+	}
+
+	principal, _ := auth.PrincipalFromContext(r.Context())
+	if !ush.policy.Allowed(principal, action, ownerID) {
+		log.Printf("[Audit] %v denied %s %s\n", principal, action, ownerID)
+		ush.writeErrorResponse(w, "not allowed to "+action, http.StatusForbidden)
+		return false
+	}
+
+	log.Printf("[Audit] %v allowed %s %s\n", principal, action, ownerID)
+	return true
+}
+
+// authorizeRole checks role is a real role and that the principal may give
+// it to the user with ID ownerID.
+func (ush *userServiceHandler) authorizeRole(w http.ResponseWriter, r *http.Request, role, ownerID string) bool {
+	switch role {
+	case persistence.RoleAdmin, persistence.RoleUser, persistence.RoleService:
+	default:
+		log.Printf("[UserServiceHandler] invalid role %s\n", role)
+		ush.writeErrorResponse(w, "invalid role", http.StatusBadRequest)
+		return false
+	}
+
+	return ush.authorize(w, r, auth.ActionSetRole, ownerID)
+}
@@ -0,0 +1,287 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+
+	auth "github.com/omgitsotis/user-service/auth"
+	dblayer "github.com/omgitsotis/user-service/dblayer"
+	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+)
+
+func verifyRequest(t *testing.T, dbh dblayer.DatabaseHandler, form url.Values) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("POST", "/auth/verify", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	rr := httptest.NewRecorder()
+	Router(dbh).ServeHTTP(rr, req)
+	return rr
+}
+
+func TestVerifyCredentials(t *testing.T) {
+	mockDB, err := dblayer.NewPersistenceLayer(dblayer.MOCKDB, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The test user's password is stored in plaintext, like users created
+	// before passwords were hashed.
+	AddTestUser(mockDB)
+
+	form := url.Values{}
+	form.Add("email", "klay_thompson@mail.com")
+	form.Add("password", "password")
+
+	rr := verifyRequest(t, mockDB, form)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	if bytes.Contains(rr.Body.Bytes(), []byte("password")) {
+		t.Errorf("handler returned the password: %s", rr.Body.String())
+	}
+
+	var user persistence.User
+	if err = json.NewDecoder(rr.Body).Decode(&user); err != nil {
+		t.Fatal(err)
+	}
+
+	if user.ID != "1" {
+		t.Errorf("handler returned wrong user: got %v want %v", user.ID, "1")
+	}
+
+	stored, err := mockDB.FindUserByID("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !auth.IsHashed(stored.Password) {
+		t.Errorf("plaintext password was not upgraded: %v", stored.Password)
+	}
+
+	// The upgraded hash must still verify, this time by nickname.
+	form = url.Values{}
+	form.Add("nickname", "Splash Brother")
+	form.Add("password", "password")
+
+	if status := verifyRequest(t, mockDB, form).Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+}
+
+func TestVerifyCredentialsInvalid(t *testing.T) {
+	mockDB, err := dblayer.NewPersistenceLayer(dblayer.MOCKDB, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AddTestUser(mockDB)
+
+	tests := []struct {
+		name   string
+		form   url.Values
+		status int
+	}{
+		{
+			"wrong password",
+			url.Values{"email": {"klay_thompson@mail.com"}, "password": {"dorwssap"}},
+			http.StatusUnauthorized,
+		},
+		{
+			"unknown user",
+			url.Values{"nickname": {"Iblocka"}, "password": {"password"}},
+			http.StatusUnauthorized,
+		},
+		{
+			"no password",
+			url.Values{"email": {"klay_thompson@mail.com"}},
+			http.StatusBadRequest,
+		},
+		{
+			"no email or nickname",
+			url.Values{"password": {"password"}},
+			http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		if status := verifyRequest(t, mockDB, tt.form).Code; status != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.name, status, tt.status)
+		}
+	}
+}
+
+const testSecret = "s3cr3t"
+
+func testAuthenticator(t *testing.T) *auth.Authenticator {
+	a, err := auth.NewAuthenticator(testSecret, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a
+}
+
+func testToken(t *testing.T, subject, role string) string {
+	claims := auth.Claims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   subject,
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
+		Role: role,
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func TestAuthenticationRequired(t *testing.T) {
+	mockDB, err := dblayer.NewPersistenceLayer(dblayer.MOCKDB, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AddTestUser(mockDB)
+	r := Router(mockDB, WithAuthenticator(testAuthenticator(t)))
+
+	tests := []struct {
+		name   string
+		path   string
+		token  string
+		status int
+	}{
+		{"healthcheck is public", "/", "", http.StatusOK},
+		{"no token", "/user/1", "", http.StatusUnauthorized},
+		{"bad token", "/user/1", "not.a.token", http.StatusUnauthorized},
+		{"valid token", "/user/1", testToken(t, "1", persistence.RoleUser), http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.name, status, tt.status)
+		}
+
+		if tt.status != http.StatusUnauthorized {
+			continue
+		}
+
+		var er ErrorResponse
+		if err = json.NewDecoder(rr.Body).Decode(&er); err != nil || er.Error == "" {
+			t.Errorf("%s: handler did not return an ErrorResponse: %v", tt.name, err)
+		}
+	}
+}
+
+func TestAuthenticatePutsPrincipalInContext(t *testing.T) {
+	ush := newUserHandler(nil, WithAuthenticator(testAuthenticator(t)))
+
+	var subject string
+	handler := ush.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p, ok := auth.PrincipalFromContext(r.Context()); ok {
+			subject = p.Subject
+		}
+	}))
+
+	req, err := http.NewRequest("GET", "/user/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+testToken(t, "42", persistence.RoleUser))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if subject != "42" {
+		t.Errorf("wrong subject in context: got %v want %v", subject, "42")
+	}
+}
+
+func TestAccessPolicy(t *testing.T) {
+	mockDB, err := dblayer.NewPersistenceLayer(dblayer.MOCKDB, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AddSearchUsers(mockDB)
+	r := Router(mockDB, WithAuthenticator(testAuthenticator(t)))
+
+	admin := testToken(t, "1", persistence.RoleAdmin)
+	user := testToken(t, "2", persistence.RoleUser)
+	service := testToken(t, "billing", persistence.RoleService)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		form   url.Values
+		token  string
+		status int
+	}{
+		{"user gets self", "GET", "/user/2", nil, user, http.StatusOK},
+		{"user gets other", "GET", "/user/3", nil, user, http.StatusForbidden},
+		{"user updates self", "PUT", "/user/2", url.Values{"country": {"GB"}}, user, http.StatusOK},
+		{"user updates other", "PUT", "/user/3", url.Values{"country": {"GB"}}, user, http.StatusForbidden},
+		{"user makes self admin", "PUT", "/user/2", url.Values{"role": {"admin"}}, user, http.StatusForbidden},
+		{"user searches", "GET", "/search/country/usa", nil, user, http.StatusForbidden},
+		{"user deletes self", "DELETE", "/user/2", nil, user, http.StatusForbidden},
+		{"service gets user", "GET", "/user/3", nil, service, http.StatusOK},
+		{"service deletes user", "DELETE", "/user/3", nil, service, http.StatusForbidden},
+		{"admin searches", "GET", "/search/country/usa", nil, admin, http.StatusOK},
+		{"admin sets bad role", "PUT", "/user/3", url.Values{"role": {"root"}}, admin, http.StatusBadRequest},
+		{"admin sets role", "PUT", "/user/3", url.Values{"role": {"service"}}, admin, http.StatusOK},
+		{"admin deletes user", "DELETE", "/user/3", nil, admin, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.path, strings.NewReader(tt.form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.name, status, tt.status)
+		}
+	}
+
+	if _, err = mockDB.FindUserByID("2"); err != nil {
+		t.Error("user was able to delete themselves")
+	}
+}
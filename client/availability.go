@@ -0,0 +1,43 @@
+package client
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/omgitsotis/user-service/dblayer/persistence"
+)
+
+// availabilityResponse says whether a nickname is free.
+type availabilityResponse struct {
+	Nickname  string `json:"nickname"`
+	Available bool   `json:"available"`
+}
+
+// availabilityHandler checks whether the nickname query parameter is free,
+// ignoring case as the database does. A nickname that breaks the validation
+// rules gets the same 400 creating a user with it would.
+func (ush *userServiceHandler) availabilityHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[UserServiceHandler] Recieved GET request on %s\n", r.URL.String())
+
+	user := persistence.User{Nickname: r.URL.Query().Get("nickname")}
+	if user.Nickname == "" {
+		log.Println("[UserServiceHandler] no nickname to check")
+		ush.writeErrorResponse(w, "nickname is required", http.StatusBadRequest)
+		return
+	}
+
+	if !ush.validUser(w, &user, false) {
+		return
+	}
+
+	users, err := ush.dbHandler.FindUserByCriteria("nickname", user.Nickname)
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error checking nickname: %s\n", err.Error())
+		ush.writeErrorResponse(w, "could not check nickname", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(availabilityResponse{user.Nickname, len(users) == 0})
+}
@@ -0,0 +1,111 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	dblayer "github.com/omgitsotis/user-service/dblayer"
+)
+
+func TestAvailability(t *testing.T) {
+	mockDB, err := dblayer.NewPersistenceLayer(dblayer.MOCKDB, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AddTestUser(mockDB)
+	r := Router(mockDB, WithAuthenticator(testAuthenticator(t)))
+
+	tests := []struct {
+		nickname  string
+		status    int
+		available bool
+	}{
+		{"Splash Brother", http.StatusOK, false},
+		{"SPLASH brother", http.StatusOK, false},
+		{"Splash Sister", http.StatusOK, true},
+		{"ab", http.StatusBadRequest, false},
+		{"", http.StatusBadRequest, false},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/availability?"+url.Values{"nickname": {tt.nickname}}.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%q: handler returned wrong status code: got %v want %v", tt.nickname, status, tt.status)
+			continue
+		}
+
+		if tt.status != http.StatusOK {
+			continue
+		}
+
+		resp := availabilityResponse{}
+		if err = json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Available != tt.available {
+			t.Errorf("%q: wrong availability: got %v want %v", tt.nickname, resp.Available, tt.available)
+		}
+	}
+}
+
+func TestUserConflict(t *testing.T) {
+	mockDB, err := dblayer.NewPersistenceLayer(dblayer.MOCKDB, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AddSearchUsers(mockDB)
+	r := Router(mockDB)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		form   url.Values
+		field  string
+	}{
+		{"create with taken email", "POST", "/user", url.Values{
+			"first_name": {"Klay"},
+			"email":      {"Klay_Thompson@Mail.com"},
+			"password":   {"correct horse"},
+		}, "email"},
+		{"update to taken nickname", "PUT", "/user/2", url.Values{"nickname": {"chef curry"}}, "nickname"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.path, strings.NewReader(tt.form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusConflict {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tt.name, status, http.StatusConflict)
+			continue
+		}
+
+		er := ErrorResponse{}
+		if err = json.NewDecoder(rr.Body).Decode(&er); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(er.Fields) != 1 || er.Fields[0].Field != tt.field || er.Fields[0].Code != "taken" {
+			t.Errorf("%s: wrong conflict: %+v", tt.name, er)
+		}
+	}
+}
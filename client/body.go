@@ -0,0 +1,126 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/omgitsotis/user-service/validation"
+)
+
+// maxBodyBytes is the largest body a user can be sent in.
+const maxBodyBytes = 1 << 20
+
+// userBody is a user as sent to create or update one, in JSON or as a form.
+type userBody struct {
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Nickname  string `json:"nickname"`
+	Password  string `json:"password"`
+	Email     string `json:"email"`
+	Country   string `json:"country"`
+	Role      string `json:"role"`
+}
+
+// readUserBody reads the user from the body of a POST or PUT. The body is
+// decoded by its Content-Type: JSON bodies must only have the fields of a
+// user, and forms are read as they always were. A request without a
+// Content-Type is treated as a form. Anything else gets a 415. It writes the
+// error and returns false if the body can't be read.
+func (ush *userServiceHandler) readUserBody(w http.ResponseWriter, r *http.Request) (userBody, bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+
+	mediaType := "application/x-www-form-urlencoded"
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(ct); err != nil {
+			log.Printf("[UserServiceHandler] bad content type %q: %s\n", ct, err.Error())
+			ush.writeErrorResponse(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return userBody{}, false
+		}
+	}
+
+	var err error
+	switch mediaType {
+	case "application/json":
+		return ush.readJSONBody(w, r)
+	case "application/x-www-form-urlencoded":
+		err = r.ParseForm()
+	case "multipart/form-data":
+		err = r.ParseMultipartForm(maxBodyBytes)
+	default:
+		log.Printf("[UserServiceHandler] unsupported content type %q\n", mediaType)
+		ush.writeErrorResponse(w, "unsupported content type", http.StatusUnsupportedMediaType)
+		return userBody{}, false
+	}
+
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error parsing form: %s\n", err.Error())
+		ush.writeErrorResponse(w, "invalid form", http.StatusBadRequest)
+		return userBody{}, false
+	}
+
+	return userBody{
+		FirstName: r.FormValue("first_name"),
+		LastName:  r.FormValue("last_name"),
+		Nickname:  r.FormValue("nickname"),
+		Password:  r.FormValue("password"),
+		Email:     r.FormValue("email"),
+		Country:   r.FormValue("country"),
+		Role:      r.FormValue("role"),
+	}, true
+}
+
+// readJSONBody decodes a single JSON object, rejecting fields a user doesn't
+// have and values of the wrong type with a 400 naming the field.
+func (ush *userServiceHandler) readJSONBody(w http.ResponseWriter, r *http.Request) (userBody, bool) {
+	var body userBody
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(&body)
+	if err == nil {
+		if _, tErr := dec.Token(); tErr != io.EOF {
+			err = errors.New("json: data after the object")
+		}
+	}
+
+	if err == nil {
+		return body, true
+	}
+
+	log.Printf("[UserServiceHandler] Error decoding JSON: %s\n", err.Error())
+
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &typeErr):
+		ush.writeError(w, ErrorResponse{
+			Error: "invalid json",
+			Fields: validation.Errors{
+				{Field: typeErr.Field, Code: validation.CodeInvalidType, Message: "must be a " + typeErr.Type.String()},
+			},
+		}, http.StatusBadRequest)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		ush.writeError(w, ErrorResponse{
+			Error: "invalid json",
+			Fields: validation.Errors{
+				{Field: field, Code: validation.CodeUnknownField, Message: "is not a field of a user"},
+			},
+		}, http.StatusBadRequest)
+	default:
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			ush.writeErrorResponse(w, "body too large", http.StatusRequestEntityTooLarge)
+			return userBody{}, false
+		}
+
+		ush.writeErrorResponse(w, "invalid json", http.StatusBadRequest)
+	}
+
+	return userBody{}, false
+}
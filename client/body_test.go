@@ -0,0 +1,93 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	dblayer "github.com/omgitsotis/user-service/dblayer"
+	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+)
+
+func TestUserJSONBody(t *testing.T) {
+	mockDB, err := dblayer.NewPersistenceLayer(dblayer.MOCKDB, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AddTestUser(mockDB)
+	r := Router(mockDB)
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		status      int
+		field       string
+		code        string
+	}{
+		{"create", "POST", "/user", "application/json",
+			`{"first_name":"Steph","last_name":"Curry","nickname":"Chef Curry","email":"steph_curry@mail.com","password":"correct horse","country":"us"}`,
+			http.StatusOK, "", ""},
+		{"update", "PUT", "/user/1", "application/json; charset=UTF-8", `{"country":"gb"}`, http.StatusOK, "", ""},
+		{"unknown field", "POST", "/user", "application/json",
+			`{"first_name":"Draymond","email":"draymond@mail.com","password":"correct horse","admin":true}`,
+			http.StatusBadRequest, "admin", "unknown_field"},
+		{"wrong type", "PUT", "/user/1", "application/json", `{"country":44}`, http.StatusBadRequest, "country", "invalid_type"},
+		{"malformed", "PUT", "/user/1", "application/json", `{"country":"gb"`, http.StatusBadRequest, "", ""},
+		{"two objects", "PUT", "/user/1", "application/json", `{"country":"gb"}{"role":"admin"}`, http.StatusBadRequest, "", ""},
+		{"unsupported", "PUT", "/user/1", "text/plain", "country=gb", http.StatusUnsupportedMediaType, "", ""},
+		{"form", "PUT", "/user/1", "application/x-www-form-urlencoded", "last_name=Thompson", http.StatusOK, "", ""},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Add("Content-Type", tt.contentType)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v: %s", tt.name, status, tt.status, rr.Body.String())
+			continue
+		}
+
+		if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+			t.Errorf("%s: response was not JSON: %v", tt.name, ct)
+		}
+
+		if tt.field == "" {
+			continue
+		}
+
+		er := ErrorResponse{}
+		if err = json.NewDecoder(rr.Body).Decode(&er); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(er.Fields) != 1 || er.Fields[0].Field != tt.field || er.Fields[0].Code != tt.code {
+			t.Errorf("%s: wrong error: %+v", tt.name, er)
+		}
+	}
+
+	users, err := mockDB.FindUserByCriteria("nickname", "Chef Curry")
+	if err != nil || len(users) != 1 || users[0].Country != "US" || users[0].Role != persistence.RoleUser {
+		t.Errorf("user created from JSON was wrong: %+v %v", users, err)
+	}
+
+	user, err := mockDB.FindUserByID("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.Country != "GB" || user.LastName != "Thompson" || user.Role == persistence.RoleAdmin {
+		t.Errorf("user updated from JSON was wrong: %+v", user)
+	}
+}
@@ -1,55 +1,247 @@
 package client
 
 import (
+	"context"
 	"encoding/json"
+	"expvar"
 	"log"
 	"net/http"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	auth "github.com/omgitsotis/user-service/auth"
 	dblayer "github.com/omgitsotis/user-service/dblayer"
 	"github.com/omgitsotis/user-service/dblayer/persistence"
+	filter "github.com/omgitsotis/user-service/filter"
+	notify "github.com/omgitsotis/user-service/notify"
+	search "github.com/omgitsotis/user-service/search"
+	validation "github.com/omgitsotis/user-service/validation"
 )
 
 // userServiceHandler is the handler for the routes of the user handler. It has
-// one field, a database layer interface to handle calls to the database.
+// a database layer interface to handle calls to the database, and an optional
+// authenticator for the routes that need one.
 type userServiceHandler struct {
-	dbHandler dblayer.DatabaseHandler
+	dbHandler     dblayer.DatabaseHandler
+	authenticator *auth.Authenticator
+	policy        auth.Policy
+	notifier      notify.Notifier
+	resetURL      string
+	publicURL     string
+	secretBox     *auth.SecretBox
+	mfaIssuer     string
+	lockout       auth.LockoutPolicy
+	ipThrottle    *auth.Throttle
+	trustProxy    bool
+	searchIndex   *search.Index
+}
+
+// Option configures optional parts of the user service handler.
+type Option func(*userServiceHandler)
+
+// WithAuthenticator requires every route apart from the healthcheck to have a
+// bearer token that a verifies, or an API key. Without an authenticator the
+// routes are open.
+func WithAuthenticator(a *auth.Authenticator) Option {
+	return func(ush *userServiceHandler) {
+		ush.authenticator = a
+	}
+}
+
+// WithPolicy sets the access policy the handlers check authenticated
+// requests against. It defaults to auth.DefaultPolicy.
+func WithPolicy(p auth.Policy) Option {
+	return func(ush *userServiceHandler) {
+		ush.policy = p
+	}
+}
+
+// WithNotifier sets how messages such as password reset links are sent to
+// users. It defaults to notify.LogNotifier, which only logs them.
+func WithNotifier(n notify.Notifier) Option {
+	return func(ush *userServiceHandler) {
+		ush.notifier = n
+	}
+}
+
+// WithPasswordResetURL sets the page password reset links point at. The
+// reset token is added to it as the token query parameter. Without one the
+// message holds just the token.
+func WithPasswordResetURL(url string) Option {
+	return func(ush *userServiceHandler) {
+		ush.resetURL = url
+	}
+}
+
+// WithPublicURL sets the URL the service is reached at, e.g.
+// https://users.example.com, which links back to the service such as email
+// verification links start with.
+func WithPublicURL(url string) Option {
+	return func(ush *userServiceHandler) {
+		ush.publicURL = strings.TrimSuffix(url, "/")
+	}
+}
+
+// WithMFA lets users set up an authenticator app as a second factor. Their
+// TOTP secrets are encrypted with box, and issuer is the name the app shows
+// them under.
+func WithMFA(box *auth.SecretBox, issuer string) Option {
+	return func(ush *userServiceHandler) {
+		ush.secretBox = box
+		ush.mfaIssuer = issuer
+	}
+}
+
+// WithLockout sets how failed logins lock out the user they were for and
+// the address they came from. They default to auth.DefaultLockoutPolicy and
+// auth.DefaultIPLockoutPolicy.
+func WithLockout(user, ip auth.LockoutPolicy) Option {
+	return func(ush *userServiceHandler) {
+		ush.lockout = user
+		ush.ipThrottle = auth.NewThrottle(ip)
+	}
+}
+
+// WithTrustedProxy takes the address requests come from from the last entry
+// of X-Forwarded-For, for when the service is behind a proxy that sets it.
+// Without a proxy it must not be used, clients could set any address.
+func WithTrustedProxy() Option {
+	return func(ush *userServiceHandler) {
+		ush.trustProxy = true
+	}
+}
+
+// WithSearchIndex serves full text search from index at /users/search, and
+// lets admins rebuild it. The database handler must keep the index in step
+// with changes to users, see dblayer.NewSearchLayer.
+func WithSearchIndex(index *search.Index) Option {
+	return func(ush *userServiceHandler) {
+		ush.searchIndex = index
+	}
 }
 
 // newUserHandler creates a new userServiceHandler with a provided database
 // lasyer
-func newUserHandler(dbh dblayer.DatabaseHandler) *userServiceHandler {
-	return &userServiceHandler{dbHandler: dbh}
+func newUserHandler(dbh dblayer.DatabaseHandler, opts ...Option) *userServiceHandler {
+	ush := &userServiceHandler{
+		dbHandler:  dbh,
+		policy:     auth.DefaultPolicy(),
+		notifier:   &notify.LogNotifier{},
+		lockout:    auth.DefaultLockoutPolicy(),
+		ipThrottle: auth.NewThrottle(auth.DefaultIPLockoutPolicy()),
+	}
+	for _, opt := range opts {
+		opt(ush)
+	}
+
+	return ush
 }
 
 // Router creates the http router and the routes for the user service. It needs to be
 // in a seperate function for testing purposes
-func Router(dbh dblayer.DatabaseHandler) *mux.Router {
-	client := newUserHandler(dbh)
+func Router(dbh dblayer.DatabaseHandler, opts ...Option) *mux.Router {
+	client := newUserHandler(dbh, opts...)
 	r := mux.NewRouter()
 	r.Methods("GET").Path("/").HandlerFunc(client.healthcheck)
 
-	r.Methods("GET").Path("/user/{id}").HandlerFunc(client.getUserHandler)
-	r.Methods("PUT").Path("/user/{id}").HandlerFunc(client.updateUserHandler)
-	r.Methods("POST").Path("/user").HandlerFunc(client.addUserHandler)
-	r.Methods("DELETE").Path("/user/{id}").HandlerFunc(client.deleteUserHandler)
+	// Logging in is how a user gets a token in the first place, so the
+	// session routes are public too. They need a secret to sign tokens
+	// with.
+	if client.authenticator != nil && client.authenticator.CanIssue() {
+		r.Methods("POST").Path("/auth/login").HandlerFunc(client.loginHandler)
+		r.Methods("POST").Path("/auth/refresh").HandlerFunc(client.refreshHandler)
+		r.Methods("POST").Path("/auth/logout").HandlerFunc(client.logoutHandler)
+	}
+
+	// Someone who has forgotten their password can't get a token, so
+	// resetting it is public as well.
+	r.Methods("POST").Path("/password/forgot").HandlerFunc(client.forgotPasswordHandler)
+	r.Methods("POST").Path("/password/reset").HandlerFunc(client.resetPasswordHandler)
+
+	// Verification links are followed from an email, without a token.
+	r.Methods("GET").Path("/verify").HandlerFunc(client.verifyEmailHandler)
+
+	// Signup forms check nicknames before there is a user to have a token.
+	r.Methods("GET").Path("/availability").HandlerFunc(client.availabilityHandler)
+
+	// Everything else needs a token when there is an authenticator. Routes
+	// are matched in the order they are added, so the routes above are
+	// matched before this catch all subrouter.
+	api := r.PathPrefix("/").Subrouter()
+	if client.authenticator != nil {
+		api.Use(client.authenticate)
+	}
+
+	api.Methods("GET").Path("/debug/vars").HandlerFunc(client.metricsHandler)
 
-	// I was contenplating using query params for this route, but I was not sure
-	// if multiple params were allowed, so I chose a more rigid option here.
-	r.Methods("GET").Path("/search/{criteria}/{search}").HandlerFunc(client.searchUserHandler)
+	api.Methods("GET").Path("/user/{id}").HandlerFunc(client.getUserHandler)
+	api.Methods("PUT").Path("/user/{id}").HandlerFunc(client.updateUserHandler)
+	api.Methods("POST").Path("/user").HandlerFunc(client.addUserHandler)
+	api.Methods("DELETE").Path("/user/{id}").HandlerFunc(client.deleteUserHandler)
+	api.Methods("DELETE").Path("/user/{id}/lockout").HandlerFunc(client.unlockUserHandler)
+
+	// Searches for a single criteria. /users takes any number of them as
+	// query params.
+	api.Methods("GET").Path("/search/{criteria}/{search}").HandlerFunc(client.searchUserHandler)
+	api.Methods("GET").Path("/users").HandlerFunc(client.findUsersHandler)
+
+	if client.searchIndex != nil {
+		api.Methods("GET").Path("/users/search").HandlerFunc(client.fullTextSearchHandler)
+		api.Methods("POST").Path("/admin/search/reindex").HandlerFunc(client.reindexHandler)
+	}
+
+	api.Methods("POST").Path("/auth/verify").HandlerFunc(client.verifyCredentialsHandler)
+
+	if client.secretBox != nil {
+		api.Methods("POST").Path("/user/{id}/mfa").HandlerFunc(client.enrollMFAHandler)
+		api.Methods("GET").Path("/user/{id}/mfa/qr").HandlerFunc(client.mfaQRHandler)
+		api.Methods("POST").Path("/user/{id}/mfa/confirm").HandlerFunc(client.confirmMFAHandler)
+		api.Methods("POST").Path("/user/{id}/mfa/recovery-codes").HandlerFunc(client.recoveryCodesHandler)
+		api.Methods("DELETE").Path("/user/{id}/mfa").HandlerFunc(client.disableMFAHandler)
+	}
+
+	api.Methods("POST").Path("/admin/apikeys").HandlerFunc(client.createAPIKeyHandler)
+	api.Methods("GET").Path("/admin/apikeys").HandlerFunc(client.listAPIKeysHandler)
+	api.Methods("POST").Path("/admin/apikeys/{id}/rotate").HandlerFunc(client.rotateAPIKeyHandler)
+	api.Methods("DELETE").Path("/admin/apikeys/{id}").HandlerFunc(client.revokeAPIKeyHandler)
 
 	return r
 }
 
-// ServeAPI starts the router
-func ServeAPI(dbh dblayer.DatabaseHandler, endpoint string) error {	
+// shutdownTimeout is how long requests in flight get to finish when the
+// server is stopped.
+var shutdownTimeout = 10 * time.Second
+
+// ServeAPI starts the router and serves it until ctx is done. It then stops
+// accepting connections and waits for the requests in flight, so whatever
+// they depend on can be closed once it returns.
+func ServeAPI(ctx context.Context, dbh dblayer.DatabaseHandler, endpoint string, opts ...Option) error {
+	srv := &http.Server{Addr: endpoint, Handler: Router(dbh, opts...)}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
+
 	log.Println("[UserServiceHandler] Server started")
-	return http.ListenAndServe(endpoint, Router(dbh))
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Println("[UserServiceHandler] Server shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
 }
 
-// ErrorResponse is a json object to hold error messages.
+// ErrorResponse is a json object to hold error messages. Fields lists every
+// rule an invalid user broke.
 type ErrorResponse struct {
-	Error string `json:"error"`
+	Error  string            `json:"error"`
+	Fields validation.Errors `json:"fields,omitempty"`
 }
 
 // getUserHandler takes an id and returns a user from the database
@@ -64,6 +256,10 @@ func (ush *userServiceHandler) getUserHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	if !ush.authorize(w, r, auth.ActionGetUser, userID) {
+		return
+	}
+
 	user, err := ush.dbHandler.FindUserByID(userID)
 	if err != nil {
 		log.Printf("[UserServiceHandler] Error getting user: %s\n", err.Error())
@@ -71,6 +267,7 @@ func (ush *userServiceHandler) getUserHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	ush.hideLockout(r, user)
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	json.NewEncoder(w).Encode(user)
 }
@@ -80,16 +277,31 @@ func (ush *userServiceHandler) getUserHandler(w http.ResponseWriter, r *http.Req
 func (ush *userServiceHandler) addUserHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("[UserServiceHandler] Recieved POST request on /user")
 
-	r.ParseForm()
-	firstName := r.FormValue("first_name")
-	lastName := r.FormValue("last_name")
-	nickname := r.FormValue("nickname")
-	password := r.FormValue("password")
-	email := r.FormValue("email")
-	country := r.FormValue("country")
+	if !ush.authorize(w, r, auth.ActionCreateUser, "") {
+		return
+	}
 
-	// Validation of the inputs would be here. Not sure if any are mandatory
-	// fields at this point
+	body, ok := ush.readUserBody(w, r)
+	if !ok {
+		return
+	}
+
+	firstName := body.FirstName
+	lastName := body.LastName
+	nickname := body.Nickname
+	password := body.Password
+	email := body.Email
+	country := body.Country
+	role := body.Role
+
+	if role != "" && !ush.authorizeRole(w, r, role, "") {
+		return
+	}
+
+	// New users are regular users unless an admin says otherwise
+	if role == "" {
+		role = persistence.RoleUser
+	}
 
 	user := persistence.User{
 		FirstName: firstName,
@@ -98,15 +310,29 @@ func (ush *userServiceHandler) addUserHandler(w http.ResponseWriter, r *http.Req
 		Password:  password,
 		Email:     email,
 		Country:   country,
+		Role:      role,
+	}
+
+	if !ush.validUser(w, &user, true) {
+		return
 	}
 
+	hash, ok := ush.hashPassword(w, user.Password)
+	if !ok {
+		return
+	}
+
+	user.Password = hash
+
 	addedUser, err := ush.dbHandler.AddUser(user)
 	if err != nil {
 		log.Printf("[UserServiceHandler] Error adding new user: %s\n", err.Error())
-		ush.writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		ush.writeUserError(w, err)
 		return
 	}
 
+	go ush.sendVerification(*addedUser)
+
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	json.NewEncoder(w).Encode(addedUser)
 }
@@ -122,6 +348,10 @@ func (ush *userServiceHandler) deleteUserHandler(w http.ResponseWriter, r *http.
 		return
 	}
 
+	if !ush.authorize(w, r, auth.ActionDeleteUser, userID) {
+		return
+	}
+
 	if err := ush.dbHandler.DeleteUser(userID); err != nil {
 		log.Printf("[UserServiceHandler] Error deleting user: %s\n", err.Error())
 		ush.writeErrorResponse(w, err.Error(), http.StatusBadRequest)
@@ -132,10 +362,15 @@ func (ush *userServiceHandler) deleteUserHandler(w http.ResponseWriter, r *http.
 }
 
 // searchUserHandler takes a criteria string and a search term string and returns
-// a list of all the users that match that criteria
+// a page of the users that match that criteria. With ?match=fuzzy it
+// searches names roughly instead, see fuzzySearch.
 func (ush *userServiceHandler) searchUserHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("[UserServiceHandler] Recieved GET request on /search")
 
+	if !ush.authorize(w, r, auth.ActionSearchUsers, "") {
+		return
+	}
+
 	vars := mux.Vars(r)
 	searchItem, ok := vars["search"]
 	if !ok {
@@ -151,15 +386,71 @@ func (ush *userServiceHandler) searchUserHandler(w http.ResponseWriter, r *http.
 		return
 	}
 
-	users, err := ush.dbHandler.FindUserByCriteria(criteria, searchItem)
-	if err != nil {
-		log.Printf("[UserServiceHandler] Error searching for users: %s\n", err.Error())
-		ush.writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+	q := persistence.Query{Criteria: []persistence.Criterion{{Field: criteria, Value: searchItem}}}
+	if !ush.pageQuery(w, r, &q) {
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	json.NewEncoder(w).Encode(&users)
+	switch match := r.URL.Query().Get("match"); match {
+	case "", "exact":
+		ush.writeUsers(w, r, q)
+	case "fuzzy":
+		ush.fuzzySearch(w, r, criteria, searchItem, q)
+	default:
+		log.Printf("[UserServiceHandler] invalid match %q\n", match)
+		ush.writeErrorResponse(w, "match must be exact or fuzzy", http.StatusBadRequest)
+	}
+}
+
+// findUsersHandler returns the users matching every query param, e.g.
+// /users?country=US&last_name=Curry. Each param apart from the paging ones
+// and filter is a field to search by, and a request without any returns
+// every user. filter is an expression in the language of the filter
+// package, e.g. /users?filter=country eq "US" and email ew "@mail.com".
+func (ush *userServiceHandler) findUsersHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[UserServiceHandler] Recieved GET request on %s\n", r.URL.String())
+
+	if !ush.authorize(w, r, auth.ActionSearchUsers, "") {
+		return
+	}
+
+	params := r.URL.Query()
+	fields := make([]string, 0, len(params))
+	for field := range params {
+		if !pageParams[field] && field != "filter" {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	q := persistence.Query{}
+	for _, field := range fields {
+		for _, value := range params[field] {
+			q.Criteria = append(q.Criteria, persistence.Criterion{Field: field, Value: value})
+		}
+	}
+
+	if f := params.Get("filter"); f != "" {
+		node, err := filter.Parse(f)
+		var cond persistence.Condition
+		if err == nil {
+			cond, err = filter.Compile(node)
+		}
+
+		if err != nil {
+			log.Printf("[UserServiceHandler] invalid filter %q: %s\n", f, err.Error())
+			ush.writeErrorResponse(w, "invalid filter: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		q.Filter = &cond
+	}
+
+	if !ush.pageQuery(w, r, &q) {
+		return
+	}
+
+	ush.writeUsers(w, r, q)
 }
 
 func (ush *userServiceHandler) updateUserHandler(w http.ResponseWriter, r *http.Request) {
@@ -173,12 +464,26 @@ func (ush *userServiceHandler) updateUserHandler(w http.ResponseWriter, r *http.
 		return
 	}
 
-	firstName := r.FormValue("first_name")
-	lastName := r.FormValue("last_name")
-	nickname := r.FormValue("nickname")
-	password := r.FormValue("password")
-	email := r.FormValue("email")
-	country := r.FormValue("country")
+	if !ush.authorize(w, r, auth.ActionUpdateUser, userID) {
+		return
+	}
+
+	body, ok := ush.readUserBody(w, r)
+	if !ok {
+		return
+	}
+
+	firstName := body.FirstName
+	lastName := body.LastName
+	nickname := body.Nickname
+	password := body.Password
+	email := body.Email
+	country := body.Country
+	role := body.Role
+
+	if role != "" && !ush.authorizeRole(w, r, role, userID) {
+		return
+	}
 
 	user := persistence.User{
 		ID:        userID,
@@ -188,28 +493,108 @@ func (ush *userServiceHandler) updateUserHandler(w http.ResponseWriter, r *http.
 		Password:  password,
 		Email:     email,
 		Country:   country,
+		Role:      role,
+	}
+
+	if !ush.validUser(w, &user, false) {
+		return
+	}
+
+	hash, ok := ush.hashPassword(w, user.Password)
+	if !ok {
+		return
 	}
 
+	user.Password = hash
+
 	updUser, err := ush.dbHandler.UpdateUser(user)
 	if err != nil {
 		log.Printf("[UserServiceHandler] Error updating user: %s\n", err.Error())
-		ush.writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		ush.writeUserError(w, err)
 		return
 	}
 
+	// A new email isn't verified, and sending an unverified user's email
+	// again sends them a new link.
+	if email != "" && !updUser.EmailVerified {
+		go ush.sendVerification(*updUser)
+	}
+
+	ush.hideLockout(r, updUser)
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	json.NewEncoder(w).Encode(updUser)
 }
 
+// metricsHandler serves the expvar metrics, which include the event outbox.
+func (ush *userServiceHandler) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !ush.authorize(w, r, auth.ActionReadMetrics, "") {
+		return
+	}
+
+	expvar.Handler().ServeHTTP(w, r)
+}
+
 func (ush *userServiceHandler) healthcheck(w http.ResponseWriter, r *http.Request) {
 	log.Println("[UserServiceHandler] Recieved GET request on /")
 	w.Write([]byte(`{status : ok}`))
 }
 
+// hashPassword hashes a password from a request so the plaintext is never
+// stored. An empty password is left empty, which means it isn't being set.
+// If hashing fails an error response is written and ok is false.
+func (ush *userServiceHandler) hashPassword(w http.ResponseWriter, password string) (string, bool) {
+	if password == "" {
+		return "", true
+	}
+
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error hashing password: %s\n", err.Error())
+		ush.writeErrorResponse(w, "could not set password", http.StatusInternalServerError)
+		return "", false
+	}
+
+	return hash, true
+}
+
 func (ush *userServiceHandler) writeErrorResponse(w http.ResponseWriter, msg string, code int) {
-	w.WriteHeader(code)
+	ush.writeError(w, ErrorResponse{Error: msg}, code)
+}
+
+// validUser checks a user from a create or update request, see
+// validation.User, writing a 400 listing every problem if it isn't valid.
+func (ush *userServiceHandler) validUser(w http.ResponseWriter, user *persistence.User, create bool) bool {
+	errs := validation.User(user, create)
+	if errs == nil {
+		return true
+	}
+
+	log.Printf("[UserServiceHandler] invalid user: %s\n", errs.Error())
+	ush.writeError(w, ErrorResponse{Error: "invalid user", Fields: errs}, http.StatusBadRequest)
+	return false
+}
+
+// writeUserError writes the error from storing a user. One that clashes
+// with another user gets a 409 naming the field.
+func (ush *userServiceHandler) writeUserError(w http.ResponseWriter, err error) {
+	conflict, ok := err.(*persistence.ConflictError)
+	if !ok {
+		ush.writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ush.writeError(w, ErrorResponse{
+		Error: conflict.Error(),
+		Fields: validation.Errors{
+			{Field: conflict.Field, Code: validation.CodeTaken, Message: "is already taken"},
+		},
+	}, http.StatusConflict)
+}
+
+func (ush *userServiceHandler) writeError(w http.ResponseWriter, er ErrorResponse, code int) {
+	// Headers must be set before WriteHeader or they are ignored
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	er := ErrorResponse{msg}
+	w.WriteHeader(code)
 	output, oErr := json.Marshal(er)
 	if oErr != nil {
 		http.Error(w, oErr.Error(), http.StatusBadRequest)
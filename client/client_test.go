@@ -1,13 +1,19 @@
 package client
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
+	auth "github.com/omgitsotis/user-service/auth"
 	dblayer "github.com/omgitsotis/user-service/dblayer"
 	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
 )
@@ -128,7 +134,7 @@ func TestAddUserHandler(t *testing.T) {
 	form.Add("nickname", "omgitsotis")
 	form.Add("password", "p4ssw0rd")
 	form.Add("email", "otis_simon@mail.com")
-	form.Add("country", "UK")
+	form.Add("country", "GB")
 
 	req, err := http.NewRequest("POST", "/user", strings.NewReader(form.Encode()))
 	if err != nil {
@@ -145,6 +151,10 @@ func TestAddUserHandler(t *testing.T) {
 			status, http.StatusOK)
 	}
 
+	if bytes.Contains(rr.Body.Bytes(), []byte("password")) {
+		t.Errorf("handler returned the password: %s", rr.Body.String())
+	}
+
 	var user persistence.User
 	if err = json.NewDecoder(rr.Body).Decode(&user); err != nil {
 		t.Fatal(err)
@@ -170,9 +180,14 @@ func TestAddUserHandler(t *testing.T) {
 			user.FirstName, "omgitsotis")
 	}
 
-	if user.Password != "p4ssw0rd" {
-		t.Errorf("handler returned wrong password: got %v want %v",
-			user.Password, "p4ssw0rd")
+	stored, err := mockDB.FindUserByID(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, _ := auth.CheckPassword(stored.Password, "p4ssw0rd"); !ok || !auth.IsHashed(stored.Password) {
+		t.Errorf("handler stored wrong password: got %v want hash of %v",
+			stored.Password, "p4ssw0rd")
 	}
 
 	if user.Email != "otis_simon@mail.com" {
@@ -180,9 +195,9 @@ func TestAddUserHandler(t *testing.T) {
 			user.Email, "otis_simon@mail.com")
 	}
 
-	if user.Country != "UK" {
+	if user.Country != "GB" {
 		t.Errorf("handler returned wrong email: got %v want %v",
-			user.Country, "UK")
+			user.Country, "GB")
 	}
 }
 
@@ -196,7 +211,7 @@ func TestUpdateUser(t *testing.T) {
 
 	form := url.Values{}
 	form.Add("email", "otis_simon@mail.com")
-	form.Add("country", "UK")
+	form.Add("country", "GB")
 
 	req, err := http.NewRequest("PUT", "/user/1", strings.NewReader(form.Encode()))
 	if err != nil {
@@ -238,9 +253,14 @@ func TestUpdateUser(t *testing.T) {
 			user.FirstName, "Splash Brother")
 	}
 
-	if user.Password != "password" {
-		t.Errorf("handler returned wrong password: got %v want %v",
-			user.Password, "password")
+	stored, err := mockDB.FindUserByID(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored.Password != "password" {
+		t.Errorf("handler changed the password: got %v want %v",
+			stored.Password, "password")
 	}
 
 	if user.Email != "otis_simon@mail.com" {
@@ -248,9 +268,9 @@ func TestUpdateUser(t *testing.T) {
 			user.Email, "otis_simon@mail.com")
 	}
 
-	if user.Country != "UK" {
+	if user.Country != "GB" {
 		t.Errorf("handler returned wrong email: got %v want %v",
-			user.Country, "UK")
+			user.Country, "GB")
 	}
 }
 
@@ -264,7 +284,7 @@ func TestUpdateUserNoUser(t *testing.T) {
 
 	form := url.Values{}
 	form.Add("email", "otis_simon@mail.com")
-	form.Add("country", "UK")
+	form.Add("country", "GB")
 
 	req, err := http.NewRequest("PUT", "/user/2", strings.NewReader(form.Encode()))
 	if err != nil {
@@ -348,14 +368,14 @@ func TestSearchUsers(t *testing.T) {
 			status, http.StatusOK)
 	}
 
-	users := make([]persistence.User, 0)
-	if err = json.NewDecoder(rr.Body).Decode(&users); err != nil {
+	page := usersPage{}
+	if err = json.NewDecoder(rr.Body).Decode(&page); err != nil {
 		t.Fatal(err)
 	}
 
-	if len(users) != 2 {
+	if len(page.Users) != 2 {
 		t.Errorf("handler returned wrong number of users: got %v want %v",
-			len(users), 2)
+			len(page.Users), 2)
 	}
 
 	req, err = http.NewRequest("GET", "/search/nickname/Iblocka", nil)
@@ -369,13 +389,13 @@ func TestSearchUsers(t *testing.T) {
 			status, http.StatusOK)
 	}
 
-	if err = json.NewDecoder(rr.Body).Decode(&users); err != nil {
+	if err = json.NewDecoder(rr.Body).Decode(&page); err != nil {
 		t.Fatal(err)
 	}
 
-	if len(users) != 1 {
+	if len(page.Users) != 1 {
 		t.Errorf("handler returned wrong number of users: got %v want %v",
-			len(users), 1)
+			len(page.Users), 1)
 	}
 
 	req, err = http.NewRequest("GET", "/search/country/uk", nil)
@@ -389,13 +409,395 @@ func TestSearchUsers(t *testing.T) {
 			status, http.StatusOK)
 	}
 
-	if err = json.NewDecoder(rr.Body).Decode(&users); err != nil {
+	if err = json.NewDecoder(rr.Body).Decode(&page); err != nil {
 		t.Fatal(err)
 	}
 
-	if len(users) != 0 {
+	if len(page.Users) != 0 {
 		t.Errorf("handler returned wrong number of users: got %v want %v",
-			len(users), 0)
+			len(page.Users), 0)
+	}
+
+}
+
+func TestFuzzySearch(t *testing.T) {
+	mockDB, err := dblayer.NewPersistenceLayer(dblayer.MOCKDB, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AddSearchUsers(mockDB)
+	r := Router(mockDB)
+
+	tests := []struct {
+		path   string
+		status int
+		want   []string
+	}{
+		{"/search/first_name/klay", http.StatusOK, nil},
+		{"/search/first_name/klay?match=fuzzy", http.StatusOK, []string{"Klay"}},
+		{"/search/first_name/Kaly?match=fuzzy", http.StatusOK, []string{"Klay"}},
+		{"/search/name/steph%20curry?match=fuzzy", http.StatusOK, []string{"Steph"}},
+		{"/search/name/curry?match=fuzzy", http.StatusOK, []string{"Steph"}},
+		{"/search/nickname/splsh?match=fuzzy", http.StatusOK, []string{"Klay"}},
+		{"/search/name/xyz?match=fuzzy", http.StatusOK, []string{}},
+		{"/search/name/klay", http.StatusBadRequest, nil},
+		{"/search/country/usa?match=fuzzy", http.StatusBadRequest, nil},
+		{"/search/first_name/klay?match=fuzzy&sort=last_name", http.StatusBadRequest, nil},
+		{"/search/first_name/klay?match=sounds_like", http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tt.path, status, tt.status)
+			continue
+		}
+
+		if tt.status != http.StatusOK {
+			continue
+		}
+
+		page := rankedPage{}
+		if err = json.NewDecoder(rr.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+
+		got := []string{}
+		for _, u := range page.Users {
+			if u.Score <= 0 || u.Score > 1 {
+				t.Errorf("%s: score out of range: %v", tt.path, u.Score)
+			}
+
+			got = append(got, u.FirstName)
+		}
+
+		if tt.want != nil && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: handler returned wrong users: got %v want %v", tt.path, got, tt.want)
+		}
+
+		if tt.want == nil && len(got) != 0 {
+			t.Errorf("%s: exact search found %v", tt.path, got)
+		}
+	}
+}
+
+func TestFindUsers(t *testing.T) {
+	mockDB, err := dblayer.NewPersistenceLayer(dblayer.MOCKDB, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AddSearchUsers(mockDB)
+	r := Router(mockDB)
+
+	tests := []struct {
+		query  string
+		status int
+		want   int
+	}{
+		{"", http.StatusOK, 3},
+		{"?country=usa", http.StatusOK, 2},
+		{"?country=usa&last_name=Curry", http.StatusOK, 1},
+		{"?country=cameroon&last_name=Curry", http.StatusOK, 0},
+		{"?country=usa&email=STEPH_CURRY@mail.com", http.StatusOK, 1},
+		{"?country=usa&password=password", http.StatusBadRequest, 0},
+		{"?email_verified=maybe", http.StatusBadRequest, 0},
+		{"?filter=" + url.QueryEscape(`country eq "usa" and email ew "@mail.com"`), http.StatusOK, 2},
+		{"?filter=" + url.QueryEscape(`last_name sw "C" or nickname co "Iblock"`), http.StatusOK, 2},
+		{"?country=usa&filter=" + url.QueryEscape(`not (first_name eq "Klay")`), http.StatusOK, 1},
+		{"?filter=" + url.QueryEscape(`country eqq "usa"`), http.StatusBadRequest, 0},
+		{"?filter=" + url.QueryEscape(`password eq "password"`), http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/users"+tt.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%q: handler returned wrong status code: got %v want %v", tt.query, status, tt.status)
+			continue
+		}
+
+		if tt.status != http.StatusOK {
+			continue
+		}
+
+		page := usersPage{}
+		if err = json.NewDecoder(rr.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(page.Users) != tt.want {
+			t.Errorf("%q: handler returned wrong number of users: got %v want %v", tt.query, len(page.Users), tt.want)
+		}
+	}
+
+	req, err := http.NewRequest("GET", "/users?filter="+url.QueryEscape(`country eq "usa" and`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	resp := ErrorResponse{}
+	if err = json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "invalid filter: expected an attribute, got the end of the filter at position 21"
+	if rr.Code != http.StatusBadRequest || resp.Error != want {
+		t.Errorf("wrong response for a bad filter: got %v %q want %q", rr.Code, resp.Error, want)
+	}
+}
+
+func TestFindUsersPages(t *testing.T) {
+	mockDB, err := dblayer.NewPersistenceLayer(dblayer.MOCKDB, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AddSearchUsers(mockDB)
+	r := Router(mockDB)
+
+	get := func(path string) (int, usersPage) {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+
+		page := usersPage{}
+		if rr.Code == http.StatusOK {
+			if err = json.NewDecoder(rr.Body).Decode(&page); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return rr.Code, page
+	}
+
+	// The cursor carries the sort, so it is all the next page needs.
+	var names []string
+	path := "/users?sort=-first_name&limit=2"
+	for path != "" {
+		status, page := get(path)
+		if status != http.StatusOK {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", path, status, http.StatusOK)
+		}
+
+		if page.Total != 3 {
+			t.Errorf("%s: wrong total: got %v want %v", path, page.Total, 3)
+		}
+
+		for _, u := range page.Users {
+			names = append(names, u.FirstName)
+		}
+
+		path = ""
+		if page.NextCursor != nil {
+			path = "/users?cursor=" + url.QueryEscape(*page.NextCursor)
+		}
+	}
+
+	if want := []string{"Steph", "Serge", "Klay"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("wrong users: got %v want %v", names, want)
+	}
+
+	if _, page := get("/search/country/usa?limit=1"); len(page.Users) != 1 || page.Total != 2 || page.NextCursor == nil {
+		t.Errorf("search wasn't paged: %+v", page)
+	}
+
+	for _, path := range []string{
+		"/users?limit=0",
+		"/users?limit=1001",
+		"/users?sort=password",
+		"/users?cursor=nonsense",
+		"/users?sort=last_name&cursor=" + (&persistence.Cursor{Sort: "first_name", Value: "Klay", ID: "1"}).Encode(),
+	} {
+		if status, _ := get(path); status != http.StatusBadRequest {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", path, status, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestUpdateUserPassword(t *testing.T) {
+	mockDB, err := dblayer.NewPersistenceLayer(dblayer.MOCKDB, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AddTestUser(mockDB)
+
+	form := url.Values{}
+	form.Add("password", "n3wp4ssw0rd")
+
+	req, err := http.NewRequest("PUT", "/user/1", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	rr := httptest.NewRecorder()
+	Router(mockDB).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	if bytes.Contains(rr.Body.Bytes(), []byte("password")) {
+		t.Errorf("handler returned the password: %s", rr.Body.String())
+	}
+
+	stored, err := mockDB.FindUserByID("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, _ := auth.CheckPassword(stored.Password, "n3wp4ssw0rd"); !ok || !auth.IsHashed(stored.Password) {
+		t.Errorf("handler stored wrong password: got %v want hash of %v",
+			stored.Password, "n3wp4ssw0rd")
+	}
+
+	if stored.FirstName != "Klay" {
+		t.Errorf("handler changed the first name: got %v want %v",
+			stored.FirstName, "Klay")
 	}
+}
+
+func TestUserValidation(t *testing.T) {
+	mockDB, err := dblayer.NewPersistenceLayer(dblayer.MOCKDB, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AddTestUser(mockDB)
+	r := Router(mockDB)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		form   url.Values
+		fields []string
+	}{
+		{"empty user", "POST", "/user", url.Values{}, []string{"first_name", "email", "password"}},
+		{"bad fields", "POST", "/user", url.Values{
+			"first_name": {"Otis"},
+			"email":      {"otis"},
+			"country":    {"UK"},
+			"password":   {"12345678"},
+		}, []string{"email", "country", "password"}},
+		{"same rules on update", "PUT", "/user/1", url.Values{
+			"email":    {"otis"},
+			"country":  {"UK"},
+			"password": {"12345678"},
+		}, []string{"email", "country", "password"}},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.path, strings.NewReader(tt.form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.name, status, http.StatusBadRequest)
+		}
+
+		er := ErrorResponse{}
+		if err = json.NewDecoder(rr.Body).Decode(&er); err != nil {
+			t.Fatal(err)
+		}
+
+		var fields []string
+		for _, fe := range er.Fields {
+			if fe.Code == "" {
+				t.Errorf("%s: %s has no code", tt.name, fe.Field)
+			}
+
+			fields = append(fields, fe.Field)
+		}
+
+		if strings.Join(fields, ",") != strings.Join(tt.fields, ",") {
+			t.Errorf("%s: wrong fields: got %v want %v", tt.name, fields, tt.fields)
+		}
+	}
+
+	stored, err := mockDB.FindUserByID("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored.Country != "usa" {
+		t.Errorf("invalid update was stored: %v", stored)
+	}
+}
+
+func TestServeAPIShutdown(t *testing.T) {
+	mockDB, err := dblayer.NewPersistenceLayer(dblayer.MOCKDB, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endpoint := l.Addr().String()
+	l.Close()
 
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- ServeAPI(ctx, mockDB, endpoint)
+	}()
+
+	for i := 0; ; i++ {
+		resp, err := http.Get("http://" + endpoint + "/")
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+
+		if i == 50 {
+			t.Fatalf("server never started: %v", err)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("server did not shut down cleanly: %v", err)
+		}
+	case <-time.After(shutdownTimeout):
+		t.Fatal("server did not stop")
+	}
+
+	if _, err := http.Get("http://" + endpoint + "/"); err == nil {
+		t.Error("server still serving after shutdown")
+	}
 }
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+
+	"github.com/omgitsotis/user-service/dblayer/persistence"
+	search "github.com/omgitsotis/user-service/search"
+)
+
+// fuzzyCriteria are the criteria that can be searched with ?match=fuzzy.
+// name searches all of search.NameFields at once.
+var fuzzyCriteria = map[string]bool{"first_name": true, "last_name": true, "nickname": true, "name": true}
+
+// rankedUser is a user found by a fuzzy or full text search, with how well
+// it matched. Full text searches also highlight the fields that matched.
+type rankedUser struct {
+	*persistence.User
+	Score      float64           `json:"score"`
+	Highlights map[string]string `json:"highlights,omitempty"`
+}
+
+// rankedPage is the page of a fuzzy or full text search, in the same shape
+// as usersPage. Results are ranked rather than sorted, so there is only
+// ever one page.
+type rankedPage struct {
+	Users      []rankedUser `json:"users"`
+	Total      int          `json:"total"`
+	NextCursor *string      `json:"next_cursor"`
+}
+
+// ranked checks the page params read into q by pageQuery can be used for
+// ranked results, writing a 400 and returning false if not. Only the limit
+// can.
+func (ush *userServiceHandler) ranked(w http.ResponseWriter, q persistence.Query) bool {
+	if q.Sort != "" || q.After != nil {
+		log.Println("[UserServiceHandler] ranked search given a sort or cursor")
+		ush.writeErrorResponse(w, "results are ranked, so can't be sorted or given a cursor", http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+// fuzzySearch writes the users whose criteria roughly matches text, ignoring
+// case and accents and allowing for typos, best match first. q holds the
+// limit, as the results can't be sorted or paged with a cursor.
+func (ush *userServiceHandler) fuzzySearch(w http.ResponseWriter, r *http.Request, criteria, text string, q persistence.Query) {
+	if !fuzzyCriteria[criteria] {
+		log.Printf("[UserServiceHandler] invalid fuzzy criteria %q\n", criteria)
+		ush.writeErrorResponse(w, "fuzzy search is only for first_name, last_name, nickname or name", http.StatusBadRequest)
+		return
+	}
+
+	if !ush.ranked(w, q) {
+		return
+	}
+
+	all, err := ush.dbHandler.FindUsers(persistence.Query{})
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error searching for users: %s\n", err.Error())
+		ush.writeErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var fields []string
+	if criteria != "name" {
+		fields = []string{criteria}
+	}
+
+	results := search.Names(all.Users, text, fields...)
+	resp := rankedPage{Users: []rankedUser{}, Total: len(results)}
+	if len(results) > q.Limit {
+		results = results[:q.Limit]
+	}
+
+	for _, result := range results {
+		ush.hideLockout(r, result.User)
+		score := math.Round(result.Score*1000) / 1000
+		resp.Users = append(resp.Users, rankedUser{User: result.User, Score: score})
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(&resp)
+}
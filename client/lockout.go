@@ -0,0 +1,141 @@
+package client
+
+import (
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	auth "github.com/omgitsotis/user-service/auth"
+	"github.com/omgitsotis/user-service/dblayer/persistence"
+)
+
+// unlockUserHandler clears the failed logins of a user, and any lock they
+// have put on them.
+func (ush *userServiceHandler) unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[UserServiceHandler] Recieved DELETE request on %s\n", r.URL.String())
+
+	userID := mux.Vars(r)["id"]
+	if !ush.authorize(w, r, auth.ActionUnlockUser, userID) {
+		return
+	}
+
+	if err := ush.clearLockout(userID); err != nil {
+		log.Printf("[UserServiceHandler] Error unlocking user: %s\n", err.Error())
+		ush.writeErrorResponse(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	log.Printf("[Audit] %v unlocked user %s\n", requestPrincipal(r), userID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkLockout writes a 429 if the address a request came from, or any of
+// the users it could be logging in as, is locked out.
+func (ush *userServiceHandler) checkLockout(w http.ResponseWriter, r *http.Request, users []*persistence.User, now time.Time) bool {
+	ip := ush.clientIP(r)
+	if until, locked := ush.ipThrottle.Locked(ip, now); locked && throttleAddress(r) {
+		log.Printf("[Audit] login from %s refused, address locked until %v\n", ip, until)
+		ush.writeLockedResponse(w, until, now)
+		return false
+	}
+
+	for _, user := range users {
+		if user.Lockout.Locked(now) {
+			log.Printf("[Audit] login for user %s from %s refused, locked until %v\n", user.ID, ip, *user.Lockout.LockedUntil)
+			ush.writeLockedResponse(w, *user.Lockout.LockedUntil, now)
+			return false
+		}
+	}
+
+	return true
+}
+
+// recordFailure counts a failed login against the address it came from and
+// each of the users it could have been for.
+func (ush *userServiceHandler) recordFailure(r *http.Request, users []*persistence.User, now time.Time) {
+	if throttleAddress(r) {
+		ip := ush.clientIP(r)
+		if l := ush.ipThrottle.Fail(ip, now); l.Locked(now) {
+			log.Printf("[Audit] %s locked out after %v failed logins\n", ip, l.Failures)
+		}
+	}
+
+	for _, user := range users {
+		l, err := ush.dbHandler.UpdateLockout(user.ID, func(l persistence.Lockout) persistence.Lockout {
+			return ush.lockout.Fail(l, now)
+		})
+		if err != nil {
+			log.Printf("[UserServiceHandler] Error recording failed login for user %s: %s\n", user.ID, err.Error())
+			continue
+		}
+
+		if l.Locked(now) {
+			log.Printf("[Audit] user %s locked out until %v after %v failed logins\n", user.ID, *l.LockedUntil, l.Failures)
+		}
+	}
+}
+
+// throttleAddress reports whether failed logins count against the address
+// a request came from. They don't when a service or API key checks
+// credentials on /auth/verify, as the address is the service's and is shared
+// by every user logging in through it. The users are still locked out.
+func throttleAddress(r *http.Request) bool {
+	return requestPrincipal(r) == nil
+}
+
+// clearLockout forgets the failed logins of a user.
+func (ush *userServiceHandler) clearLockout(userID string) error {
+	_, err := ush.dbHandler.UpdateLockout(userID, func(persistence.Lockout) persistence.Lockout {
+		return persistence.Lockout{}
+	})
+	return err
+}
+
+// writeLockedResponse writes a 429 saying when to try again.
+func (ush *userServiceHandler) writeLockedResponse(w http.ResponseWriter, until, now time.Time) {
+	retry := int(math.Ceil(until.Sub(now).Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	ush.writeErrorResponse(w, "too many failed logins, try again later", http.StatusTooManyRequests)
+}
+
+// hideLockout removes the lockout from users unless the request may see it.
+func (ush *userServiceHandler) hideLockout(r *http.Request, users ...*persistence.User) {
+	if ush.allowed(r, auth.ActionUnlockUser, "") {
+		return
+	}
+
+	for _, user := range users {
+		user.Lockout = nil
+	}
+}
+
+// allowed reports whether the request may perform action, like authorize
+// but without writing a response or an audit entry.
+func (ush *userServiceHandler) allowed(r *http.Request, action, ownerID string) bool {
+	if ush.authenticator == nil {
+		return true
+	}
+
+	principal, _ := auth.PrincipalFromContext(r.Context())
+	return ush.policy.Allowed(principal, action, ownerID)
+}
+
+// clientIP is the address a request came from.
+func (ush *userServiceHandler) clientIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); ush.trustProxy && forwarded != "" {
+		addrs := strings.Split(forwarded, ",")
+		return strings.TrimSpace(addrs[len(addrs)-1])
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
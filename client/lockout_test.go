@@ -0,0 +1,196 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	auth "github.com/omgitsotis/user-service/auth"
+	dblayer "github.com/omgitsotis/user-service/dblayer"
+	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+)
+
+// loginFrom logs in as the test user with password from the address addr.
+func loginFrom(t *testing.T, r *mux.Router, addr, password string) *httptest.ResponseRecorder {
+	form := url.Values{"email": {"klay_thompson@mail.com"}, "password": {password}}
+	req, err := http.NewRequest("POST", "/auth/login", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = addr
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestUserLockout(t *testing.T) {
+	mockDB, err := dblayer.NewPersistenceLayer(dblayer.MOCKDB, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AddTestUser(mockDB)
+	policy := auth.LockoutPolicy{Threshold: 3, Base: time.Minute, Max: time.Hour, ResetAfter: time.Hour}
+	r := Router(mockDB, WithAuthenticator(testAuthenticator(t)), WithLockout(policy, auth.LockoutPolicy{}))
+
+	// Failures from different addresses all count against the user.
+	for i, addr := range []string{"192.0.2.1:1000", "192.0.2.2:1000", "192.0.2.3:1000"} {
+		if status := loginFrom(t, r, addr, "wrong").Code; status != http.StatusUnauthorized {
+			t.Errorf("failure %v returned wrong status code: got %v want %v", i+1, status, http.StatusUnauthorized)
+		}
+	}
+
+	rr := loginFrom(t, r, "192.0.2.4:1000", "password")
+	if status := rr.Code; status != http.StatusTooManyRequests {
+		t.Fatalf("locked user logged in: got %v want %v", status, http.StatusTooManyRequests)
+	}
+
+	if retry := rr.Header().Get("Retry-After"); retry != "60" && retry != "59" {
+		t.Errorf("wrong Retry-After: %v", retry)
+	}
+
+	// Admins can see the lock, the user can't.
+	rr = userRequest(t, r, "GET", "/user/1", nil, true)
+	var shown struct {
+		Lockout *struct {
+			Failures    int        `json:"failed_logins"`
+			LockedUntil *time.Time `json:"locked_until"`
+			Locked      bool       `json:"locked"`
+		} `json:"lockout"`
+	}
+	if err = json.NewDecoder(rr.Body).Decode(&shown); err != nil {
+		t.Fatal(err)
+	}
+
+	if shown.Lockout == nil || shown.Lockout.Failures != 3 || !shown.Lockout.Locked || shown.Lockout.LockedUntil == nil {
+		t.Errorf("admin can't see the lockout: %+v", shown.Lockout)
+	}
+
+	rr = userRequest(t, r, "GET", "/user/1", nil, false)
+	if strings.Contains(rr.Body.String(), "lockout") {
+		t.Errorf("user can see their lockout: %s", rr.Body.String())
+	}
+
+	if status := userRequest(t, r, "DELETE", "/user/1/lockout", nil, false).Code; status != http.StatusForbidden {
+		t.Errorf("user unlocked themselves: got %v want %v", status, http.StatusForbidden)
+	}
+
+	if status := userRequest(t, r, "DELETE", "/user/1/lockout", nil, true).Code; status != http.StatusNoContent {
+		t.Fatalf("admin could not unlock user: got %v want %v", status, http.StatusNoContent)
+	}
+
+	if status := loginFrom(t, r, "192.0.2.4:1000", "password").Code; status != http.StatusOK {
+		t.Errorf("unlocked user could not log in: got %v want %v", status, http.StatusOK)
+	}
+
+	// Logging in forgets earlier failures.
+	loginFrom(t, r, "192.0.2.4:1000", "wrong")
+	loginFrom(t, r, "192.0.2.4:1000", "password")
+	if user, err := mockDB.FindUserByID("1"); err != nil || user.Lockout != nil {
+		t.Errorf("failures were kept after logging in: %v %v", user, err)
+	}
+}
+
+func TestIPLockout(t *testing.T) {
+	mockDB, err := dblayer.NewPersistenceLayer(dblayer.MOCKDB, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AddTestUser(mockDB)
+	policy := auth.LockoutPolicy{Threshold: 2, Base: time.Minute, Max: time.Hour, ResetAfter: time.Hour}
+	r := Router(mockDB, WithAuthenticator(testAuthenticator(t)), WithLockout(auth.LockoutPolicy{}, policy))
+
+	loginFrom(t, r, "192.0.2.1:1000", "wrong")
+	loginFrom(t, r, "192.0.2.1:2000", "wrong")
+
+	if status := loginFrom(t, r, "192.0.2.1:3000", "password").Code; status != http.StatusTooManyRequests {
+		t.Errorf("locked address logged in: got %v want %v", status, http.StatusTooManyRequests)
+	}
+
+	if status := loginFrom(t, r, "192.0.2.2:1000", "password").Code; status != http.StatusOK {
+		t.Errorf("another address was locked: got %v want %v", status, http.StatusOK)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	req := httptest.NewRequest("POST", "/auth/login", nil)
+	req.RemoteAddr = "10.0.0.1:1000"
+	req.Header.Set("X-Forwarded-For", "192.0.2.9, 198.51.100.7")
+
+	if ip := newUserHandler(nil).clientIP(req); ip != "10.0.0.1" {
+		t.Errorf("X-Forwarded-For was trusted without a proxy: %v", ip)
+	}
+
+	if ip := newUserHandler(nil, WithTrustedProxy()).clientIP(req); ip != "198.51.100.7" {
+		t.Errorf("wrong address behind a proxy: got %v want %v", ip, "198.51.100.7")
+	}
+}
+
+// The lockout is kept out of what services are told about a user.
+func TestVerifyHidesLockout(t *testing.T) {
+	mockDB, err := dblayer.NewPersistenceLayer(dblayer.MOCKDB, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AddTestUser(mockDB)
+	_, err = mockDB.UpdateLockout("1", func(persistence.Lockout) persistence.Lockout {
+		return persistence.Lockout{Failures: 1, LastFailure: time.Now()}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := Router(mockDB, WithAuthenticator(testAuthenticator(t)))
+	form := url.Values{"email": {"klay_thompson@mail.com"}, "password": {"password"}}
+	key := createKey(t, r, url.Values{"name": {"login"}, "scope": {"read"}})
+	rr := keyRequest(t, r, "POST", "/auth/verify", form, key.Key)
+	if rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), "lockout") {
+		t.Errorf("verify returned the lockout: %v %s", rr.Code, rr.Body.String())
+	}
+}
+
+// A service checking credentials for its users does it from its own
+// address, which mustn't be locked out for their mistakes.
+func TestVerifyNotThrottledByAddress(t *testing.T) {
+	mockDB, err := dblayer.NewPersistenceLayer(dblayer.MOCKDB, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AddTestUser(mockDB)
+	policy := auth.LockoutPolicy{Threshold: 2, Base: time.Minute, Max: time.Hour, ResetAfter: time.Hour}
+	r := Router(mockDB, WithAuthenticator(testAuthenticator(t)), WithLockout(policy, policy))
+	key := createKey(t, r, url.Values{"name": {"login"}, "scope": {"read"}})
+
+	wrong := url.Values{"email": {"klay_thompson@mail.com"}, "password": {"wrong"}}
+	for i := 0; i < 2; i++ {
+		if status := keyRequest(t, r, "POST", "/auth/verify", wrong, key.Key).Code; status != http.StatusUnauthorized {
+			t.Errorf("failure %v returned wrong status code: got %v want %v", i+1, status, http.StatusUnauthorized)
+		}
+	}
+
+	// The user is locked, the service's address isn't.
+	if status := keyRequest(t, r, "POST", "/auth/verify", wrong, key.Key).Code; status != http.StatusTooManyRequests {
+		t.Errorf("locked user was checked: got %v want %v", status, http.StatusTooManyRequests)
+	}
+
+	if err = newUserHandler(mockDB).clearLockout("1"); err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{"email": {"klay_thompson@mail.com"}, "password": {"password"}}
+	if status := keyRequest(t, r, "POST", "/auth/verify", form, key.Key).Code; status != http.StatusOK {
+		t.Errorf("service address was locked: got %v want %v", status, http.StatusOK)
+	}
+}
@@ -0,0 +1,404 @@
+package client
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	auth "github.com/omgitsotis/user-service/auth"
+	"github.com/omgitsotis/user-service/dblayer/persistence"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// mfaEnrollment is what a user needs to set up their authenticator app.
+type mfaEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+// recoveryCodesResponse holds a new set of recovery codes. They are only
+// ever shown once.
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// enrollMFAHandler starts setting up an authenticator for a user. It isn't
+// required to log in until it is confirmed with a code, see
+// confirmMFAHandler. Starting again replaces an unconfirmed authenticator.
+func (ush *userServiceHandler) enrollMFAHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[UserServiceHandler] Recieved POST request on %s\n", r.URL.String())
+
+	user, ok := ush.mfaUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.MFAEnabled() {
+		log.Printf("[UserServiceHandler] user %s already has mfa\n", user.ID)
+		ush.writeErrorResponse(w, "mfa is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error generating totp secret: %s\n", err.Error())
+		ush.writeErrorResponse(w, "could not enroll mfa", http.StatusInternalServerError)
+		return
+	}
+
+	sealed, err := ush.secretBox.Seal(secret)
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error encrypting totp secret: %s\n", err.Error())
+		ush.writeErrorResponse(w, "could not enroll mfa", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err = ush.dbHandler.UpdateUser(persistence.User{ID: user.ID, TOTP: &persistence.TOTP{Secret: sealed}}); err != nil {
+		log.Printf("[UserServiceHandler] Error storing totp secret: %s\n", err.Error())
+		ush.writeErrorResponse(w, "could not enroll mfa", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[Audit] %v started mfa enrollment for user %s\n", requestPrincipal(r), user.ID)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(mfaEnrollment{secret, ush.totpURI(user, secret)})
+}
+
+// mfaQRHandler serves the otpauth URI of an unconfirmed authenticator as a
+// QR code to scan with an authenticator app. Once it is confirmed the secret
+// is never shown again.
+func (ush *userServiceHandler) mfaQRHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[UserServiceHandler] Recieved GET request on %s\n", r.URL.String())
+
+	user, ok := ush.mfaUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.TOTP == nil || user.TOTP.Enabled {
+		ush.writeErrorResponse(w, "no mfa enrollment in progress", http.StatusNotFound)
+		return
+	}
+
+	secret, err := ush.secretBox.Open(user.TOTP.Secret)
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error decrypting totp secret: %s\n", err.Error())
+		ush.writeErrorResponse(w, "could not show mfa code", http.StatusInternalServerError)
+		return
+	}
+
+	png, err := qrcode.Encode(ush.totpURI(user, secret), qrcode.Medium, 256)
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error drawing qr code: %s\n", err.Error())
+		ush.writeErrorResponse(w, "could not show mfa code", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(png)
+}
+
+// confirmMFAHandler turns on an authenticator once the user has shown it
+// works by entering a code from it, and returns their recovery codes.
+func (ush *userServiceHandler) confirmMFAHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[UserServiceHandler] Recieved POST request on %s\n", r.URL.String())
+
+	user, ok := ush.mfaUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.TOTP == nil {
+		ush.writeErrorResponse(w, "no mfa enrollment in progress", http.StatusNotFound)
+		return
+	}
+
+	if user.TOTP.Enabled {
+		ush.writeErrorResponse(w, "mfa is already enabled", http.StatusConflict)
+		return
+	}
+
+	r.ParseForm()
+	step, ok := ush.checkTOTP(w, user, r.FormValue("code"))
+	if !ok {
+		return
+	}
+
+	if !ush.claimTOTPStep(w, user, step) {
+		return
+	}
+
+	// Enabling mfa is a change to the user, so unlike using a code it goes
+	// through UpdateUser and is an event.
+	totp := persistence.TOTP{Secret: user.TOTP.Secret, Enabled: true, LastStep: step}
+	if _, err := ush.dbHandler.UpdateUser(persistence.User{ID: user.ID, TOTP: &totp}); err != nil {
+		log.Printf("[UserServiceHandler] Error enabling mfa: %s\n", err.Error())
+		ush.writeErrorResponse(w, "could not enable mfa", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[Audit] %v enabled mfa for user %s\n", requestPrincipal(r), user.ID)
+	ush.writeRecoveryCodes(w, user.ID)
+}
+
+// recoveryCodesHandler replaces a user's recovery codes with new ones. It
+// needs a code from their authenticator.
+func (ush *userServiceHandler) recoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[UserServiceHandler] Recieved POST request on %s\n", r.URL.String())
+
+	user, ok := ush.mfaUser(w, r)
+	if !ok {
+		return
+	}
+
+	if !user.MFAEnabled() {
+		ush.writeErrorResponse(w, "mfa is not enabled", http.StatusNotFound)
+		return
+	}
+
+	r.ParseForm()
+	if _, ok = ush.useTOTP(w, user, r.FormValue("code")); !ok {
+		return
+	}
+
+	log.Printf("[Audit] %v replaced the recovery codes of user %s\n", requestPrincipal(r), user.ID)
+	ush.writeRecoveryCodes(w, user.ID)
+}
+
+// disableMFAHandler removes a user's authenticator and recovery codes. It
+// needs a code from the authenticator or a recovery code, unless the
+// principal is allowed to reset other users' mfa, for users who have lost
+// both.
+func (ush *userServiceHandler) disableMFAHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[UserServiceHandler] Recieved DELETE request on %s\n", r.URL.String())
+
+	user, ok := ush.mfaUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.TOTP == nil {
+		ush.writeErrorResponse(w, "mfa is not enabled", http.StatusNotFound)
+		return
+	}
+
+	r.ParseForm()
+	if r.FormValue("code") == "" && r.FormValue("recovery_code") == "" {
+		if !ush.authorize(w, r, auth.ActionResetMFA, user.ID) {
+			return
+		}
+	} else if user.MFAEnabled() && !ush.checkSecondFactor(w, r, user) {
+		return
+	}
+
+	if _, err := ush.dbHandler.UpdateUser(persistence.User{ID: user.ID, TOTP: &persistence.TOTP{}}); err != nil {
+		log.Printf("[UserServiceHandler] Error disabling mfa: %s\n", err.Error())
+		ush.writeErrorResponse(w, "could not disable mfa", http.StatusInternalServerError)
+		return
+	}
+
+	if err := ush.dbHandler.RevokeTokenFamily(auth.RecoveryCodeFamily(user.ID), time.Now().UTC()); err != nil {
+		log.Printf("[UserServiceHandler] Error revoking recovery codes for user %s: %s\n", user.ID, err.Error())
+	}
+
+	log.Printf("[Audit] %v disabled mfa for user %s\n", requestPrincipal(r), user.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// mfaUser checks the principal may change the mfa of the user in the path
+// and looks them up.
+func (ush *userServiceHandler) mfaUser(w http.ResponseWriter, r *http.Request) (*persistence.User, bool) {
+	userID := mux.Vars(r)["id"]
+	if !ush.authorize(w, r, auth.ActionUpdateUser, userID) {
+		return nil, false
+	}
+
+	user, err := ush.dbHandler.FindUserByID(userID)
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error getting user: %s\n", err.Error())
+		ush.writeErrorResponse(w, err.Error(), http.StatusNotFound)
+		return nil, false
+	}
+
+	return user, true
+}
+
+// checkSecondFactor checks the code or recovery_code in a form for a user
+// with mfa enabled, writing a 401 if neither is right. Users without mfa
+// always pass.
+func (ush *userServiceHandler) checkSecondFactor(w http.ResponseWriter, r *http.Request, user *persistence.User) bool {
+	if !user.MFAEnabled() {
+		return true
+	}
+
+	code := r.FormValue("code")
+	recovery := r.FormValue("recovery_code")
+	if code == "" && recovery == "" {
+		log.Printf("[UserServiceHandler] no mfa code for user %s\n", user.ID)
+		ush.writeErrorResponse(w, "mfa code required", http.StatusUnauthorized)
+		return false
+	}
+
+	if code != "" {
+		_, ok := ush.useTOTP(w, user, code)
+		return ok
+	}
+
+	used, err := ush.useRecoveryCode(user, recovery)
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error checking recovery code: %s\n", err.Error())
+		ush.writeErrorResponse(w, "could not check mfa code", http.StatusInternalServerError)
+		return false
+	}
+
+	if !used {
+		log.Printf("[UserServiceHandler] invalid recovery code for user %s\n", user.ID)
+		ush.writeErrorResponse(w, "invalid mfa code", http.StatusUnauthorized)
+		return false
+	}
+
+	log.Printf("[Audit] user %s used a recovery code\n", user.ID)
+	return true
+}
+
+// useTOTP checks a code from a user's enabled authenticator and records it
+// as used, writing a 401 if it is wrong.
+func (ush *userServiceHandler) useTOTP(w http.ResponseWriter, user *persistence.User, code string) (int64, bool) {
+	step, ok := ush.checkTOTP(w, user, code)
+	if !ok || !ush.claimTOTPStep(w, user, step) {
+		return 0, false
+	}
+
+	return step, true
+}
+
+// claimTOTPStep records the step of a checked code as used, writing a 401 if
+// another request used it or a later code first. checkTOTP only compares
+// with the step the user was loaded with, so this is what stops two
+// requests racing with the same code.
+func (ush *userServiceHandler) claimTOTPStep(w http.ResponseWriter, user *persistence.User, step int64) bool {
+	used, err := ush.dbHandler.UseTOTPStep(user.ID, step)
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error recording totp code for user %s: %s\n", user.ID, err.Error())
+		ush.writeErrorResponse(w, "could not check mfa code", http.StatusInternalServerError)
+		return false
+	}
+
+	if !used {
+		log.Printf("[UserServiceHandler] totp code for user %s was already used\n", user.ID)
+		ush.writeErrorResponse(w, "invalid mfa code", http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+// checkTOTP checks a code against a user's authenticator, writing an error
+// if it is wrong. The time step of the code is returned.
+func (ush *userServiceHandler) checkTOTP(w http.ResponseWriter, user *persistence.User, code string) (int64, bool) {
+	if code == "" {
+		ush.writeErrorResponse(w, "mfa code required", http.StatusUnauthorized)
+		return 0, false
+	}
+
+	// Without the key the secret can't be read, so the user can't get in
+	// rather than getting in without a second factor.
+	if ush.secretBox == nil {
+		log.Printf("[UserServiceHandler] user %s has mfa but there is no encryption key\n", user.ID)
+		ush.writeErrorResponse(w, "could not check mfa code", http.StatusInternalServerError)
+		return 0, false
+	}
+
+	secret, err := ush.secretBox.Open(user.TOTP.Secret)
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error decrypting totp secret for user %s: %s\n", user.ID, err.Error())
+		ush.writeErrorResponse(w, "could not check mfa code", http.StatusInternalServerError)
+		return 0, false
+	}
+
+	step, ok := auth.CheckTOTP(secret, code, time.Now(), user.TOTP.LastStep)
+	if !ok {
+		log.Printf("[UserServiceHandler] invalid totp code for user %s\n", user.ID)
+		ush.writeErrorResponse(w, "invalid mfa code", http.StatusUnauthorized)
+		return 0, false
+	}
+
+	return step, true
+}
+
+// useRecoveryCode uses up one of a user's recovery codes, reporting whether
+// it was one.
+func (ush *userServiceHandler) useRecoveryCode(user *persistence.User, code string) (bool, error) {
+	token, err := ush.dbHandler.FindTokenByHash(auth.HashRecoveryCode(code))
+	if err == persistence.ErrTokenNotFound {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	if token.Kind != persistence.TokenRecoveryCode || token.UserID != user.ID || token.Revoked() {
+		return false, nil
+	}
+
+	return ush.dbHandler.RevokeToken(token.ID, time.Now().UTC())
+}
+
+// writeRecoveryCodes replaces a user's recovery codes and writes the new
+// ones.
+func (ush *userServiceHandler) writeRecoveryCodes(w http.ResponseWriter, userID string) {
+	codes, err := ush.newRecoveryCodes(userID)
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error creating recovery codes for user %s: %s\n", userID, err.Error())
+		ush.writeErrorResponse(w, "could not create recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(recoveryCodesResponse{codes})
+}
+
+func (ush *userServiceHandler) newRecoveryCodes(userID string) ([]string, error) {
+	now := time.Now().UTC()
+	family := auth.RecoveryCodeFamily(userID)
+	if err := ush.dbHandler.RevokeTokenFamily(family, now); err != nil {
+		return nil, err
+	}
+
+	codes, hashes, err := auth.NewRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, hash := range hashes {
+		_, err = ush.dbHandler.AddToken(persistence.Token{
+			Kind:      persistence.TokenRecoveryCode,
+			Hash:      hash,
+			UserID:    userID,
+			Family:    family,
+			CreatedAt: now,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, nil
+}
+
+// totpURI returns the otpauth URI for a user's authenticator, labelled with
+// their email or nickname.
+func (ush *userServiceHandler) totpURI(user *persistence.User, secret string) string {
+	account := user.Email
+	if account == "" {
+		account = user.Nickname
+	}
+
+	return auth.TOTPURI(ush.mfaIssuer, account, secret)
+}
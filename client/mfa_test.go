@@ -0,0 +1,249 @@
+package client
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	auth "github.com/omgitsotis/user-service/auth"
+	dblayer "github.com/omgitsotis/user-service/dblayer"
+	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+)
+
+func testSecretBox(t *testing.T) *auth.SecretBox {
+	box, err := auth.NewSecretBox(base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return box
+}
+
+// userRequest makes a request as the test user, or as an admin if admin is
+// set.
+func userRequest(t *testing.T, r *mux.Router, method, path string, form url.Values, admin bool) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	role := persistence.RoleUser
+	if admin {
+		role = persistence.RoleAdmin
+	}
+
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+testToken(t, "1", role))
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	return rr
+}
+
+func loginStatus(t *testing.T, r *mux.Router, extra url.Values) int {
+	form := url.Values{"email": {"klay_thompson@mail.com"}, "password": {"password"}}
+	for k, v := range extra {
+		form[k] = v
+	}
+
+	return postForm(t, r, "/auth/login", form).Code
+}
+
+func totpCode(t *testing.T, secret string, at time.Time) string {
+	code, err := auth.TOTPCode(secret, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return code
+}
+
+func TestMFA(t *testing.T) {
+	mockDB, err := dblayer.NewPersistenceLayer(dblayer.MOCKDB, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AddTestUser(mockDB)
+	r := Router(mockDB, WithAuthenticator(testAuthenticator(t)), WithMFA(testSecretBox(t), "user-service"))
+
+	rr := userRequest(t, r, "POST", "/user/1/mfa", nil, false)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	enrollment := mfaEnrollment{}
+	if err = json.NewDecoder(rr.Body).Decode(&enrollment); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(enrollment.URI, "otpauth://totp/user-service:klay_thompson@mail.com?") {
+		t.Errorf("wrong otpauth uri: %v", enrollment.URI)
+	}
+
+	stored, err := mockDB.FindUserByID("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored.TOTP == nil || strings.Contains(stored.TOTP.Secret, enrollment.Secret) {
+		t.Errorf("secret was not stored encrypted: %v", stored.TOTP)
+	}
+
+	rr = userRequest(t, r, "GET", "/user/1/mfa/qr", nil, false)
+	if rr.Code != http.StatusOK || !bytes.HasPrefix(rr.Body.Bytes(), []byte("\x89PNG")) {
+		t.Errorf("qr code is not a png: %v %v", rr.Code, rr.Header().Get("Content-Type"))
+	}
+
+	// Until it is confirmed the authenticator isn't needed.
+	if status := loginStatus(t, r, nil); status != http.StatusOK {
+		t.Errorf("login needed an unconfirmed authenticator: got %v want %v", status, http.StatusOK)
+	}
+
+	now := time.Now()
+	if status := userRequest(t, r, "POST", "/user/1/mfa/confirm", url.Values{"code": {"000000"}}, false).Code; status != http.StatusUnauthorized {
+		t.Errorf("wrong code confirmed mfa: got %v want %v", status, http.StatusUnauthorized)
+	}
+
+	rr = userRequest(t, r, "POST", "/user/1/mfa/confirm", url.Values{"code": {totpCode(t, enrollment.Secret, now)}}, false)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	codes := recoveryCodesResponse{}
+	if err = json.NewDecoder(rr.Body).Decode(&codes); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(codes.RecoveryCodes) != auth.RecoveryCodeCount {
+		t.Fatalf("wrong number of recovery codes: %v", codes.RecoveryCodes)
+	}
+
+	tests := []struct {
+		name   string
+		form   url.Values
+		status int
+	}{
+		{"no code", nil, http.StatusUnauthorized},
+		{"wrong code", url.Values{"code": {"000000"}}, http.StatusUnauthorized},
+		{"code used to confirm", url.Values{"code": {totpCode(t, enrollment.Secret, now)}}, http.StatusUnauthorized},
+		{"next code", url.Values{"code": {totpCode(t, enrollment.Secret, now.Add(30*time.Second))}}, http.StatusOK},
+		{"recovery code", url.Values{"recovery_code": {codes.RecoveryCodes[0]}}, http.StatusOK},
+		{"used recovery code", url.Values{"recovery_code": {codes.RecoveryCodes[0]}}, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		if status := loginStatus(t, r, tt.form); status != tt.status {
+			t.Errorf("%s: login returned wrong status code: got %v want %v", tt.name, status, tt.status)
+		}
+	}
+
+	// Removing it needs a second factor unless an admin does it.
+	if status := userRequest(t, r, "DELETE", "/user/1/mfa", nil, false).Code; status != http.StatusForbidden {
+		t.Errorf("mfa removed without a code: got %v want %v", status, http.StatusForbidden)
+	}
+
+	query := url.Values{"recovery_code": {codes.RecoveryCodes[1]}}
+	if status := userRequest(t, r, "DELETE", "/user/1/mfa?"+query.Encode(), nil, false).Code; status != http.StatusNoContent {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNoContent)
+	}
+
+	if status := loginStatus(t, r, nil); status != http.StatusOK {
+		t.Errorf("login still needs mfa after removing it: got %v want %v", status, http.StatusOK)
+	}
+
+	// The remaining recovery codes went with it.
+	if used, err := newUserHandler(mockDB).useRecoveryCode(stored, codes.RecoveryCodes[2]); err != nil || used {
+		t.Errorf("recovery code outlived mfa: %v %v", used, err)
+	}
+}
+
+func TestMFAAdminReset(t *testing.T) {
+	mockDB, err := dblayer.NewPersistenceLayer(dblayer.MOCKDB, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AddTestUser(mockDB)
+	r := Router(mockDB, WithAuthenticator(testAuthenticator(t)), WithMFA(testSecretBox(t), "user-service"))
+
+	rr := userRequest(t, r, "POST", "/user/1/mfa", nil, false)
+	enrollment := mfaEnrollment{}
+	if err = json.NewDecoder(rr.Body).Decode(&enrollment); err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{"code": {totpCode(t, enrollment.Secret, time.Now())}}
+	if status := userRequest(t, r, "POST", "/user/1/mfa/confirm", form, false).Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	if status := userRequest(t, r, "POST", "/user/1/mfa", nil, false).Code; status != http.StatusConflict {
+		t.Errorf("enrolled twice: got %v want %v", status, http.StatusConflict)
+	}
+
+	if status := userRequest(t, r, "DELETE", "/user/1/mfa", nil, true).Code; status != http.StatusNoContent {
+		t.Errorf("admin could not reset mfa: got %v want %v", status, http.StatusNoContent)
+	}
+
+	if status := loginStatus(t, r, nil); status != http.StatusOK {
+		t.Errorf("login still needs mfa after a reset: got %v want %v", status, http.StatusOK)
+	}
+}
+
+func TestMFACodeRace(t *testing.T) {
+	mockDB, err := dblayer.NewPersistenceLayer(dblayer.MOCKDB, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AddTestUser(mockDB)
+	r := Router(mockDB, WithAuthenticator(testAuthenticator(t)), WithMFA(testSecretBox(t), "user-service"))
+
+	rr := userRequest(t, r, "POST", "/user/1/mfa", nil, false)
+	enrollment := mfaEnrollment{}
+	if err = json.NewDecoder(rr.Body).Decode(&enrollment); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	form := url.Values{"code": {totpCode(t, enrollment.Secret, now)}}
+	if status := userRequest(t, r, "POST", "/user/1/mfa/confirm", form, false).Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	// Every request loads the user before any of them records the code, so
+	// only recording it atomically stops them all getting in.
+	code := url.Values{"code": {totpCode(t, enrollment.Secret, now.Add(30*time.Second))}}
+	statuses := make(chan int, 8)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(statuses); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses <- loginStatus(t, r, code)
+		}()
+	}
+
+	wg.Wait()
+	close(statuses)
+	ok := 0
+	for status := range statuses {
+		if status == http.StatusOK {
+			ok++
+		}
+	}
+
+	if ok != 1 {
+		t.Errorf("a code was used by %v logins, want 1", ok)
+	}
+}
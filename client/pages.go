@@ -0,0 +1,97 @@
+package client
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/omgitsotis/user-service/dblayer/persistence"
+)
+
+// The number of users on a page when the request doesn't give a limit, and
+// the most it can ask for.
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// pageParams are the query params that control paging rather than being
+// criteria to search by.
+var pageParams = map[string]bool{"limit": true, "cursor": true, "sort": true}
+
+// usersPage is a page of users from a search. NextCursor is passed back as
+// the cursor param to get the next page, and is null on the last one.
+type usersPage struct {
+	Users      []*persistence.User `json:"users"`
+	Total      int                 `json:"total"`
+	NextCursor *string             `json:"next_cursor"`
+}
+
+// pageQuery reads the limit, cursor and sort params into q, writing a 400
+// and returning false if any of them are invalid. sort is the field to sort
+// by, with a leading - to sort in descending order. A cursor remembers the
+// sort it was made for, so later pages only need the cursor.
+func (ush *userServiceHandler) pageQuery(w http.ResponseWriter, r *http.Request, q *persistence.Query) bool {
+	params := r.URL.Query()
+
+	q.Limit = defaultPageSize
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPageSize {
+			log.Printf("[UserServiceHandler] invalid limit %q\n", limit)
+			ush.writeErrorResponse(w, "limit must be between 1 and "+strconv.Itoa(maxPageSize), http.StatusBadRequest)
+			return false
+		}
+
+		q.Limit = n
+	}
+
+	if sort := params.Get("sort"); sort != "" {
+		q.Descending = strings.HasPrefix(sort, "-")
+		q.Sort = strings.TrimPrefix(sort, "-")
+		if _, ok := persistence.SortFields[q.Sort]; !ok {
+			log.Printf("[UserServiceHandler] invalid sort %q\n", sort)
+			ush.writeErrorResponse(w, "invalid sort field", http.StatusBadRequest)
+			return false
+		}
+	}
+
+	if cursor := params.Get("cursor"); cursor != "" {
+		after, err := persistence.DecodeCursor(cursor)
+		if err == nil && params.Get("sort") == "" {
+			q.Sort, q.Descending = after.Sort, after.Descending
+		}
+
+		if err != nil || after.Sort != q.Sort || after.Descending != q.Descending {
+			log.Printf("[UserServiceHandler] invalid cursor %q\n", cursor)
+			ush.writeErrorResponse(w, persistence.ErrInvalidCursor.Error(), http.StatusBadRequest)
+			return false
+		}
+
+		q.After = after
+	}
+
+	return true
+}
+
+// writeUsers finds a page of the users matching q and writes it out.
+func (ush *userServiceHandler) writeUsers(w http.ResponseWriter, r *http.Request, q persistence.Query) {
+	page, err := ush.dbHandler.FindUsers(q)
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error searching for users: %s\n", err.Error())
+		ush.writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ush.hideLockout(r, page.Users...)
+	resp := usersPage{Users: page.Users, Total: page.Total}
+	if page.Next != nil {
+		next := page.Next.Encode()
+		resp.NextCursor = &next
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(&resp)
+}
@@ -0,0 +1,179 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	auth "github.com/omgitsotis/user-service/auth"
+	"github.com/omgitsotis/user-service/dblayer/persistence"
+	notify "github.com/omgitsotis/user-service/notify"
+)
+
+// StatusResponse is a json object for requests that succeed without
+// anything to return.
+type StatusResponse struct {
+	Status string `json:"status"`
+}
+
+// forgotPasswordHandler sends a password reset token to an email address.
+// The response is the same whether or not a user has that email, and the
+// token is created and sent after responding so the time taken doesn't give
+// it away either.
+func (ush *userServiceHandler) forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("[UserServiceHandler] Recieved POST request on /password/forgot")
+
+	r.ParseForm()
+	email := r.FormValue("email")
+	if email == "" {
+		log.Println("[UserServiceHandler] no email to reset")
+		ush.writeErrorResponse(w, "email is required", http.StatusBadRequest)
+		return
+	}
+
+	go ush.sendPasswordReset(email)
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(StatusResponse{"if the email is registered a reset link has been sent"})
+}
+
+// sendPasswordReset creates a reset token for the user with email and sends
+// it to them. Nothing is sent if there isn't one.
+func (ush *userServiceHandler) sendPasswordReset(email string) {
+	users, err := ush.dbHandler.FindUserByCriteria("email", email)
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error finding user to reset: %s\n", err.Error())
+		return
+	}
+
+	if len(users) == 0 {
+		log.Println("[UserServiceHandler] password reset for unknown email")
+		return
+	}
+
+	user := users[0]
+	token, hash, err := auth.NewPasswordResetToken()
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error generating reset token: %s\n", err.Error())
+		return
+	}
+
+	now := time.Now().UTC()
+	expires := now.Add(auth.PasswordResetTTL)
+	_, err = ush.dbHandler.AddToken(persistence.Token{
+		Kind:      persistence.TokenPasswordReset,
+		Hash:      hash,
+		UserID:    user.ID,
+		Family:    auth.PasswordResetFamily(user.ID),
+		CreatedAt: now,
+		ExpiresAt: &expires,
+	})
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error storing reset token: %s\n", err.Error())
+		return
+	}
+
+	link := token
+	if ush.resetURL != "" {
+		link = ush.resetURL + "?token=" + url.QueryEscape(token)
+	}
+
+	err = ush.notifier.Notify(notify.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Someone asked to reset the password for your account. "+
+			"If it was you, use this to choose a new one within %v:\n\n%s\n\n"+
+			"If it wasn't, you can ignore this message.\n", auth.PasswordResetTTL, link),
+	})
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error sending reset token to user %s: %s\n", user.ID, err.Error())
+		return
+	}
+
+	log.Printf("[Audit] password reset sent to user %s\n", user.ID)
+}
+
+// resetPasswordHandler sets a new password using a reset token. Each token
+// works once, and using one revokes every other reset token for the user.
+func (ush *userServiceHandler) resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("[UserServiceHandler] Recieved POST request on /password/reset")
+
+	r.ParseForm()
+	password := r.FormValue("password")
+	if password == "" {
+		log.Println("[UserServiceHandler] no new password")
+		ush.writeErrorResponse(w, "password is required", http.StatusBadRequest)
+		return
+	}
+
+	if !ush.validUser(w, &persistence.User{Password: password}, false) {
+		return
+	}
+
+	token, ok := ush.checkToken(w, r.FormValue("token"), persistence.TokenPasswordReset)
+	if !ok {
+		return
+	}
+
+	hash, ok := ush.hashPassword(w, password)
+	if !ok {
+		return
+	}
+
+	// The token is used up by the same change that sets the password, so if
+	// that fails it can be tried again.
+	now := time.Now().UTC()
+	_, err := ush.dbHandler.ResetPassword(token.ID, hash, now)
+	if err == persistence.ErrTokenUsed {
+		log.Printf("[UserServiceHandler] %s token %s already used\n", token.Kind, token.ID)
+		ush.writeErrorResponse(w, "invalid or expired token", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("[UserServiceHandler] Error resetting password for user %s: %s\n", token.UserID, err.Error())
+		ush.writeErrorResponse(w, "could not reset password", http.StatusInternalServerError)
+		return
+	}
+
+	if err = ush.dbHandler.RevokeTokenFamily(token.Family, now); err != nil {
+		log.Printf("[UserServiceHandler] Error revoking reset tokens for user %s: %s\n", token.UserID, err.Error())
+	}
+
+	// Proving they own the email is enough to undo a lock earned by
+	// guessing at the old password.
+	if err := ush.clearLockout(token.UserID); err != nil {
+		log.Printf("[UserServiceHandler] Error clearing failed logins for user %s: %s\n", token.UserID, err.Error())
+	}
+
+	log.Printf("[Audit] user %s reset their password\n", token.UserID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkToken looks up a single use token of the given kind without using it.
+// If the token isn't valid a 400 is written and ok is false.
+func (ush *userServiceHandler) checkToken(w http.ResponseWriter, secret, kind string) (*persistence.Token, bool) {
+	if secret == "" {
+		log.Println("[UserServiceHandler] no token")
+		ush.writeErrorResponse(w, "token is required", http.StatusBadRequest)
+		return nil, false
+	}
+
+	token, err := ush.dbHandler.FindTokenByHash(auth.HashToken(secret))
+	if err != nil && err != persistence.ErrTokenNotFound {
+		log.Printf("[UserServiceHandler] Error finding %s token: %s\n", kind, err.Error())
+		ush.writeErrorResponse(w, "could not check token", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	now := time.Now().UTC()
+	if err == persistence.ErrTokenNotFound || token.Kind != kind || token.Revoked() || token.Expired(now) {
+		log.Printf("[UserServiceHandler] invalid %s token\n", kind)
+		ush.writeErrorResponse(w, "invalid or expired token", http.StatusBadRequest)
+		return nil, false
+	}
+
+	return token, true
+}
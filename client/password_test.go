@@ -0,0 +1,213 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	dblayer "github.com/omgitsotis/user-service/dblayer"
+	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+	notify "github.com/omgitsotis/user-service/notify"
+)
+
+// waitForMessages waits for the recorder to have n messages, as they are sent
+// after the response.
+func waitForMessages(t *testing.T, rec *notify.Recorder, n int) []notify.Message {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if messages := rec.Messages(); len(messages) >= n {
+			return messages
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("timed out waiting for %d messages, got %d", n, len(rec.Messages()))
+	return nil
+}
+
+// linkToken takes the token out of the link in a message.
+func linkToken(t *testing.T, m notify.Message) string {
+	i := strings.Index(m.Body, "?token=")
+	if i < 0 {
+		t.Fatalf("no link in message: %s", m.Body)
+	}
+
+	token := strings.Fields(m.Body[i+len("?token="):])[0]
+	token, err := url.QueryUnescape(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func TestPasswordReset(t *testing.T) {
+	mockDB, err := dblayer.NewPersistenceLayer(dblayer.MOCKDB, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AddTestUser(mockDB)
+	rec := &notify.Recorder{}
+	r := Router(mockDB, WithNotifier(rec), WithPasswordResetURL("https://example.com/reset"))
+
+	known := postForm(t, r, "/password/forgot", url.Values{"email": {"klay_thompson@mail.com"}})
+	unknown := postForm(t, r, "/password/forgot", url.Values{"email": {"nobody@mail.com"}})
+
+	if known.Code != http.StatusAccepted || known.Code != unknown.Code || known.Body.String() != unknown.Body.String() {
+		t.Errorf("responses reveal whether the email exists: %v %s, %v %s",
+			known.Code, known.Body.String(), unknown.Code, unknown.Body.String())
+	}
+
+	messages := waitForMessages(t, rec, 1)
+	if messages[0].To != "klay_thompson@mail.com" {
+		t.Errorf("reset sent to the wrong address: %v", messages[0].To)
+	}
+
+	// A second request gives a second token, which the first reset revokes.
+	postForm(t, r, "/password/forgot", url.Values{"email": {"klay_thompson@mail.com"}})
+	messages = waitForMessages(t, rec, 2)
+
+	token := linkToken(t, messages[0])
+	rr := postForm(t, r, "/password/reset", url.Values{"token": {token}, "password": {"n3w password"}})
+	if status := rr.Code; status != http.StatusNoContent {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s",
+			status, http.StatusNoContent, rr.Body.String())
+	}
+
+	if !passwordMatches(t, mockDB, "n3w password") {
+		t.Error("password was not changed")
+	}
+
+	for name, used := range map[string]string{"reused": token, "revoked": linkToken(t, messages[1])} {
+		rr = postForm(t, r, "/password/reset", url.Values{"token": {used}, "password": {"another password"}})
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("%s token: handler returned wrong status code: got %v want %v",
+				name, status, http.StatusBadRequest)
+		}
+	}
+
+	if len(rec.Messages()) != 2 {
+		t.Errorf("a message was sent for an unknown email: %v", rec.Messages())
+	}
+}
+
+func TestPasswordResetEndsSessions(t *testing.T) {
+	mockDB, err := dblayer.NewPersistenceLayer(dblayer.MOCKDB, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AddTestUser(mockDB)
+	rec := &notify.Recorder{}
+	r := Router(mockDB, WithAuthenticator(testAuthenticator(t)), WithNotifier(rec),
+		WithPasswordResetURL("https://example.com/reset"))
+
+	// Two sessions, one of them already rotated.
+	first, second := login(t, r), login(t, r)
+	second = session(t, postForm(t, r, "/auth/refresh", url.Values{"refresh_token": {second.RefreshToken}}))
+
+	postForm(t, r, "/password/forgot", url.Values{"email": {"klay_thompson@mail.com"}})
+	form := url.Values{"token": {linkToken(t, waitForMessages(t, rec, 1)[0])}, "password": {"n3w password"}}
+	if status := postForm(t, r, "/password/reset", form).Code; status != http.StatusNoContent {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusNoContent)
+	}
+
+	for name, s := range map[string]sessionResponse{"first": first, "second": second} {
+		rr := postForm(t, r, "/auth/refresh", url.Values{"refresh_token": {s.RefreshToken}})
+		if status := rr.Code; status != http.StatusUnauthorized {
+			t.Errorf("%s session: refresh returned wrong status code: got %v want %v",
+				name, status, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestPasswordResetInvalid(t *testing.T) {
+	mockDB, err := dblayer.NewPersistenceLayer(dblayer.MOCKDB, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := Router(mockDB, WithNotifier(&notify.Recorder{}))
+
+	tests := []struct {
+		name   string
+		path   string
+		form   url.Values
+		status int
+	}{
+		{"no email", "/password/forgot", nil, http.StatusBadRequest},
+		{"no token", "/password/reset", url.Values{"password": {"n3w password"}}, http.StatusBadRequest},
+		{"weak password", "/password/reset", url.Values{"token": {"usp_x"}, "password": {"x"}}, http.StatusBadRequest},
+		{"no password", "/password/reset", url.Values{"token": {"usp_x"}}, http.StatusBadRequest},
+		{"unknown token", "/password/reset", url.Values{"token": {"usp_x"}, "password": {"n3w password"}}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		if status := postForm(t, r, tt.path, tt.form).Code; status != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.name, status, tt.status)
+		}
+	}
+}
+
+// failingReset is a database that can't reset passwords while fail is set.
+type failingReset struct {
+	dblayer.DatabaseHandler
+	fail bool
+}
+
+func (f *failingReset) ResetPassword(tokenID, password string, at time.Time) (*persistence.User, error) {
+	if f.fail {
+		return nil, errors.New("database is down")
+	}
+
+	return f.DatabaseHandler.ResetPassword(tokenID, password, at)
+}
+
+func TestPasswordResetFailure(t *testing.T) {
+	mockDB, err := dblayer.NewPersistenceLayer(dblayer.MOCKDB, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AddTestUser(mockDB)
+	dbh := &failingReset{mockDB, true}
+	rec := &notify.Recorder{}
+	r := Router(dbh, WithNotifier(rec), WithPasswordResetURL("https://example.com/reset"))
+
+	postForm(t, r, "/password/forgot", url.Values{"email": {"klay_thompson@mail.com"}})
+	form := url.Values{"token": {linkToken(t, waitForMessages(t, rec, 1)[0])}, "password": {"n3w password"}}
+
+	// A failed reset is the server's fault and leaves the token usable.
+	if status := postForm(t, r, "/password/reset", form).Code; status != http.StatusInternalServerError {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusInternalServerError)
+	}
+
+	if passwordMatches(t, mockDB, "n3w password") {
+		t.Error("password was changed by a failed reset")
+	}
+
+	dbh.fail = false
+	if status := postForm(t, r, "/password/reset", form).Code; status != http.StatusNoContent {
+		t.Errorf("retry: handler returned wrong status code: got %v want %v", status, http.StatusNoContent)
+	}
+
+	if !passwordMatches(t, mockDB, "n3w password") {
+		t.Error("password was not changed")
+	}
+}
+
+// passwordMatches reports whether password is the test user's password.
+func passwordMatches(t *testing.T, dbh dblayer.DatabaseHandler, password string) bool {
+	users, err := dbh.FindUserByCriteria("email", "klay_thompson@mail.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return newUserHandler(dbh).checkCredentials(users, password) != nil
+}
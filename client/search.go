@@ -0,0 +1,119 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	auth "github.com/omgitsotis/user-service/auth"
+	dblayer "github.com/omgitsotis/user-service/dblayer"
+	"github.com/omgitsotis/user-service/dblayer/persistence"
+)
+
+// fullTextSearchHandler searches the index for the users matching the q
+// param, best match first, e.g. /users/search?q=first_name:kl* curry. See
+// search.Index.Search for the query language.
+func (ush *userServiceHandler) fullTextSearchHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("[UserServiceHandler] Recieved GET request on %s\n", r.URL.String())
+
+	if !ush.authorize(w, r, auth.ActionSearchUsers, "") {
+		return
+	}
+
+	q := persistence.Query{}
+	if !ush.pageQuery(w, r, &q) || !ush.ranked(w, q) {
+		return
+	}
+
+	hits, total, err := ush.searchIndex.Search(r.URL.Query().Get("q"), q.Limit)
+	if err != nil {
+		log.Printf("[UserServiceHandler] invalid search query: %s\n", err.Error())
+		ush.writeErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := rankedPage{Users: []rankedUser{}, Total: total}
+	for _, hit := range hits {
+		user, err := ush.dbHandler.FindUserByID(hit.ID)
+		if err != nil {
+			// Deleted since it was found, or the index is out of date.
+			log.Printf("[UserServiceHandler] search hit %s not found: %s\n", hit.ID, err.Error())
+			resp.Total--
+			continue
+		}
+
+		ush.hideLockout(r, user)
+		score := math.Round(hit.Score*1000) / 1000
+		resp.Users = append(resp.Users, rankedUser{user, score, hit.Highlights})
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(&resp)
+}
+
+// reindexHandler rebuilds the search index from the database, for when it
+// has got out of step, such as after users were changed by another instance
+// of the service.
+func (ush *userServiceHandler) reindexHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("[UserServiceHandler] Recieved POST request on /admin/search/reindex")
+
+	if !ush.authorize(w, r, auth.ActionReindex, "") {
+		return
+	}
+
+	n, err := dblayer.Reindex(ush.dbHandler, ush.searchIndex)
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error rebuilding the search index: %s\n", err.Error())
+		ush.writeErrorResponse(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[UserServiceHandler] search index rebuilt with %v user(s)\n", n)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(map[string]int{"indexed": n})
+}
+
+// RequestReindex asks the service at baseURL to rebuild its search index, and
+// returns how many users it indexed. It is how an admin rebuilds the index
+// of a running instance from the command line. The request is made as an
+// admin with a short lived token from authenticator, which needs a JWT
+// secret, or without one if authenticator is nil as the API is then open.
+func RequestReindex(baseURL string, authenticator *auth.Authenticator) (int, error) {
+	req, err := http.NewRequest("POST", strings.TrimSuffix(baseURL, "/")+"/admin/search/reindex", nil)
+	if err != nil {
+		return 0, err
+	}
+
+	if authenticator != nil {
+		principal := &auth.Principal{Subject: "reindex", Role: persistence.RoleAdmin}
+		token, err := authenticator.Issue(principal, time.Minute)
+		if err != nil {
+			return 0, err
+		}
+
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		errResp := ErrorResponse{}
+		json.NewDecoder(resp.Body).Decode(&errResp)
+		return 0, fmt.Errorf("reindex failed with %s: %s", resp.Status, errResp.Error)
+	}
+
+	result := map[string]int{}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+
+	return result["indexed"], nil
+}
@@ -0,0 +1,165 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	dblayer "github.com/omgitsotis/user-service/dblayer"
+	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+	search "github.com/omgitsotis/user-service/search"
+)
+
+// searchDB returns the search users in a database that keeps index up to
+// date, built from them.
+func searchDB(t *testing.T, index *search.Index) dblayer.DatabaseHandler {
+	mockDB, err := dblayer.NewPersistenceLayer(dblayer.MOCKDB, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AddSearchUsers(mockDB)
+	dbh := dblayer.NewSearchLayer(mockDB, index)
+	if _, err = dblayer.Reindex(dbh, index); err != nil {
+		t.Fatal(err)
+	}
+
+	return dbh
+}
+
+func TestFullTextSearch(t *testing.T) {
+	index := search.NewIndex()
+	dbh := searchDB(t, index)
+	r := Router(dbh, WithSearchIndex(index))
+
+	tests := []struct {
+		query  string
+		status int
+		want   []string
+	}{
+		{"?q=curry", http.StatusOK, []string{"Steph"}},
+		{"?q=" + url.QueryEscape("kl*"), http.StatusOK, []string{"Klay"}},
+		{"?q=" + url.QueryEscape("country:usa"), http.StatusOK, []string{"Klay", "Steph"}},
+		{"?q=" + url.QueryEscape("country:usa") + "&limit=1", http.StatusOK, []string{"Klay"}},
+		{"?q=ibaka", http.StatusOK, []string{"Serge"}},
+		{"?q=nobody", http.StatusOK, []string{}},
+		{"", http.StatusBadRequest, nil},
+		{"?q=" + url.QueryEscape("password:x"), http.StatusBadRequest, nil},
+		{"?q=curry&sort=first_name", http.StatusBadRequest, nil},
+		{"?q=curry&limit=0", http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/users/search"+tt.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%q: handler returned wrong status code: got %v want %v", tt.query, status, tt.status)
+			continue
+		}
+
+		if tt.status != http.StatusOK {
+			continue
+		}
+
+		page := rankedPage{}
+		if err = json.NewDecoder(rr.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+
+		got := []string{}
+		for _, u := range page.Users {
+			got = append(got, u.FirstName)
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: handler returned wrong users: got %v want %v", tt.query, got, tt.want)
+		}
+	}
+
+	// Changes through the handlers are searchable straight away.
+	dbh.UpdateUser(persistence.User{ID: "3", Nickname: "Baby Faced Assassin"})
+	req, err := http.NewRequest("GET", "/users/search?q="+url.QueryEscape("nickname:assas*"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	page := rankedPage{}
+	if err = json.NewDecoder(rr.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"nickname": "Baby Faced <mark>Assassin</mark>"}
+	if len(page.Users) != 1 || !reflect.DeepEqual(page.Users[0].Highlights, want) || page.Users[0].Score <= 0 {
+		t.Errorf("wrong results for an updated user: %+v", page.Users)
+	}
+}
+
+func TestReindex(t *testing.T) {
+	index := search.NewIndex()
+	dbh := searchDB(t, index)
+	r := Router(dbh, WithSearchIndex(index))
+
+	// A change that doesn't go through the search layer is missed until the
+	// index is rebuilt.
+	index.Delete("2")
+	req, err := http.NewRequest("POST", "/admin/search/reindex", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	resp := map[string]int{}
+	if err = json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if rr.Code != http.StatusOK || resp["indexed"] != 3 {
+		t.Errorf("wrong reindex response: got %v %v", rr.Code, resp)
+	}
+
+	if hits, _, _ := index.Search("ibaka", 0); len(hits) != 1 {
+		t.Errorf("reindex did not restore the user: got %v hits", len(hits))
+	}
+
+	// The same rebuild can be asked for from outside the service.
+	srv := httptest.NewServer(Router(dbh, WithSearchIndex(index), WithAuthenticator(testAuthenticator(t))))
+	defer srv.Close()
+
+	index.Delete("2")
+	if n, err := RequestReindex(srv.URL, testAuthenticator(t)); err != nil || n != 3 {
+		t.Errorf("wrong reindex: got %v, %v want 3", n, err)
+	}
+
+	if hits, _, _ := index.Search("ibaka", 0); len(hits) != 1 {
+		t.Errorf("requested reindex did not restore the user: got %v hits", len(hits))
+	}
+
+	if _, err := RequestReindex(srv.URL, nil); err == nil {
+		t.Error("reindexed without a token")
+	}
+
+	// Without an index the routes aren't served.
+	for _, route := range []struct{ method, path string }{{"GET", "/users/search?q=curry"}, {"POST", "/admin/search/reindex"}} {
+		req, err := http.NewRequest(route.method, route.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		Router(dbh).ServeHTTP(rr, req)
+		if rr.Code == http.StatusOK {
+			t.Errorf("%s %s served without an index", route.method, route.path)
+		}
+	}
+}
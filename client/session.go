@@ -0,0 +1,186 @@
+package client
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	auth "github.com/omgitsotis/user-service/auth"
+	"github.com/omgitsotis/user-service/dblayer/persistence"
+)
+
+// sessionResponse is the tokens issued at login and on refresh, in the shape
+// of an OAuth 2 token response.
+type sessionResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// loginHandler checks a user's email or nickname and password and starts a
+// session, returning an access token and a refresh token.
+func (ush *userServiceHandler) loginHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("[UserServiceHandler] Recieved POST request on /auth/login")
+
+	user, ok := ush.formCredentials(w, r)
+	if !ok {
+		return
+	}
+
+	family, err := auth.NewTokenFamily()
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error starting session: %s\n", err.Error())
+		ush.writeErrorResponse(w, "could not log in", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[Audit] user %s logged in, session %s\n", user.ID, family)
+	ush.issueSession(w, user, family)
+}
+
+// refreshHandler swaps a refresh token for a new access token and refresh
+// token. Each refresh token can only be used once. Using one again means it
+// has been stolen, so the whole session it belongs to is revoked.
+func (ush *userServiceHandler) refreshHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("[UserServiceHandler] Recieved POST request on /auth/refresh")
+
+	token, ok := ush.findRefreshToken(w, r)
+	if !ok {
+		return
+	}
+
+	now := time.Now().UTC()
+	if token.Expired(now) {
+		log.Printf("[UserServiceHandler] refresh token %s has expired\n", token.ID)
+		ush.writeErrorResponse(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	// Revoking the token is what marks it as used, and only one request can
+	// revoke it, so two requests racing with the same token count as reuse.
+	rotated, err := ush.dbHandler.RevokeToken(token.ID, now)
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error rotating refresh token: %s\n", err.Error())
+		ush.writeErrorResponse(w, "could not refresh session", http.StatusInternalServerError)
+		return
+	}
+
+	if !rotated {
+		log.Printf("[Audit] refresh token %s reused, revoking session %s of user %s\n", token.ID, token.Family, token.UserID)
+		ush.revokeSession(token.Family)
+		ush.writeErrorResponse(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	// The user is looked up again so a changed role is picked up, and a
+	// deleted user can't carry on.
+	user, err := ush.dbHandler.FindUserByID(token.UserID)
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error finding user %s for session: %s\n", token.UserID, err.Error())
+		ush.revokeSession(token.Family)
+		ush.writeErrorResponse(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	ush.issueSession(w, user, token.Family)
+}
+
+// logoutHandler ends the session a refresh token belongs to. It succeeds even
+// if the session has already ended.
+func (ush *userServiceHandler) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("[UserServiceHandler] Recieved POST request on /auth/logout")
+
+	token, ok := ush.findRefreshToken(w, r)
+	if !ok {
+		return
+	}
+
+	if err := ush.dbHandler.RevokeTokenFamily(token.Family, time.Now().UTC()); err != nil {
+		log.Printf("[UserServiceHandler] Error logging out: %s\n", err.Error())
+		ush.writeErrorResponse(w, "could not log out", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("[Audit] user %s logged out, session %s\n", token.UserID, token.Family)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// issueSession writes a new access token and refresh token for user. The
+// refresh token is added to family.
+func (ush *userServiceHandler) issueSession(w http.ResponseWriter, user *persistence.User, family string) {
+	access, err := ush.authenticator.Issue(&auth.Principal{Subject: user.ID, Role: user.Role}, auth.AccessTokenTTL)
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error issuing access token: %s\n", err.Error())
+		ush.writeErrorResponse(w, "could not issue tokens", http.StatusInternalServerError)
+		return
+	}
+
+	refresh, hash, err := auth.NewRefreshToken()
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error generating refresh token: %s\n", err.Error())
+		ush.writeErrorResponse(w, "could not issue tokens", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().UTC()
+	expires := now.Add(auth.RefreshTokenTTL)
+	_, err = ush.dbHandler.AddToken(persistence.Token{
+		Kind:      persistence.TokenRefresh,
+		Hash:      hash,
+		UserID:    user.ID,
+		Family:    family,
+		CreatedAt: now,
+		ExpiresAt: &expires,
+	})
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error storing refresh token: %s\n", err.Error())
+		ush.writeErrorResponse(w, "could not issue tokens", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(sessionResponse{
+		AccessToken:  access,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(auth.AccessTokenTTL / time.Second),
+		RefreshToken: refresh,
+	})
+}
+
+// findRefreshToken looks up the refresh token in a form, writing a 401 if it
+// isn't one.
+func (ush *userServiceHandler) findRefreshToken(w http.ResponseWriter, r *http.Request) (*persistence.Token, bool) {
+	r.ParseForm()
+	refresh := r.FormValue("refresh_token")
+	if refresh == "" {
+		log.Println("[UserServiceHandler] no refresh token")
+		ush.writeErrorResponse(w, "refresh_token is required", http.StatusBadRequest)
+		return nil, false
+	}
+
+	token, err := ush.dbHandler.FindTokenByHash(auth.HashToken(refresh))
+	if err == persistence.ErrTokenNotFound || (err == nil && token.Kind != persistence.TokenRefresh) {
+		log.Println("[UserServiceHandler] unknown refresh token")
+		ush.writeErrorResponse(w, "invalid refresh token", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error finding refresh token: %s\n", err.Error())
+		ush.writeErrorResponse(w, "could not check refresh token", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return token, true
+}
+
+// revokeSession revokes every refresh token in a family. Failing to is
+// logged, the request is refused either way.
+func (ush *userServiceHandler) revokeSession(family string) {
+	if err := ush.dbHandler.RevokeTokenFamily(family, time.Now().UTC()); err != nil {
+		log.Printf("[UserServiceHandler] Error revoking session %s: %s\n", family, err.Error())
+	}
+}
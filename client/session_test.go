@@ -0,0 +1,160 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	dblayer "github.com/omgitsotis/user-service/dblayer"
+)
+
+func postForm(t *testing.T, r *mux.Router, path string, form url.Values) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	return rr
+}
+
+// session decodes the tokens from a successful login or refresh.
+func session(t *testing.T, rr *httptest.ResponseRecorder) sessionResponse {
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s",
+			status, http.StatusOK, rr.Body.String())
+	}
+
+	s := sessionResponse{}
+	if err := json.NewDecoder(rr.Body).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.AccessToken == "" || s.RefreshToken == "" || s.TokenType != "Bearer" {
+		t.Fatalf("incomplete session: %+v", s)
+	}
+
+	return s
+}
+
+func login(t *testing.T, r *mux.Router) sessionResponse {
+	form := url.Values{"email": {"klay_thompson@mail.com"}, "password": {"password"}}
+	return session(t, postForm(t, r, "/auth/login", form))
+}
+
+func TestLoginAndRefresh(t *testing.T) {
+	mockDB, err := dblayer.NewPersistenceLayer(dblayer.MOCKDB, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AddTestUser(mockDB)
+	r := Router(mockDB, WithAuthenticator(testAuthenticator(t)))
+
+	s := login(t, r)
+
+	// The access token works on the API like any other token.
+	req, err := http.NewRequest("GET", "/user/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+s.AccessToken)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("access token was refused: got %v want %v", status, http.StatusOK)
+	}
+
+	refreshed := session(t, postForm(t, r, "/auth/refresh", url.Values{"refresh_token": {s.RefreshToken}}))
+	if refreshed.RefreshToken == s.RefreshToken {
+		t.Error("refresh token was not rotated")
+	}
+
+	// Reusing the rotated token revokes the whole session, including the
+	// token it was rotated into.
+	rr = postForm(t, r, "/auth/refresh", url.Values{"refresh_token": {s.RefreshToken}})
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("rotated token was accepted: got %v want %v", status, http.StatusUnauthorized)
+	}
+
+	rr = postForm(t, r, "/auth/refresh", url.Values{"refresh_token": {refreshed.RefreshToken}})
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("session survived token reuse: got %v want %v", status, http.StatusUnauthorized)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	mockDB, err := dblayer.NewPersistenceLayer(dblayer.MOCKDB, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AddTestUser(mockDB)
+	r := Router(mockDB, WithAuthenticator(testAuthenticator(t)))
+
+	first := login(t, r)
+	second := login(t, r)
+
+	rr := postForm(t, r, "/auth/logout", url.Values{"refresh_token": {first.RefreshToken}})
+	if status := rr.Code; status != http.StatusNoContent {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNoContent)
+	}
+
+	rr = postForm(t, r, "/auth/refresh", url.Values{"refresh_token": {first.RefreshToken}})
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("logged out session was refreshed: got %v want %v", status, http.StatusUnauthorized)
+	}
+
+	// Logging out of one session leaves the others alone.
+	session(t, postForm(t, r, "/auth/refresh", url.Values{"refresh_token": {second.RefreshToken}}))
+}
+
+func TestSessionInvalid(t *testing.T) {
+	mockDB, err := dblayer.NewPersistenceLayer(dblayer.MOCKDB, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AddTestUser(mockDB)
+	r := Router(mockDB, WithAuthenticator(testAuthenticator(t)))
+
+	tests := []struct {
+		name   string
+		path   string
+		form   url.Values
+		status int
+	}{
+		{"wrong password", "/auth/login", url.Values{"email": {"klay_thompson@mail.com"}, "password": {"nope"}}, http.StatusUnauthorized},
+		{"no credentials", "/auth/login", nil, http.StatusBadRequest},
+		{"unknown refresh token", "/auth/refresh", url.Values{"refresh_token": {"usr_nope"}}, http.StatusUnauthorized},
+		{"no refresh token", "/auth/refresh", nil, http.StatusBadRequest},
+		{"unknown logout token", "/auth/logout", url.Values{"refresh_token": {"usr_nope"}}, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		if status := postForm(t, r, tt.path, tt.form).Code; status != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.name, status, tt.status)
+		}
+	}
+
+	// A deleted user's session can't be refreshed.
+	s := login(t, r)
+	if err = mockDB.DeleteUser("1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := postForm(t, r, "/auth/refresh", url.Values{"refresh_token": {s.RefreshToken}}).Code; status != http.StatusUnauthorized {
+		t.Errorf("deleted user's session was refreshed: got %v want %v", status, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,92 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	auth "github.com/omgitsotis/user-service/auth"
+	"github.com/omgitsotis/user-service/dblayer/persistence"
+	notify "github.com/omgitsotis/user-service/notify"
+)
+
+// sendVerification sends user a link to verify their email with. The token
+// is tied to the email it was sent to, so it stops working if the email
+// changes before it is used.
+func (ush *userServiceHandler) sendVerification(user persistence.User) {
+	if user.Email == "" {
+		return
+	}
+
+	token, hash, err := auth.NewEmailVerificationToken()
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error generating verification token: %s\n", err.Error())
+		return
+	}
+
+	now := time.Now().UTC()
+	expires := now.Add(auth.EmailVerificationTTL)
+	_, err = ush.dbHandler.AddToken(persistence.Token{
+		Kind:      persistence.TokenEmailVerification,
+		Hash:      hash,
+		Name:      user.Email,
+		UserID:    user.ID,
+		Family:    auth.EmailVerificationFamily(user.ID),
+		CreatedAt: now,
+		ExpiresAt: &expires,
+	})
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error storing verification token: %s\n", err.Error())
+		return
+	}
+
+	link := ush.publicURL + "/verify?token=" + url.QueryEscape(token)
+	err = ush.notifier.Notify(notify.Message{
+		To:      user.Email,
+		Subject: "Verify your email",
+		Body: fmt.Sprintf("Follow this link within %v to verify your email:\n\n%s\n\n"+
+			"If you didn't sign up, you can ignore this message.\n", auth.EmailVerificationTTL, link),
+	})
+	if err != nil {
+		log.Printf("[UserServiceHandler] Error sending verification to user %s: %s\n", user.ID, err.Error())
+		return
+	}
+
+	log.Printf("[UserServiceHandler] sent verification link to user %s\n", user.ID)
+}
+
+// verifyEmailHandler marks a user's email as verified using the token from a
+// verification link.
+func (ush *userServiceHandler) verifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("[UserServiceHandler] Recieved GET request on /verify")
+
+	token, ok := ush.checkToken(w, r.URL.Query().Get("token"), persistence.TokenEmailVerification)
+	if !ok {
+		return
+	}
+
+	// The email is compared in the same change that verifies it, so it
+	// can't change in between.
+	now := time.Now().UTC()
+	user, err := ush.dbHandler.VerifyEmail(token.ID, now)
+	if err == persistence.ErrTokenUsed || err == persistence.ErrTokenStale {
+		log.Printf("[UserServiceHandler] verification token %s for user %s: %s\n", token.ID, token.UserID, err.Error())
+		ush.writeErrorResponse(w, "invalid or expired token", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("[UserServiceHandler] Error verifying user %s: %s\n", token.UserID, err.Error())
+		ush.writeErrorResponse(w, "could not verify email", http.StatusInternalServerError)
+		return
+	}
+
+	if err = ush.dbHandler.RevokeTokenFamily(token.Family, now); err != nil {
+		log.Printf("[UserServiceHandler] Error revoking verification tokens for user %s: %s\n", user.ID, err.Error())
+	}
+
+	log.Printf("[Audit] user %s verified their email\n", user.ID)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(StatusResponse{"email verified"})
+}
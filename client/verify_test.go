@@ -0,0 +1,89 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	dblayer "github.com/omgitsotis/user-service/dblayer"
+	notify "github.com/omgitsotis/user-service/notify"
+)
+
+func TestEmailVerification(t *testing.T) {
+	mockDB, err := dblayer.NewPersistenceLayer(dblayer.MOCKDB, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &notify.Recorder{}
+	r := Router(mockDB, WithNotifier(rec), WithPublicURL("https://users.example.com/"))
+
+	form := url.Values{
+		"first_name": {"Klay"},
+		"nickname":   {"Splash Brother"},
+		"email":      {"klay_thompson@mail.com"},
+		"password":   {"correct horse"},
+	}
+
+	if status := postForm(t, r, "/user", form).Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	messages := waitForMessages(t, rec, 1)
+	if messages[0].To != "klay_thompson@mail.com" || !strings.Contains(messages[0].Body, "https://users.example.com/verify?token=") {
+		t.Fatalf("wrong verification message: %+v", messages[0])
+	}
+
+	first := linkToken(t, messages[0])
+
+	// Changing the email sends a new link, and the old one stops working.
+	req, err := http.NewRequest("PUT", "/user/1", strings.NewReader(url.Values{"email": {"klay@mail.com"}}.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	messages = waitForMessages(t, rec, 2)
+	second := linkToken(t, messages[1])
+
+	if status := verifyEmail(r, first).Code; status != http.StatusBadRequest {
+		t.Errorf("link for the old email worked: got %v want %v", status, http.StatusBadRequest)
+	}
+
+	if status := verifyEmail(r, second).Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	user, err := mockDB.FindUserByID("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !user.EmailVerified || user.VerifiedAt == nil {
+		t.Errorf("user was not verified: %v", user)
+	}
+
+	if status := verifyEmail(r, second).Code; status != http.StatusBadRequest {
+		t.Errorf("link worked twice: got %v want %v", status, http.StatusBadRequest)
+	}
+
+	users, err := mockDB.FindUserByCriteria("email_verified", "true")
+	if err != nil || len(users) != 1 {
+		t.Errorf("verified user not found by search: %v %v", users, err)
+	}
+}
+
+func verifyEmail(r http.Handler, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/verify?token="+url.QueryEscape(token), nil)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	return rr
+}
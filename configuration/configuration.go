@@ -9,25 +9,118 @@ import (
 )
 
 var (
-	DBTypeDefault      = dblayer.MOCKDB
-	RestfulEPDefault   = "localhost:8080"
-	DefaultAMQPBrooker = "test"
+	DBTypeDefault       = dblayer.MOCKDB
+	DBConnectionDefault = ""
+	RestfulEPDefault    = "localhost:8080"
+	DefaultAMQPBrooker  = ""
+	DefaultAMQPExchange = "users"
+	DefaultMFAIssuer    = "user-service"
+
+	DefaultLockoutThreshold    = 5
+	DefaultIPLockoutThreshold  = 20
+	DefaultLockoutSeconds      = 60
+	DefaultLockoutMaxSeconds   = 3600
+	DefaultIPLockoutSeconds    = 60
+	DefaultIPLockoutMaxSeconds = 3600
 )
 
 type ServiceConfig struct {
 	DatabaseLayer dblayer.DBType `json:"database_type"`
+	DBConnection  string         `json:"database_connection"`
 	RestfulEP     string         `json:"endpoint"`
 	AMQPBrooker   string         `json:"amqp_brooker"`
+	AMQPExchange  string         `json:"amqp_exchange"`
+	// JWTSecret and JWKSFile turn on bearer token authentication for HS256
+	// and RS256 tokens respectively. With neither set the API is open.
+	JWTSecret string `json:"jwt_hmac_secret"`
+	JWKSFile  string `json:"jwt_jwks_file"`
+	// Policies overrides the roles allowed to perform each action, see
+	// auth.DefaultPolicy for the actions and their defaults.
+	Policies map[string][]string `json:"policies"`
+	// SMTPServer is the host:port of the mail server messages such as
+	// password reset links are sent through. Without one they are only
+	// logged.
+	SMTPServer   string `json:"smtp_server"`
+	SMTPFrom     string `json:"smtp_from"`
+	SMTPUsername string `json:"smtp_username"`
+	SMTPPassword string `json:"smtp_password"`
+	// PasswordResetURL is the page password reset links point at.
+	PasswordResetURL string `json:"password_reset_url"`
+	// PublicURL is where users reach the service, for links back to it
+	// such as email verification. It defaults to http:// and the endpoint.
+	PublicURL string `json:"public_url"`
+	// MFAEncryptionKey is the base64 encoded 32 byte key authenticator
+	// secrets are encrypted with. Two-factor authentication is only offered
+	// when it is set.
+	MFAEncryptionKey string `json:"mfa_encryption_key"`
+	// MFAIssuer names the service in authenticator apps.
+	MFAIssuer string `json:"mfa_issuer"`
+	// Failed logins in a row lock out the user after LockoutThreshold, for
+	// LockoutSeconds doubling with each failure after up to
+	// LockoutMaxSeconds. The address they came from is locked out the same
+	// way with the IP settings. A threshold of 0 turns that lock off.
+	LockoutThreshold    int `json:"lockout_threshold"`
+	IPLockoutThreshold  int `json:"ip_lockout_threshold"`
+	LockoutSeconds      int `json:"lockout_seconds"`
+	LockoutMaxSeconds   int `json:"lockout_max_seconds"`
+	IPLockoutSeconds    int `json:"ip_lockout_seconds"`
+	IPLockoutMaxSeconds int `json:"ip_lockout_max_seconds"`
+	// TrustedProxy takes client addresses from X-Forwarded-For. Only set it
+	// when the service is behind a proxy that sets the header.
+	TrustedProxy bool `json:"trusted_proxy"`
 }
 
 func GetConfiguration(filename string) (ServiceConfig, error) {
-	conf := ServiceConfig{DBTypeDefault, RestfulEPDefault, DefaultAMQPBrooker}
+	conf := ServiceConfig{
+		DatabaseLayer: DBTypeDefault,
+		DBConnection:  DBConnectionDefault,
+		RestfulEP:     RestfulEPDefault,
+		AMQPBrooker:   DefaultAMQPBrooker,
+		AMQPExchange:  DefaultAMQPExchange,
+		MFAIssuer:     DefaultMFAIssuer,
+
+		LockoutThreshold:    DefaultLockoutThreshold,
+		IPLockoutThreshold:  DefaultIPLockoutThreshold,
+		LockoutSeconds:      DefaultLockoutSeconds,
+		LockoutMaxSeconds:   DefaultLockoutMaxSeconds,
+		IPLockoutSeconds:    DefaultIPLockoutSeconds,
+		IPLockoutMaxSeconds: DefaultIPLockoutMaxSeconds,
+	}
 	file, err := os.Open(filename)
 	if err != nil {
 		fmt.Println("Configuration file not found, using defaults")
 		return conf, err
 	}
 
-	err = json.NewDecoder(file).Decode(&conf)
-	return conf, err
+	if err = json.NewDecoder(file).Decode(&conf); err != nil {
+		return conf, err
+	}
+
+	return conf, conf.Validate()
+}
+
+// Validate returns an error for settings the service can't run with.
+func (c ServiceConfig) Validate() error {
+	if err := validLockout("", c.LockoutThreshold, c.LockoutSeconds, c.LockoutMaxSeconds); err != nil {
+		return err
+	}
+
+	return validLockout("ip_", c.IPLockoutThreshold, c.IPLockoutSeconds, c.IPLockoutMaxSeconds)
+}
+
+// validLockout checks the lockout settings starting with prefix. The
+// durations only matter when the threshold turns the lock on.
+func validLockout(prefix string, threshold, seconds, maxSeconds int) error {
+	switch {
+	case threshold < 0:
+		return fmt.Errorf("%slockout_threshold can't be negative", prefix)
+	case threshold == 0:
+		return nil
+	case seconds <= 0:
+		return fmt.Errorf("%slockout_seconds must be positive", prefix)
+	case maxSeconds < seconds:
+		return fmt.Errorf("%slockout_max_seconds can't be less than %slockout_seconds", prefix, prefix)
+	}
+
+	return nil
 }
@@ -0,0 +1,58 @@
+package configuration
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLockoutSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		config string
+		valid  bool
+	}{
+		{`{}`, true},
+		{`{"lockout_threshold": 0, "lockout_seconds": 0, "lockout_max_seconds": 0}`, true},
+		{`{"lockout_seconds": 0}`, false},
+		{`{"lockout_seconds": -60}`, false},
+		{`{"lockout_max_seconds": 0}`, false},
+		{`{"lockout_seconds": 600, "lockout_max_seconds": 60}`, false},
+		{`{"lockout_seconds": 60, "lockout_max_seconds": 60}`, true},
+		{`{"lockout_threshold": -1}`, false},
+		{`{"ip_lockout_seconds": 0}`, false},
+		{`{"ip_lockout_seconds": 600, "ip_lockout_max_seconds": 60}`, false},
+		{`{"ip_lockout_threshold": 0, "ip_lockout_max_seconds": 0}`, true},
+	}
+
+	path := filepath.Join(dir, "config.json")
+	for _, tt := range tests {
+		if err = ioutil.WriteFile(path, []byte(tt.config), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := GetConfiguration(path); (err == nil) != tt.valid {
+			t.Errorf("%s: got error %v, want valid %v", tt.config, err, tt.valid)
+		}
+	}
+
+	// The address lock has its own durations.
+	if err = ioutil.WriteFile(path, []byte(`{"ip_lockout_seconds": 5, "ip_lockout_max_seconds": 50}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := GetConfiguration(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.LockoutSeconds != DefaultLockoutSeconds || conf.IPLockoutSeconds != 5 || conf.IPLockoutMaxSeconds != 50 {
+		t.Errorf("wrong lockout settings: %+v", conf)
+	}
+}
@@ -0,0 +1,822 @@
+package boltlayer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+	events "github.com/omgitsotis/user-service/events"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Layout of the database file:
+//
+//	users            id -> JSON encoded record
+//	index_<criteria> value 0x00 id -> nothing
+//	unique_<field>   lower cased value -> id
+//	outbox           id -> JSON encoded outboxRecord
+//
+// IDs are 8 byte big endian integers so that keys sort in the order users
+// were added. Every field a query can search or sort by has an index bucket,
+// whose keys are in the order of the field, so searching only touches the
+// users that match one of its criteria and a sorted page can be read
+// straight from the index. Email and nickname, which no two users can share,
+// are searched through a unique bucket instead.
+var (
+	usersBucket  = []byte("users")
+	outboxBucket = []byte("outbox")
+)
+
+// indexes maps each field users can be searched or sorted by to its value.
+var indexes = map[string]func(*record) string{
+	"country":    func(r *record) string { return r.Country },
+	"first_name": func(r *record) string { return r.FirstName },
+	"last_name":  func(r *record) string { return r.LastName },
+	"nickname":   func(r *record) string { return r.Nickname },
+	"email":      func(r *record) string { return r.Email },
+	"role":       func(r *record) string { return r.Role },
+	// Searched for with true or false
+	"email_verified": func(r *record) string { return strconv.FormatBool(r.EmailVerified) },
+}
+
+// uniques maps each field no two users can share, ignoring case, to the
+// field. They are searched through their unique bucket.
+var uniques = map[string]func(*record) string{
+	"email":    func(r *record) string { return r.Email },
+	"nickname": func(r *record) string { return r.Nickname },
+}
+
+// record is how a user is stored. It is kept separate from persistence.User
+// so the API representation of a user can change without changing what is
+// on disk.
+type record struct {
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Nickname  string `json:"nickname"`
+	Password  string `json:"password"`
+	Email     string `json:"email"`
+	Country   string `json:"country"`
+	Role      string `json:"role"`
+
+	EmailVerified bool       `json:"email_verified"`
+	VerifiedAt    *time.Time `json:"verified_at,omitempty"`
+	TOTP          *totp      `json:"totp,omitempty"`
+	Lockout       *lockout   `json:"lockout,omitempty"`
+}
+
+// totp is how a user's authenticator is stored. The secret is already
+// encrypted.
+type totp struct {
+	Secret   string `json:"secret"`
+	Enabled  bool   `json:"enabled"`
+	LastStep int64  `json:"last_step"`
+}
+
+// lockout is how a user's failed logins are stored.
+type lockout struct {
+	Failures    int        `json:"failures"`
+	LastFailure time.Time  `json:"last_failure"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+}
+
+// outboxRecord is how an event waiting in the outbox is stored.
+type outboxRecord struct {
+	Event     events.Event `json:"event"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+// BoltDatabase is a DatabaseHandler that keeps users in an embedded bbolt
+// key/value store, so the service can persist users without an external
+// database. Every change to a user also writes an event to the outbox bucket
+// in the same transaction.
+type BoltDatabase struct {
+	db *bolt.DB
+}
+
+// NewBoltDatabase opens (or creates) the bbolt database file at path.
+func NewBoltDatabase(path string) (*BoltDatabase, error) {
+	if path == "" {
+		return nil, errors.New("no bolt database path provided")
+	}
+
+	// Only one process can hold the file open, fail rather than hang if
+	// another instance already has it.
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(usersBucket); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(outboxBucket); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(tokensBucket); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(tokenHashBucket); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(tokenFamilyBucket); err != nil {
+			return err
+		}
+
+		// An index added since the file was created starts out empty, so
+		// the existing users are added to it.
+		for criteria := range indexes {
+			if tx.Bucket(indexBucket(criteria)) != nil {
+				continue
+			}
+
+			if _, err := tx.CreateBucket(indexBucket(criteria)); err != nil {
+				return err
+			}
+
+			if err := buildIndex(tx, criteria); err != nil {
+				return err
+			}
+		}
+
+		for field := range uniques {
+			if tx.Bucket(uniqueBucket(field)) != nil {
+				continue
+			}
+
+			if _, err := tx.CreateBucket(uniqueBucket(field)); err != nil {
+				return err
+			}
+
+			if err := buildUnique(tx, field); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	log.Printf("[BoltDB] opened database %s\n", path)
+	return &BoltDatabase{db}, nil
+}
+
+// Close closes the database file.
+func (db *BoltDatabase) Close() error {
+	return db.db.Close()
+}
+
+func (db *BoltDatabase) AddUser(user persistence.User) (*persistence.User, error) {
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		seq, err := tx.Bucket(usersBucket).NextSequence()
+		if err != nil {
+			return err
+		}
+
+		user.ID = strconv.FormatUint(seq, 10)
+		if err = putRecord(tx, idKey(seq), toRecord(user)); err != nil {
+			return err
+		}
+
+		return addEvent(tx, events.NewUserEvent(events.UserCreated, nil, &user))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[BoltDB] added new user %s\n", user.ID)
+	return &user, nil
+}
+
+func (db *BoltDatabase) FindUserByID(id string) (*persistence.User, error) {
+	var user *persistence.User
+	err := db.db.View(func(tx *bolt.Tx) error {
+		key, r, err := getRecord(tx, id)
+		if err != nil {
+			return err
+		}
+
+		user = r.toUser(key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[BoltDB] found user %s\n", user.ID)
+	return user, nil
+}
+
+func (db *BoltDatabase) DeleteUser(id string) error {
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		key, r, err := getRecord(tx, id)
+		if err != nil {
+			return err
+		}
+
+		if err = unindex(tx, key, r); err != nil {
+			return err
+		}
+
+		if err = tx.Bucket(usersBucket).Delete(key); err != nil {
+			return err
+		}
+
+		return addEvent(tx, events.NewUserEvent(events.UserDeleted, r.toUser(key), nil))
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[BoltDB] deleted user %s\n", id)
+	return nil
+}
+
+func (db *BoltDatabase) FindUserByCriteria(criteria string, value string) ([]*persistence.User, error) {
+	page, err := db.FindUsers(persistence.Query{Criteria: []persistence.Criterion{{Field: criteria, Value: value}}})
+	if err != nil {
+		return nil, err
+	}
+
+	return page.Users, nil
+}
+
+// FindUsers reads the users equal to one value the query's filter needs from
+// its bucket, or every user if it doesn't need any, and checks the filter
+// against each of them. They all have to be read to count them, so they are
+// then sorted and paged. A query without a filter reads the page straight
+// from the index of its sort field, stopping at the end of the page, and
+// counts every user.
+func (db *BoltDatabase) FindUsers(q persistence.Query) (*persistence.Page, error) {
+	q, err := q.Normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	page := &persistence.Page{Users: make([]*persistence.User, 0)}
+	err = db.db.View(func(tx *bolt.Tx) error {
+		if q.Filter == nil {
+			page.Total = tx.Bucket(usersBucket).Stats().KeyN
+			return inOrder(tx, q, func(key []byte, r *record) bool {
+				return addToPage(page, q, r.toUser(key))
+			})
+		}
+
+		matches := make([]*persistence.User, 0)
+		err := candidates(tx, q, func(key []byte, r *record) error {
+			if user := r.toUser(key); q.Match(user) {
+				matches = append(matches, user)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		page.Total = len(matches)
+		sort.Slice(matches, func(i, j int) bool {
+			return q.Less(matches[i], matches[j])
+		})
+
+		for _, user := range matches {
+			if q.Follows(user) && !addToPage(page, q, user) {
+				break
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[BoltDB] found %v of %v user(s) with %s", len(page.Users), page.Total, q)
+	return page, nil
+}
+
+// UpdateUser only overwrites the fields of u that are set, see
+// persistence.User.Merge.
+func (db *BoltDatabase) UpdateUser(u persistence.User) (*persistence.User, error) {
+	var user *persistence.User
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		key, r, err := getRecord(tx, u.ID)
+		if err != nil {
+			return err
+		}
+
+		if err = unindex(tx, key, r); err != nil {
+			return err
+		}
+
+		before := r.toUser(key)
+		user = r.toUser(key)
+		user.Merge(u)
+		if err = putRecord(tx, key, toRecord(*user)); err != nil {
+			return err
+		}
+
+		return addEvent(tx, events.NewUserEvent(events.UserUpdated, before, user))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[BoltDB] updated user %v", user)
+	return user, nil
+}
+
+// UseTOTPStep doesn't write an event, and bolt only runs one write
+// transaction at a time so the step can't be checked and set by two at once.
+// Like UpdateLockout, the record stays in the same indexes.
+func (db *BoltDatabase) UseTOTPStep(id string, step int64) (bool, error) {
+	used := false
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		key, r, err := getRecord(tx, id)
+		if err != nil {
+			return err
+		}
+
+		if r.TOTP == nil || step <= r.TOTP.LastStep {
+			return nil
+		}
+
+		r.TOTP.LastStep, used = step, true
+		return putRecord(tx, key, r)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return used, nil
+}
+
+// UpdateLockout doesn't write an event, failed logins aren't a change to the
+// user other services need to know about. The indexed fields don't change,
+// so the record stays in the same indexes.
+func (db *BoltDatabase) UpdateLockout(id string, update func(persistence.Lockout) persistence.Lockout) (*persistence.Lockout, error) {
+	var updated *persistence.Lockout
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		key, r, err := getRecord(tx, id)
+		if err != nil {
+			return err
+		}
+
+		current := persistence.Lockout{}
+		if user := r.toUser(key); user.Lockout != nil {
+			current = *user.Lockout
+		}
+
+		r.Lockout = nil
+		if l := update(current); l.Failures > 0 {
+			r.Lockout = &lockout{l.Failures, l.LastFailure, l.LockedUntil}
+			updated = &l
+		}
+
+		return putRecord(tx, key, r)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if updated == nil {
+		log.Printf("[BoltDB] cleared lockout for user %s\n", id)
+	}
+
+	return updated, nil
+}
+
+func (db *BoltDatabase) PendingEvents(limit int) ([]events.OutboxEntry, error) {
+	entries := make([]events.OutboxEntry, 0)
+	err := db.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(outboxBucket).Cursor()
+		for k, v := c.First(); k != nil && len(entries) < limit; k, v = c.Next() {
+			var r outboxRecord
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+
+			entries = append(entries, events.OutboxEntry{
+				ID:        int64(binary.BigEndian.Uint64(k)),
+				Event:     r.Event,
+				CreatedAt: r.CreatedAt,
+			})
+		}
+
+		return nil
+	})
+
+	return entries, err
+}
+
+func (db *BoltDatabase) MarkSent(id int64) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(outboxBucket).Delete(idKey(uint64(id)))
+	})
+}
+
+func (db *BoltDatabase) OutboxBacklog() (int, time.Time, error) {
+	var count int
+	var oldest time.Time
+	err := db.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(outboxBucket)
+		count = b.Stats().KeyN
+		if _, v := b.Cursor().First(); v != nil {
+			var r outboxRecord
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+
+			oldest = r.CreatedAt
+		}
+
+		return nil
+	})
+
+	return count, oldest, err
+}
+
+// addEvent writes e to the outbox as part of tx, so the event is only stored
+// if the change it describes is.
+func addEvent(tx *bolt.Tx, e events.Event) error {
+	if e.Empty() {
+		return nil
+	}
+
+	b := tx.Bucket(outboxBucket)
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(outboxRecord{e, time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+
+	return b.Put(idKey(seq), data)
+}
+
+// getRecord looks up the user with the given ID, returning its key as well as
+// the stored record.
+func getRecord(tx *bolt.Tx, id string) ([]byte, *record, error) {
+	seq, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, nil, errors.New("no user found with ID")
+	}
+
+	key := idKey(seq)
+	data := tx.Bucket(usersBucket).Get(key)
+	if data == nil {
+		return nil, nil, errors.New("no user found with ID")
+	}
+
+	r, err := decodeRecord(data)
+	return key, r, err
+}
+
+// putRecord stores r under key and adds it to every index. Any previous
+// version of the record must already have been removed from the indexes. It
+// returns a persistence.ConflictError if another user has the email or
+// nickname of r.
+func putRecord(tx *bolt.Tx, key []byte, r *record) error {
+	for field, value := range uniques {
+		k := []byte(persistence.UniqueKey(value(r)))
+		if len(k) == 0 {
+			continue
+		}
+
+		b := tx.Bucket(uniqueBucket(field))
+		if owner := b.Get(k); owner != nil && !bytes.Equal(owner, key) {
+			return &persistence.ConflictError{Field: field}
+		}
+
+		if err := b.Put(k, key); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Bucket(usersBucket).Put(key, data); err != nil {
+		return err
+	}
+
+	for criteria, field := range indexes {
+		k := append(indexPrefix(field(r)), key...)
+		if err = tx.Bucket(indexBucket(criteria)).Put(k, []byte{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// candidates calls fn, in the order they were added, for the users equal to
+// one of the values a normalized query needs, see Query.Equalities. A
+// unique bucket holds at most one user, so it is used over an index. A
+// query that doesn't need any reads every user.
+func candidates(tx *bolt.Tx, q persistence.Query, fn func(key []byte, r *record) error) error {
+	users := tx.Bucket(usersBucket)
+	equalities := q.Equalities()
+	for _, c := range equalities {
+		if _, ok := uniques[c.Field]; !ok {
+			continue
+		}
+
+		key := tx.Bucket(uniqueBucket(c.Field)).Get([]byte(c.Value))
+		if key == nil {
+			return nil
+		}
+
+		r, err := decodeRecord(users.Get(key))
+		if err != nil {
+			return err
+		}
+
+		return fn(key, r)
+	}
+
+	for _, c := range equalities {
+		if _, ok := indexes[c.Field]; !ok {
+			continue
+		}
+
+		prefix := indexPrefix(c.Value)
+		cur := tx.Bucket(indexBucket(c.Field)).Cursor()
+		for k, _ := cur.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cur.Next() {
+			// The prefix of a longer value that happens to contain a 0x00
+			// would also match, so check the rest of the key is just an ID.
+			if len(k) != len(prefix)+8 {
+				continue
+			}
+
+			key := k[len(prefix):]
+			r, err := decodeRecord(users.Get(key))
+			if err != nil {
+				return err
+			}
+
+			if err = fn(key, r); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return users.ForEach(func(key, data []byte) error {
+		r, err := decodeRecord(data)
+		if err != nil {
+			return err
+		}
+
+		return fn(key, r)
+	})
+}
+
+// inOrder calls fn for each user after the cursor of a normalized query, in
+// the order of the query, until it returns false. Users sorted by ID are
+// read from the users bucket, and by anything else from the index of the
+// field.
+func inOrder(tx *bolt.Tx, q persistence.Query, fn func(key []byte, r *record) bool) error {
+	users := tx.Bucket(usersBucket)
+	b := users
+	if q.Sort != "id" {
+		b = tx.Bucket(indexBucket(q.Sort))
+	}
+
+	var start []byte
+	if q.After != nil {
+		seq, err := strconv.ParseUint(q.After.ID, 10, 64)
+		if err != nil {
+			return persistence.ErrInvalidCursor
+		}
+
+		start = idKey(seq)
+		if q.Sort != "id" {
+			start = append(indexPrefix(q.After.Value), start...)
+		}
+	}
+
+	c := b.Cursor()
+	next := c.Next
+	if q.Descending {
+		next = c.Prev
+	}
+
+	for k, v := seek(c, start, q.Descending); k != nil; k, v = next() {
+		key := k
+		if q.Sort != "id" {
+			if len(k) < 9 {
+				continue
+			}
+
+			key = k[len(k)-8:]
+			v = users.Get(key)
+		}
+
+		r, err := decodeRecord(v)
+		if err != nil {
+			return err
+		}
+
+		if !fn(key, r) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// seek moves c to the first key after start, going backwards if descending,
+// or to the first key if there is no start. The key at start may have been
+// deleted since it was handed out, so it isn't expected to be there.
+func seek(c *bolt.Cursor, start []byte, descending bool) ([]byte, []byte) {
+	switch {
+	case start == nil && descending:
+		return c.Last()
+	case start == nil:
+		return c.First()
+	}
+
+	k, v := c.Seek(start)
+	switch {
+	case descending && k == nil:
+		return c.Last()
+	case descending:
+		return c.Prev()
+	case bytes.Equal(k, start):
+		return c.Next()
+	}
+
+	return k, v
+}
+
+// addToPage adds user to the page, or sets the cursor for the next page if
+// it is already full. It reports whether there is room for more.
+func addToPage(p *persistence.Page, q persistence.Query, user *persistence.User) bool {
+	if q.Limit > 0 && len(p.Users) == q.Limit {
+		p.Next = q.CursorAfter(p.Users[len(p.Users)-1])
+		return false
+	}
+
+	p.Users = append(p.Users, user)
+	return true
+}
+
+// buildIndex adds every user to the index for criteria.
+func buildIndex(tx *bolt.Tx, criteria string) error {
+	index := tx.Bucket(indexBucket(criteria))
+	field := indexes[criteria]
+	return tx.Bucket(usersBucket).ForEach(func(key, data []byte) error {
+		r, err := decodeRecord(data)
+		if err != nil {
+			return err
+		}
+
+		return index.Put(append(indexPrefix(field(r)), key...), []byte{})
+	})
+}
+
+// buildUnique adds every user to the unique bucket for field, failing if
+// two of them share a value.
+func buildUnique(tx *bolt.Tx, field string) error {
+	b := tx.Bucket(uniqueBucket(field))
+	value := uniques[field]
+	return tx.Bucket(usersBucket).ForEach(func(key, data []byte) error {
+		r, err := decodeRecord(data)
+		if err != nil {
+			return err
+		}
+
+		k := []byte(persistence.UniqueKey(value(r)))
+		if len(k) == 0 {
+			return nil
+		}
+
+		if owner := b.Get(k); owner != nil {
+			return fmt.Errorf("users %d and %d have the same %s, resolve it before upgrading",
+				binary.BigEndian.Uint64(owner), binary.BigEndian.Uint64(key), field)
+		}
+
+		return b.Put(k, key)
+	})
+}
+
+// unindex removes r from every index.
+func unindex(tx *bolt.Tx, key []byte, r *record) error {
+	for criteria, field := range indexes {
+		k := append(indexPrefix(field(r)), key...)
+		if err := tx.Bucket(indexBucket(criteria)).Delete(k); err != nil {
+			return err
+		}
+	}
+
+	for field, value := range uniques {
+		b := tx.Bucket(uniqueBucket(field))
+		k := []byte(persistence.UniqueKey(value(r)))
+		if owner := b.Get(k); len(k) > 0 && bytes.Equal(owner, key) {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func decodeRecord(data []byte) (*record, error) {
+	r := record{}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+func toRecord(u persistence.User) *record {
+	r := &record{
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+		Nickname:  u.Nickname,
+		Password:  u.Password,
+		Email:     u.Email,
+		Country:   u.Country,
+		Role:      u.Role,
+
+		EmailVerified: u.EmailVerified,
+		VerifiedAt:    u.VerifiedAt,
+	}
+
+	if u.TOTP != nil {
+		r.TOTP = &totp{u.TOTP.Secret, u.TOTP.Enabled, u.TOTP.LastStep}
+	}
+
+	if u.Lockout != nil {
+		r.Lockout = &lockout{u.Lockout.Failures, u.Lockout.LastFailure, u.Lockout.LockedUntil}
+	}
+
+	return r
+}
+
+func (r *record) toUser(key []byte) *persistence.User {
+	u := &persistence.User{
+		ID:        strconv.FormatUint(binary.BigEndian.Uint64(key), 10),
+		FirstName: r.FirstName,
+		LastName:  r.LastName,
+		Nickname:  r.Nickname,
+		Password:  r.Password,
+		Email:     r.Email,
+		Country:   r.Country,
+		Role:      r.Role,
+
+		EmailVerified: r.EmailVerified,
+		VerifiedAt:    r.VerifiedAt,
+	}
+
+	if r.TOTP != nil {
+		u.TOTP = &persistence.TOTP{Secret: r.TOTP.Secret, Enabled: r.TOTP.Enabled, LastStep: r.TOTP.LastStep}
+	}
+
+	if r.Lockout != nil {
+		u.Lockout = &persistence.Lockout{Failures: r.Lockout.Failures, LastFailure: r.Lockout.LastFailure, LockedUntil: r.Lockout.LockedUntil}
+	}
+
+	return u
+}
+
+func idKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+func uniqueBucket(field string) []byte {
+	return []byte("unique_" + field)
+}
+
+func indexBucket(criteria string) []byte {
+	return []byte("index_" + criteria)
+}
+
+func indexPrefix(value string) []byte {
+	return append([]byte(value), 0)
+}
@@ -0,0 +1,373 @@
+package boltlayer
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+
+	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+	events "github.com/omgitsotis/user-service/events"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Tokens are kept in their own buckets:
+//
+//	tokens        id -> JSON encoded persistence.Token
+//	token_hash    hash -> id
+//	token_family  family 0x00 id -> nothing
+var (
+	tokensBucket      = []byte("tokens")
+	tokenHashBucket   = []byte("token_hash")
+	tokenFamilyBucket = []byte("token_family")
+)
+
+// tokenRecord is how a token is stored. persistence.Token leaves the hash
+// out of its JSON, so it can't be stored as it is.
+type tokenRecord struct {
+	persistence.Token
+	Hash string `json:"hash"`
+}
+
+func (db *BoltDatabase) AddToken(token persistence.Token) (*persistence.Token, error) {
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		seq, err := tx.Bucket(tokensBucket).NextSequence()
+		if err != nil {
+			return err
+		}
+
+		token.ID = strconv.FormatUint(seq, 10)
+		return putToken(tx, idKey(seq), &token)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[BoltDB] added new %s token %s\n", token.Kind, token.ID)
+	return &token, nil
+}
+
+func (db *BoltDatabase) FindTokenByID(id string) (*persistence.Token, error) {
+	var token *persistence.Token
+	err := db.db.View(func(tx *bolt.Tx) error {
+		var err error
+		_, token, err = getToken(tx, id)
+		return err
+	})
+
+	return token, err
+}
+
+func (db *BoltDatabase) FindTokenByHash(hash string) (*persistence.Token, error) {
+	var token *persistence.Token
+	err := db.db.View(func(tx *bolt.Tx) error {
+		key := tx.Bucket(tokenHashBucket).Get([]byte(hash))
+		if key == nil {
+			return persistence.ErrTokenNotFound
+		}
+
+		var err error
+		token, err = decodeToken(tx.Bucket(tokensBucket).Get(key))
+		return err
+	})
+
+	return token, err
+}
+
+// FindTokensByKind scans every token. There are only ever a handful of each
+// kind that get listed, so they aren't worth an index.
+func (db *BoltDatabase) FindTokensByKind(kind string) ([]*persistence.Token, error) {
+	results := make([]*persistence.Token, 0)
+	err := db.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(tokensBucket).ForEach(func(k, v []byte) error {
+			token, err := decodeToken(v)
+			if err != nil {
+				return err
+			}
+
+			if token.Kind == kind {
+				results = append(results, token)
+			}
+
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// UpdateToken replaces the hash, name, scopes, expiry and revocation time of
+// a token. The kind, owner, family and creation time of a token never
+// change.
+func (db *BoltDatabase) UpdateToken(token persistence.Token) (*persistence.Token, error) {
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		key, stored, err := getToken(tx, token.ID)
+		if err != nil {
+			return err
+		}
+
+		if err = tx.Bucket(tokenHashBucket).Delete([]byte(stored.Hash)); err != nil {
+			return err
+		}
+
+		token.Kind = stored.Kind
+		token.UserID = stored.UserID
+		token.Family = stored.Family
+		token.CreatedAt = stored.CreatedAt
+		return putToken(tx, key, &token)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[BoltDB] updated token %s\n", token.ID)
+	return &token, nil
+}
+
+func (db *BoltDatabase) RevokeToken(id string, at time.Time) (bool, error) {
+	revoked := false
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		key, token, err := getToken(tx, id)
+		if err != nil || token.Revoked() {
+			return err
+		}
+
+		token.RevokedAt = &at
+		revoked = true
+		return putToken(tx, key, token)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if revoked {
+		log.Printf("[BoltDB] revoked token %s\n", id)
+	}
+
+	return revoked, nil
+}
+
+func (db *BoltDatabase) RevokeTokenFamily(family string, at time.Time) error {
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		// The keys are collected first as putToken writes to the family
+		// index, which can't be changed while a cursor is on it.
+		prefix := indexPrefix(family)
+		keys := make([][]byte, 0)
+		c := tx.Bucket(tokenFamilyBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			keys = append(keys, append([]byte(nil), k[len(prefix):]...))
+		}
+
+		tokens := tx.Bucket(tokensBucket)
+		for _, key := range keys {
+			token, err := decodeToken(tokens.Get(key))
+			if err != nil {
+				return err
+			}
+
+			if token.Revoked() {
+				continue
+			}
+
+			token.RevokedAt = &at
+			if err = putToken(tx, key, token); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[BoltDB] revoked token family %s\n", family)
+	return nil
+}
+
+// ResetPassword revokes the token, sets the password and revokes the user's
+// refresh tokens in one transaction.
+// The password isn't indexed, so the record stays in the same indexes.
+func (db *BoltDatabase) ResetPassword(tokenID, password string, at time.Time) (*persistence.User, error) {
+	var user *persistence.User
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		tokenKey, token, err := getToken(tx, tokenID)
+		if err != nil {
+			return err
+		}
+
+		if token.Revoked() {
+			return persistence.ErrTokenUsed
+		}
+
+		key, r, err := getRecord(tx, token.UserID)
+		if err != nil {
+			return err
+		}
+
+		before := r.toUser(key)
+		r.Password = password
+		user = r.toUser(key)
+		if err = putRecord(tx, key, r); err != nil {
+			return err
+		}
+
+		token.RevokedAt = &at
+		if err = putToken(tx, tokenKey, token); err != nil {
+			return err
+		}
+
+		if err = revokeUserTokens(tx, user.ID, persistence.TokenRefresh, at); err != nil {
+			return err
+		}
+
+		return addEvent(tx, events.NewUserEvent(events.UserUpdated, before, user))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[BoltDB] reset password of user %s with token %s\n", user.ID, tokenID)
+	return user, nil
+}
+
+// VerifyEmail compares the email and writes the user in one transaction.
+// The verification isn't indexed, so the record stays in the same indexes.
+func (db *BoltDatabase) VerifyEmail(tokenID string, at time.Time) (*persistence.User, error) {
+	var user *persistence.User
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		tokenKey, token, err := getToken(tx, tokenID)
+		if err != nil {
+			return err
+		}
+
+		if token.Revoked() {
+			return persistence.ErrTokenUsed
+		}
+
+		key, r, err := getRecord(tx, token.UserID)
+		if err != nil {
+			return err
+		}
+
+		if r.Email != token.Name {
+			return persistence.ErrTokenStale
+		}
+
+		before := r.toUser(key)
+		r.EmailVerified, r.VerifiedAt = true, &at
+		user = r.toUser(key)
+		if err = putRecord(tx, key, r); err != nil {
+			return err
+		}
+
+		token.RevokedAt = &at
+		if err = putToken(tx, tokenKey, token); err != nil {
+			return err
+		}
+
+		return addEvent(tx, events.NewUserEvent(events.UserUpdated, before, user))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[BoltDB] verified email of user %s with token %s\n", user.ID, tokenID)
+	return user, nil
+}
+
+// revokeUserTokens revokes every token of a kind issued to a user. There is
+// no index of tokens by user, so they are all read.
+func revokeUserTokens(tx *bolt.Tx, userID, kind string, at time.Time) error {
+	// The tokens are collected first as they can't be written while a
+	// cursor is on their bucket.
+	keys := make([][]byte, 0)
+	revoke := make([]*persistence.Token, 0)
+	err := tx.Bucket(tokensBucket).ForEach(func(k, v []byte) error {
+		token, err := decodeToken(v)
+		if err != nil {
+			return err
+		}
+
+		if token.Kind == kind && token.UserID == userID && !token.Revoked() {
+			keys = append(keys, append([]byte(nil), k...))
+			revoke = append(revoke, token)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, token := range revoke {
+		token.RevokedAt = &at
+		if err = putToken(tx, keys[i], token); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func getToken(tx *bolt.Tx, id string) ([]byte, *persistence.Token, error) {
+	seq, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, nil, persistence.ErrTokenNotFound
+	}
+
+	key := idKey(seq)
+	data := tx.Bucket(tokensBucket).Get(key)
+	if data == nil {
+		return nil, nil, persistence.ErrTokenNotFound
+	}
+
+	token, err := decodeToken(data)
+	return key, token, err
+}
+
+func putToken(tx *bolt.Tx, key []byte, token *persistence.Token) error {
+	data, err := json.Marshal(tokenRecord{*token, token.Hash})
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Bucket(tokensBucket).Put(key, data); err != nil {
+		return err
+	}
+
+	if err = tx.Bucket(tokenHashBucket).Put([]byte(token.Hash), key); err != nil {
+		return err
+	}
+
+	if token.Family == "" {
+		return nil
+	}
+
+	return tx.Bucket(tokenFamilyBucket).Put(append(indexPrefix(token.Family), key...), []byte{})
+}
+
+func decodeToken(data []byte) (*persistence.Token, error) {
+	r := tokenRecord{}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+
+	// Tokens stored before the times were pointers have zero times rather
+	// than none.
+	token := r.Token
+	token.Hash = r.Hash
+	if token.ExpiresAt != nil && token.ExpiresAt.IsZero() {
+		token.ExpiresAt = nil
+	}
+
+	if token.RevokedAt != nil && token.RevokedAt.IsZero() {
+		token.RevokedAt = nil
+	}
+
+	return &token, nil
+}
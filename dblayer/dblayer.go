@@ -2,8 +2,12 @@ package dblayer
 
 import (
 	"errors"
+	"time"
+	bolt "github.com/omgitsotis/user-service/dblayer/boltlayer"
 	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
 	mockDB "github.com/omgitsotis/user-service/dblayer/mockdblayer"
+	postgres "github.com/omgitsotis/user-service/dblayer/postgreslayer"
+	sqlite "github.com/omgitsotis/user-service/dblayer/sqlitelayer"
 )
 
 type DBType string
@@ -13,17 +17,87 @@ type DatabaseHandler interface {
 	FindUserByID(string) 			   (*persistence.User, error)
 	DeleteUser(string) 				   (error)
 	FindUserByCriteria(string, string) ([]*persistence.User, error)
+	// FindUsers finds a page of the users matching every criterion of a
+	// query, see persistence.Query. FindUserByCriteria is a query with one
+	// criterion, returning every match.
+	FindUsers(persistence.Query) 	   (*persistence.Page, error)
 	UpdateUser(persistence.User) 	   (*persistence.User, error)
+	// UpdateLockout replaces a user's lockout with the one update returns
+	// for it, as a single atomic change so concurrent failed logins are all
+	// counted. A lockout with no failures clears it.
+	UpdateLockout(string, func(persistence.Lockout) persistence.Lockout) (*persistence.Lockout, error)
+	// UseTOTPStep records the time step of a code from a user's
+	// authenticator as used, but only if it is after the last one, and
+	// reports whether it was. It is a single atomic change, so the same
+	// code can't be used twice by racing requests, and it isn't an event.
+	UseTOTPStep(string, int64) 		   (bool, error)
+
+	// Tokens are looked up by the hash of their secret, and are never
+	// deleted so revoked tokens can still be audited.
+	AddToken(persistence.Token) 		   (*persistence.Token, error)
+	FindTokenByID(string) 			   (*persistence.Token, error)
+	FindTokenByHash(string) 		   (*persistence.Token, error)
+	FindTokensByKind(string) 		   ([]*persistence.Token, error)
+	UpdateToken(persistence.Token) 	   (*persistence.Token, error)
+	// RevokeToken revokes a token at the given time unless it is already
+	// revoked, and reports whether it did. Only one of many concurrent
+	// calls for the same token revokes it.
+	RevokeToken(string, time.Time) 	   (bool, error)
+	// RevokeTokenFamily revokes every token in a family that isn't
+	// already revoked.
+	RevokeTokenFamily(string, time.Time) (error)
+	// ResetPassword revokes a password reset token and sets the password of
+	// the user it was issued to, as a single atomic change with the usual
+	// user.updated event. Every refresh token of the user is revoked with
+	// it, ending the sessions started with the old password. If the token
+	// was already revoked nothing changes and persistence.ErrTokenUsed is
+	// returned.
+	ResetPassword(string, string, time.Time) (*persistence.User, error)
+	// VerifyEmail revokes an email verification token and marks the email
+	// of the user it was issued to as verified at the given time, as a
+	// single atomic change with the usual user.updated event. The token is
+	// only valid while the user's email is still the one it was sent to,
+	// its Name, otherwise nothing changes and persistence.ErrTokenStale is
+	// returned. If it was already revoked persistence.ErrTokenUsed is.
+	VerifyEmail(string, time.Time) 	   (*persistence.User, error)
 }
 
 const (
-	MOCKDB DBType = "mockdb"
+	MOCKDB   DBType = "mockdb"
+	SQLITE   DBType = "sqlite"
+	POSTGRES DBType = "postgres"
+	BOLT     DBType = "bolt"
 )
 
+// NewPersistenceLayer creates the database layer for the given type. The
+// meaning of connection depends on the type: it is ignored by the mock
+// database, is the path to the database file for SQLite and bolt and the
+// connection string for Postgres.
 func NewPersistenceLayer(options DBType, connection string) (DatabaseHandler, error) {
 	switch options {
 	case MOCKDB:
 		return mockDB.NewMockDatabase(), nil
+	case SQLITE:
+		db, err := sqlite.NewSQLiteDatabase(connection)
+		if err != nil {
+			return nil, err
+		}
+
+		return db, nil
+	case POSTGRES:
+		db, err := postgres.NewPostgresDatabase(connection)
+		if err != nil {
+			return nil, err
+		}
+
+		return db, nil
+	case BOLT:
+		db, err := bolt.NewBoltDatabase(connection)
+		if err != nil {
+			return nil, err
+		}
+
+		return db, nil
 	}
 
 	return nil, errors.New("unsuported database type")
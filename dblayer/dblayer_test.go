@@ -0,0 +1,1393 @@
+package dblayer
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	boltlayer "github.com/omgitsotis/user-service/dblayer/boltlayer"
+	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+	events "github.com/omgitsotis/user-service/events"
+	filter "github.com/omgitsotis/user-service/filter"
+	bbolt "go.etcd.io/bbolt"
+)
+
+// postgresEnv is the environment variable holding the connection string of a
+// scratch Postgres database to run the behaviour tests against. Everything in
+// its public schema is dropped by the tests. When it isn't set the Postgres
+// tests are skipped.
+const postgresEnv = "USER_SERVICE_TEST_POSTGRES"
+
+// backends returns a constructor for every database layer that should pass
+// the behaviour tests below. Each call must return a fresh, empty database.
+func backends(t *testing.T) map[DBType]func() DatabaseHandler {
+	b := map[DBType]func() DatabaseHandler{
+		MOCKDB: func() DatabaseHandler {
+			return newHandler(t, MOCKDB, "")
+		},
+		SQLITE: func() DatabaseHandler {
+			return newHandler(t, SQLITE, filepath.Join(tempDir(t), "users.db"))
+		},
+		BOLT: func() DatabaseHandler {
+			return newHandler(t, BOLT, filepath.Join(tempDir(t), "users.bolt"))
+		},
+	}
+
+	if dsn := os.Getenv(postgresEnv); dsn != "" {
+		b[POSTGRES] = func() DatabaseHandler {
+			resetPostgres(t, dsn)
+			return newHandler(t, POSTGRES, dsn)
+		}
+	} else {
+		t.Logf("%s not set, skipping postgres", postgresEnv)
+	}
+
+	return b
+}
+
+// resetPostgres drops every table so the migrations start from scratch.
+func resetPostgres(t *testing.T, dsn string) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err = db.Exec(`DROP SCHEMA public CASCADE; CREATE SCHEMA public`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newHandler(t *testing.T, dbType DBType, connection string) DatabaseHandler {
+	dbh, err := NewPersistenceLayer(dbType, connection)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dbh
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "user-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func testUsers() []persistence.User {
+	return []persistence.User{
+		{
+			FirstName: "Klay",
+			LastName:  "Thompson",
+			Nickname:  "Splash Brother",
+			Password:  "password",
+			Email:     "klay_thompson@mail.com",
+			Country:   "usa",
+		},
+		{
+			FirstName: "Serge",
+			LastName:  "Ibaka",
+			Nickname:  "Iblocka",
+			Password:  "dorwssap",
+			Email:     "serge_ibaka@mail.com",
+			Country:   "cameroon",
+			Role:      persistence.RoleAdmin,
+		},
+		{
+			FirstName: "Steph",
+			LastName:  "Curry",
+			Nickname:  "Chef Curry",
+			Password:  "pdarsosw",
+			Email:     "steph_curry@mail.com",
+			Country:   "usa",
+		},
+	}
+}
+
+func addUsers(t *testing.T, dbh DatabaseHandler) []*persistence.User {
+	added := make([]*persistence.User, 0)
+	for _, u := range testUsers() {
+		user, err := dbh.AddUser(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		added = append(added, user)
+	}
+
+	return added
+}
+
+func TestAddAndFindUser(t *testing.T) {
+	for name, newDB := range backends(t) {
+		t.Run(string(name), func(t *testing.T) {
+			dbh := newDB()
+			added := addUsers(t, dbh)
+
+			if added[0].ID == added[1].ID {
+				t.Errorf("users were given the same ID %v", added[0].ID)
+			}
+
+			user, err := dbh.FindUserByID(added[1].ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if *user != *added[1] {
+				t.Errorf("found wrong user: got %v want %v", user, added[1])
+			}
+
+			if _, err = dbh.FindUserByID("1000"); err == nil {
+				t.Error("expected an error finding a user that does not exist")
+			}
+
+			if _, err = dbh.FindUserByID("not-an-id"); err == nil {
+				t.Error("expected an error finding a user with a malformed ID")
+			}
+		})
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	for name, newDB := range backends(t) {
+		t.Run(string(name), func(t *testing.T) {
+			dbh := newDB()
+			added := addUsers(t, dbh)
+
+			if err := dbh.DeleteUser(added[0].ID); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := dbh.FindUserByID(added[0].ID); err == nil {
+				t.Error("found user after it was deleted")
+			}
+
+			if err := dbh.DeleteUser(added[0].ID); err == nil {
+				t.Error("expected an error deleting a user twice")
+			}
+
+			users, err := dbh.FindUserByCriteria("email", added[0].Email)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(users) != 0 {
+				t.Errorf("search found %v deleted user(s)", len(users))
+			}
+		})
+	}
+}
+
+func TestFindUserByCriteria(t *testing.T) {
+	for name, newDB := range backends(t) {
+		t.Run(string(name), func(t *testing.T) {
+			dbh := newDB()
+			addUsers(t, dbh)
+
+			tests := []struct {
+				criteria string
+				value    string
+				want     int
+			}{
+				{"country", "usa", 2},
+				{"country", "uk", 0},
+				{"first_name", "Serge", 1},
+				{"last_name", "Curry", 1},
+				{"nickname", "Iblocka", 1},
+				{"email", "klay_thompson@mail.com", 1},
+			}
+
+			for _, tt := range tests {
+				users, err := dbh.FindUserByCriteria(tt.criteria, tt.value)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if len(users) != tt.want {
+					t.Errorf("wrong number of users for %s %s: got %v want %v",
+						tt.criteria, tt.value, len(users), tt.want)
+				}
+			}
+
+			if _, err := dbh.FindUserByCriteria("password", "password"); err == nil {
+				t.Error("expected an error searching on an invalid criteria")
+			}
+		})
+	}
+}
+
+// where returns the criteria for pairs of fields and values.
+func where(pairs ...string) []persistence.Criterion {
+	var criteria []persistence.Criterion
+	for i := 0; i < len(pairs); i += 2 {
+		criteria = append(criteria, persistence.Criterion{Field: pairs[i], Value: pairs[i+1]})
+	}
+
+	return criteria
+}
+
+func TestFindUsers(t *testing.T) {
+	for name, newDB := range backends(t) {
+		t.Run(string(name), func(t *testing.T) {
+			dbh := newDB()
+			added := addUsers(t, dbh)
+
+			tests := []struct {
+				name     string
+				criteria []persistence.Criterion
+				want     []string
+			}{
+				{"no criteria", nil, []string{added[0].ID, added[1].ID, added[2].ID}},
+				{"one criterion", where("country", "usa"), []string{added[0].ID, added[2].ID}},
+				{"both match", where("country", "usa", "last_name", "Curry"), []string{added[2].ID}},
+				{"one matches", where("country", "cameroon", "last_name", "Curry"), nil},
+				{"unique field", where("country", "usa", "email", "KLAY_THOMPSON@mail.com"), []string{added[0].ID}},
+				{"unique field mismatch", where("nickname", "iblocka", "country", "usa"), nil},
+				{"email verified", where("email_verified", "false", "first_name", "Serge"), []string{added[1].ID}},
+			}
+
+			for _, tt := range tests {
+				page, err := dbh.FindUsers(persistence.Query{Criteria: tt.criteria})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var got []string
+				for _, u := range page.Users {
+					got = append(got, u.ID)
+				}
+
+				if !reflect.DeepEqual(got, tt.want) || page.Total != len(tt.want) || page.Next != nil {
+					t.Errorf("%s: wrong users: got %v (%v, %v) want %v", tt.name, got, page.Total, page.Next, tt.want)
+				}
+			}
+
+			invalid := where("country", "usa", "password", "password")
+			if _, err := dbh.FindUsers(persistence.Query{Criteria: invalid}); err == nil {
+				t.Error("expected an error searching on an invalid criteria")
+			}
+		})
+	}
+}
+
+func TestFindUsersFilter(t *testing.T) {
+	for name, newDB := range backends(t) {
+		t.Run(string(name), func(t *testing.T) {
+			dbh := newDB()
+			added := addUsers(t, dbh)
+
+			// Kevon has no nickname, and Steph is the only verified user.
+			kevon, err := dbh.AddUser(persistence.User{FirstName: "Kevon", LastName: "Looney", Email: "kevon@mail.org", Country: "usa"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			verifiedAt := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+			if _, err = dbh.UpdateUser(persistence.User{ID: added[2].ID, VerifiedAt: &verifiedAt}); err != nil {
+				t.Fatal(err)
+			}
+
+			tests := []struct {
+				filter string
+				want   []string
+			}{
+				{`country eq "usa" and email ew "@mail.com"`, []string{added[0].ID, added[2].ID}},
+				{`country ne "usa"`, []string{added[1].ID}},
+				{`first_name co "la"`, []string{added[0].ID}},
+				{`first_name co "LA"`, nil},
+				{`last_name sw "Th" or last_name sw "Cu"`, []string{added[0].ID, added[2].ID}},
+				{`email ew "CURRY@MAIL.COM"`, []string{added[2].ID}},
+				{`nickname sw "chef"`, []string{added[2].ID}},
+				{`nickname pr`, []string{added[0].ID, added[1].ID, added[2].ID}},
+				{`not (nickname pr)`, []string{kevon.ID}},
+				{`verified_at pr and email_verified eq true`, []string{added[2].ID}},
+				{`verified_at gt "2020-01-01T00:00:00Z"`, []string{added[2].ID}},
+				{`verified_at lt "2020-06-01T14:00:00+02:00"`, nil},
+				{`verified_at eq "2020-06-01T14:00:00+02:00"`, []string{added[2].ID}},
+				{`not (verified_at gt "2020-01-01T00:00:00Z")`, []string{added[0].ID, added[1].ID, kevon.ID}},
+				{`(country eq "usa" or country eq "cameroon") and not (first_name sw "K")`, []string{added[1].ID, added[2].ID}},
+			}
+
+			for _, tt := range tests {
+				node, err := filter.Parse(tt.filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				cond, err := filter.Compile(node)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				page, err := dbh.FindUsers(persistence.Query{Filter: &cond})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var got []string
+				for _, u := range page.Users {
+					got = append(got, u.ID)
+				}
+
+				if !reflect.DeepEqual(got, tt.want) || page.Total != len(tt.want) {
+					t.Errorf("%s: wrong users: got %v (%v) want %v", tt.filter, got, page.Total, tt.want)
+				}
+			}
+
+			// Criteria are and'ed with the filter.
+			cond := persistence.Condition{Op: persistence.OpEndsWith, Field: "email", Value: ".org"}
+			page, err := dbh.FindUsers(persistence.Query{Criteria: where("country", "usa"), Filter: &cond})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(page.Users) != 1 || page.Users[0].ID != kevon.ID {
+				t.Errorf("wrong users for criteria and a filter: got %v", page.Users)
+			}
+		})
+	}
+}
+
+func TestFindUsersPages(t *testing.T) {
+	for name, newDB := range backends(t) {
+		t.Run(string(name), func(t *testing.T) {
+			dbh := newDB()
+			added := addUsers(t, dbh)
+			more, err := dbh.AddUser(persistence.User{FirstName: "Andre", LastName: "Iguodala", Email: "andre@mail.com", Country: "usa"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			klay, serge, steph, andre := added[0].ID, added[1].ID, added[2].ID, more.ID
+			tests := []struct {
+				name       string
+				criteria   []persistence.Criterion
+				sort       string
+				descending bool
+				want       []string
+			}{
+				{"by id", nil, "", false, []string{klay, serge, steph, andre}},
+				{"by id descending", nil, "id", true, []string{andre, steph, serge, klay}},
+				{"by first name", nil, "first_name", false, []string{andre, klay, serge, steph}},
+				{"by country descending", nil, "country", true, []string{andre, steph, klay, serge}},
+				{"by nickname", nil, "nickname", false, []string{andre, steph, serge, klay}},
+				{"by role", nil, "role", false, []string{klay, steph, andre, serge}},
+				{"search by last name", where("country", "usa"), "last_name", false, []string{steph, andre, klay}},
+				{"search descending", where("country", "usa"), "id", true, []string{andre, steph, klay}},
+			}
+
+			for _, tt := range tests {
+				q := persistence.Query{Criteria: tt.criteria, Sort: tt.sort, Descending: tt.descending, Limit: 2}
+				var got []string
+				for pages := 0; pages < 5; pages++ {
+					page, err := dbh.FindUsers(q)
+					if err != nil {
+						t.Fatalf("%s: %v", tt.name, err)
+					}
+
+					if page.Total != len(tt.want) {
+						t.Errorf("%s: wrong total: got %v want %v", tt.name, page.Total, len(tt.want))
+					}
+
+					for _, u := range page.Users {
+						got = append(got, u.ID)
+					}
+
+					if page.Next == nil {
+						break
+					}
+
+					// Cursors are handed to clients and come back encoded.
+					if q.After, err = persistence.DecodeCursor(page.Next.Encode()); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("%s: wrong users: got %v want %v", tt.name, got, tt.want)
+				}
+			}
+
+			// A cursor still works once its user is deleted.
+			q := persistence.Query{Sort: "first_name", Limit: 2}
+			page, err := dbh.FindUsers(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err = dbh.DeleteUser(klay); err != nil {
+				t.Fatal(err)
+			}
+
+			q.After = page.Next
+			if page, err = dbh.FindUsers(q); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(page.Users) != 2 || page.Users[0].ID != serge || page.Users[1].ID != steph || page.Total != 3 {
+				t.Errorf("wrong page after a deleted user: %v %v", page.Users, page.Total)
+			}
+
+			q.Sort = "last_name"
+			if _, err = dbh.FindUsers(q); err != persistence.ErrInvalidCursor {
+				t.Errorf("cursor for another sort was accepted: %v", err)
+			}
+
+			if _, err = dbh.FindUsers(persistence.Query{Sort: "password"}); err == nil {
+				t.Error("expected an error sorting by an invalid field")
+			}
+		})
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	for name, newDB := range backends(t) {
+		t.Run(string(name), func(t *testing.T) {
+			dbh := newDB()
+			added := addUsers(t, dbh)
+			want := *added[0]
+			want.Email = "otis_simon@mail.com"
+			want.Country = "UK"
+
+			update := persistence.User{
+				ID:      added[0].ID,
+				Email:   "otis_simon@mail.com",
+				Country: "UK",
+			}
+
+			user, err := dbh.UpdateUser(update)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if *user != want {
+				t.Errorf("wrong updated user: got %v want %v", user, want)
+			}
+
+			found, err := dbh.FindUserByID(added[0].ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if *found != want {
+				t.Errorf("update was not stored: got %v want %v", found, want)
+			}
+
+			// Searches must see the new values and not the old ones.
+			for country, count := range map[string]int{"UK": 1, "usa": 1} {
+				users, err := dbh.FindUserByCriteria("country", country)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if len(users) != count {
+					t.Errorf("wrong number of users in %s after update: got %v want %v",
+						country, len(users), count)
+				}
+			}
+
+			// Concurrent updates of different fields must all be kept.
+			changes := []persistence.User{
+				{ID: added[1].ID, FirstName: "Ada"},
+				{ID: added[1].ID, LastName: "Lovelace"},
+				{ID: added[1].ID, Country: "GB"},
+				{ID: added[1].ID, Nickname: "ada"},
+			}
+
+			errs := make(chan error, len(changes))
+			for _, change := range changes {
+				go func(change persistence.User) {
+					_, err := dbh.UpdateUser(change)
+					errs <- err
+				}(change)
+			}
+
+			for range changes {
+				if err := <-errs; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			found, err = dbh.FindUserByID(added[1].ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if found.FirstName != "Ada" || found.LastName != "Lovelace" || found.Country != "GB" || found.Nickname != "ada" {
+				t.Errorf("concurrent updates were lost: %v", found)
+			}
+
+			if _, err = dbh.UpdateUser(persistence.User{ID: "1000", Email: "a"}); err == nil {
+				t.Error("expected an error updating a user that does not exist")
+			}
+		})
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	for name, newDB := range backends(t) {
+		t.Run(string(name), func(t *testing.T) {
+			dbh := newDB()
+			added := addUsers(t, dbh)
+
+			if added[0].EmailVerified || added[0].VerifiedAt != nil {
+				t.Fatalf("new user is verified: %v", added[0])
+			}
+
+			verifiedAt := time.Now().UTC().Truncate(time.Second)
+			user, err := dbh.UpdateUser(persistence.User{ID: added[2].ID, VerifiedAt: &verifiedAt})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !user.EmailVerified {
+				t.Errorf("user was not verified: %v", user)
+			}
+
+			found, err := dbh.FindUserByID(added[2].ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !found.EmailVerified || found.VerifiedAt == nil || !found.VerifiedAt.Equal(verifiedAt) {
+				t.Errorf("verification was not stored: %v %v", found, found.VerifiedAt)
+			}
+
+			for value, count := range map[string]int{"true": 1, "false": 2} {
+				users, err := dbh.FindUserByCriteria("email_verified", value)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if len(users) != count {
+					t.Errorf("wrong number of users with email_verified %s: got %v want %v",
+						value, len(users), count)
+				}
+			}
+
+			if _, err = dbh.FindUserByCriteria("email_verified", "maybe"); err == nil {
+				t.Error("expected an error for an email_verified value that isn't a bool")
+			}
+
+			// Changing anything but the email keeps the user verified, and
+			// role changes are stored like any other field.
+			user, err = dbh.UpdateUser(persistence.User{ID: added[2].ID, Email: added[2].Email, Role: persistence.RoleService})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !user.EmailVerified {
+				t.Error("user was unverified without their email changing")
+			}
+
+			if _, err = dbh.UpdateUser(persistence.User{ID: added[2].ID, Email: "chef@mail.com"}); err != nil {
+				t.Fatal(err)
+			}
+
+			found, err = dbh.FindUserByID(added[2].ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if found.EmailVerified || found.VerifiedAt != nil {
+				t.Errorf("changing the email kept the user verified: %v", found)
+			}
+
+			if found.Role != persistence.RoleService {
+				t.Errorf("role was not stored: got %v want %v", found.Role, persistence.RoleService)
+			}
+		})
+	}
+}
+
+func TestUserTOTP(t *testing.T) {
+	for name, newDB := range backends(t) {
+		t.Run(string(name), func(t *testing.T) {
+			dbh := newDB()
+			added := addUsers(t, dbh)
+
+			outbox := dbh.(events.Outbox)
+			before, _, err := outbox.OutboxBacklog()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Starting enrollment changes nothing other services see, so
+			// it isn't an event. Enabling it is.
+			enroll := persistence.TOTP{Secret: "sealed"}
+			if _, err = dbh.UpdateUser(persistence.User{ID: added[0].ID, TOTP: &enroll}); err != nil {
+				t.Fatal(err)
+			}
+
+			if after, _, err := outbox.OutboxBacklog(); err != nil || after != before {
+				t.Errorf("enrolling wrote an event: got %v want %v (%v)", after, before, err)
+			}
+
+			totp := persistence.TOTP{Secret: "sealed", Enabled: true, LastStep: 55555555}
+			if _, err = dbh.UpdateUser(persistence.User{ID: added[0].ID, TOTP: &totp}); err != nil {
+				t.Fatal(err)
+			}
+
+			pending, err := outbox.PendingEvents(100)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(pending) != before+1 || !reflect.DeepEqual(pending[before].Event.Changed, []string{"mfa_enabled"}) {
+				t.Errorf("wrong events after enabling mfa: %+v", pending)
+			}
+
+			found, err := dbh.FindUserByID(added[0].ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if found.TOTP == nil || *found.TOTP != totp || !found.MFAEnabled() {
+				t.Errorf("authenticator was not stored: %v", found.TOTP)
+			}
+
+			// Other updates leave it alone.
+			if _, err = dbh.UpdateUser(persistence.User{ID: added[0].ID, Country: "GB"}); err != nil {
+				t.Fatal(err)
+			}
+
+			if found, err = dbh.FindUserByID(added[0].ID); err != nil || found.TOTP == nil {
+				t.Errorf("authenticator was lost by an update: %v %v", found, err)
+			}
+
+			// An authenticator without a secret removes it.
+			if _, err = dbh.UpdateUser(persistence.User{ID: added[0].ID, TOTP: &persistence.TOTP{}}); err != nil {
+				t.Fatal(err)
+			}
+
+			if found, err = dbh.FindUserByID(added[0].ID); err != nil || found.TOTP != nil || found.MFAEnabled() {
+				t.Errorf("authenticator was not removed: %v %v", found, err)
+			}
+		})
+	}
+}
+
+func TestUpdateLockout(t *testing.T) {
+	for name, newDB := range backends(t) {
+		t.Run(string(name), func(t *testing.T) {
+			dbh := newDB()
+			added := addUsers(t, dbh)
+
+			at := time.Date(2020, 4, 1, 12, 0, 0, 0, time.UTC)
+			fail := func(l persistence.Lockout) persistence.Lockout {
+				l.Failures++
+				l.LastFailure = at
+				if l.Failures >= 3 {
+					until := at.Add(time.Minute)
+					l.LockedUntil = &until
+				}
+
+				return l
+			}
+
+			// Concurrent failures must all be counted.
+			errs := make(chan error, 3)
+			for i := 0; i < 3; i++ {
+				go func() {
+					_, err := dbh.UpdateLockout(added[0].ID, fail)
+					errs <- err
+				}()
+			}
+
+			for i := 0; i < 3; i++ {
+				if err := <-errs; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Other updates leave it alone.
+			if _, err := dbh.UpdateUser(persistence.User{ID: added[0].ID, Country: "GB"}); err != nil {
+				t.Fatal(err)
+			}
+
+			found, err := dbh.FindUserByID(added[0].ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			lockout := found.Lockout
+			if lockout == nil || lockout.Failures != 3 || !lockout.LastFailure.Equal(at) || !lockout.Locked(at) || lockout.Locked(at.Add(time.Minute)) {
+				t.Errorf("lockout was not stored: %+v", lockout)
+			}
+
+			if other, err := dbh.FindUserByID(added[1].ID); err != nil || other.Lockout != nil {
+				t.Errorf("another user was locked: %v %v", other, err)
+			}
+
+			cleared, err := dbh.UpdateLockout(added[0].ID, func(persistence.Lockout) persistence.Lockout {
+				return persistence.Lockout{}
+			})
+			if err != nil || cleared != nil {
+				t.Errorf("lockout was not cleared: %v %v", cleared, err)
+			}
+
+			if found, err = dbh.FindUserByID(added[0].ID); err != nil || found.Lockout != nil {
+				t.Errorf("lockout was not cleared: %v %v", found, err)
+			}
+
+			if _, err = dbh.UpdateLockout("999", fail); err == nil {
+				t.Error("locked a user that doesn't exist")
+			}
+		})
+	}
+}
+
+func TestUseTOTPStep(t *testing.T) {
+	for name, newDB := range backends(t) {
+		t.Run(string(name), func(t *testing.T) {
+			dbh := newDB()
+			added := addUsers(t, dbh)
+
+			// A user without an authenticator has no steps to use.
+			if ok, err := dbh.UseTOTPStep(added[0].ID, 5); err != nil || ok {
+				t.Errorf("used a step without an authenticator: %v %v", ok, err)
+			}
+
+			totp := &persistence.TOTP{Secret: "secret", Enabled: true, LastStep: 4}
+			if _, err := dbh.UpdateUser(persistence.User{ID: added[0].ID, TOTP: totp}); err != nil {
+				t.Fatal(err)
+			}
+
+			before, _, err := dbh.(events.Outbox).OutboxBacklog()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Only one of the racing uses of a step gets it.
+			used := make(chan bool, 8)
+			for i := 0; i < cap(used); i++ {
+				go func() {
+					ok, err := dbh.UseTOTPStep(added[0].ID, 5)
+					if err != nil {
+						t.Error(err)
+					}
+
+					used <- ok
+				}()
+			}
+
+			n := 0
+			for i := 0; i < cap(used); i++ {
+				if <-used {
+					n++
+				}
+			}
+
+			if n != 1 {
+				t.Errorf("step was used %v times, want 1", n)
+			}
+
+			for step, want := range map[int64]bool{5: false, 4: false, 6: true} {
+				if ok, err := dbh.UseTOTPStep(added[0].ID, step); err != nil || ok != want {
+					t.Errorf("step %v: got %v, %v want %v", step, ok, err, want)
+				}
+			}
+
+			found, err := dbh.FindUserByID(added[0].ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if found.TOTP == nil || found.TOTP.LastStep != 6 || found.TOTP.Secret != "secret" || !found.TOTP.Enabled {
+				t.Errorf("step was not stored: %+v", found.TOTP)
+			}
+
+			if after, _, err := dbh.(events.Outbox).OutboxBacklog(); err != nil || after != before {
+				t.Errorf("using a step wrote events: got %v want %v (%v)", after, before, err)
+			}
+
+			// An update made from a copy of the user read before the step was
+			// used must not make the step usable again.
+			if _, err = dbh.UpdateUser(persistence.User{ID: added[0].ID, TOTP: totp}); err != nil {
+				t.Fatal(err)
+			}
+
+			if ok, err := dbh.UseTOTPStep(added[0].ID, 6); err != nil || ok {
+				t.Errorf("step was used again after a stale update: %v %v", ok, err)
+			}
+
+			// A new secret starts again.
+			renewed := &persistence.TOTP{Secret: "renewed"}
+			if _, err = dbh.UpdateUser(persistence.User{ID: added[0].ID, TOTP: renewed}); err != nil {
+				t.Fatal(err)
+			}
+
+			if ok, err := dbh.UseTOTPStep(added[0].ID, 1); err != nil || !ok {
+				t.Errorf("step of a new secret was not used: %v %v", ok, err)
+			}
+
+			if _, err = dbh.UseTOTPStep("999", 7); err == nil {
+				t.Error("used a step of a user that doesn't exist")
+			}
+		})
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	for name, newDB := range backends(t) {
+		t.Run(string(name), func(t *testing.T) {
+			dbh := newDB()
+			added := addUsers(t, dbh)
+
+			at := time.Date(2020, 4, 1, 12, 0, 0, 0, time.UTC)
+			token, err := dbh.AddToken(persistence.Token{
+				Kind:      persistence.TokenPasswordReset,
+				Hash:      "reset",
+				UserID:    added[0].ID,
+				Family:    "reset-family",
+				CreatedAt: at,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Refresh tokens of the user are revoked with it, not anyone
+			// else's.
+			refresh := make([]*persistence.Token, 0)
+			for i, userID := range []string{added[0].ID, added[0].ID, added[1].ID} {
+				token, err := dbh.AddToken(persistence.Token{
+					Kind:      persistence.TokenRefresh,
+					Hash:      "refresh" + strconv.Itoa(i),
+					UserID:    userID,
+					Family:    "session" + strconv.Itoa(i),
+					CreatedAt: at,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				refresh = append(refresh, token)
+			}
+
+			outbox := dbh.(events.Outbox)
+			before, _, err := outbox.OutboxBacklog()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			user, err := dbh.ResetPassword(token.ID, "new hash", at)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if user.ID != added[0].ID || user.Password != "new hash" || user.Email != added[0].Email {
+				t.Errorf("wrong user returned: %+v", user)
+			}
+
+			if found, err := dbh.FindUserByID(added[0].ID); err != nil || found.Password != "new hash" {
+				t.Errorf("password was not stored: %v %v", found, err)
+			}
+
+			if found, err := dbh.FindTokenByID(token.ID); err != nil || found.RevokedAt == nil || !found.RevokedAt.Equal(at) {
+				t.Errorf("token was not revoked: %v %v", found, err)
+			}
+
+			for i, want := range []bool{true, true, false} {
+				if found, err := dbh.FindTokenByID(refresh[i].ID); err != nil || found.Revoked() != want {
+					t.Errorf("refresh token %v: got %v, %v want revoked %v", i, found, err, want)
+				}
+			}
+
+			if after, _, err := outbox.OutboxBacklog(); err != nil || after != before+1 {
+				t.Errorf("wrong number of events: got %v want %v (%v)", after, before+1, err)
+			}
+
+			if _, err = dbh.ResetPassword(token.ID, "another hash", at); err != persistence.ErrTokenUsed {
+				t.Errorf("reused a token: got %v want %v", err, persistence.ErrTokenUsed)
+			}
+
+			if found, err := dbh.FindUserByID(added[0].ID); err != nil || found.Password != "new hash" {
+				t.Errorf("password was changed with a used token: %v %v", found, err)
+			}
+
+			if _, err = dbh.ResetPassword("999", "another hash", at); err != persistence.ErrTokenNotFound {
+				t.Errorf("unknown token: got %v want %v", err, persistence.ErrTokenNotFound)
+			}
+		})
+	}
+}
+
+func TestVerifyEmail(t *testing.T) {
+	for name, newDB := range backends(t) {
+		t.Run(string(name), func(t *testing.T) {
+			dbh := newDB()
+			added := addUsers(t, dbh)
+
+			at := time.Date(2020, 4, 1, 12, 0, 0, 0, time.UTC)
+			tokens := make([]*persistence.Token, 0)
+			for i, user := range added[:2] {
+				token, err := dbh.AddToken(persistence.Token{
+					Kind:      persistence.TokenEmailVerification,
+					Hash:      "verify" + strconv.Itoa(i),
+					Name:      user.Email,
+					UserID:    user.ID,
+					Family:    "verify" + user.ID,
+					CreatedAt: at,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				tokens = append(tokens, token)
+			}
+
+			outbox := dbh.(events.Outbox)
+			before, _, err := outbox.OutboxBacklog()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			user, err := dbh.VerifyEmail(tokens[0].ID, at)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if user.ID != added[0].ID || !user.EmailVerified || user.VerifiedAt == nil || !user.VerifiedAt.Equal(at) {
+				t.Errorf("wrong user returned: %+v", user)
+			}
+
+			if found, err := dbh.FindUserByID(added[0].ID); err != nil || !found.EmailVerified {
+				t.Errorf("verification was not stored: %v %v", found, err)
+			}
+
+			if found, err := dbh.FindTokenByID(tokens[0].ID); err != nil || !found.Revoked() {
+				t.Errorf("token was not revoked: %v %v", found, err)
+			}
+
+			if after, _, err := outbox.OutboxBacklog(); err != nil || after != before+1 {
+				t.Errorf("wrong number of events: got %v want %v (%v)", after, before+1, err)
+			}
+
+			if _, err = dbh.VerifyEmail(tokens[0].ID, at); err != persistence.ErrTokenUsed {
+				t.Errorf("reused a token: got %v want %v", err, persistence.ErrTokenUsed)
+			}
+
+			// A token sent to an email the user no longer has changes nothing.
+			if _, err = dbh.UpdateUser(persistence.User{ID: added[1].ID, Email: "someone@mail.com"}); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = dbh.VerifyEmail(tokens[1].ID, at); err != persistence.ErrTokenStale {
+				t.Errorf("verified another email: got %v want %v", err, persistence.ErrTokenStale)
+			}
+
+			if found, err := dbh.FindUserByID(added[1].ID); err != nil || found.EmailVerified {
+				t.Errorf("user was verified with a stale token: %v %v", found, err)
+			}
+
+			if _, err = dbh.VerifyEmail("999", at); err != persistence.ErrTokenNotFound {
+				t.Errorf("unknown token: got %v want %v", err, persistence.ErrTokenNotFound)
+			}
+		})
+	}
+}
+
+func TestUniqueEmailAndNickname(t *testing.T) {
+	for name, newDB := range backends(t) {
+		t.Run(string(name), func(t *testing.T) {
+			dbh := newDB()
+			added := addUsers(t, dbh)
+
+			conflictOn := func(err error) string {
+				if conflict, ok := err.(*persistence.ConflictError); ok {
+					return conflict.Field
+				}
+
+				return fmt.Sprint(err)
+			}
+
+			clash := testUsers()[0]
+			clash.Email = "KLAY_Thompson@mail.com"
+			clash.Nickname = "klay"
+			if _, err := dbh.AddUser(clash); conflictOn(err) != "email" {
+				t.Errorf("added a user with a taken email: %v", err)
+			}
+
+			clash.Email = "klay@mail.com"
+			clash.Nickname = "splash BROTHER"
+			if _, err := dbh.AddUser(clash); conflictOn(err) != "nickname" {
+				t.Errorf("added a user with a taken nickname: %v", err)
+			}
+
+			// Users without a nickname don't clash with each other.
+			for _, email := range []string{"a@mail.com", "b@mail.com"} {
+				if _, err := dbh.AddUser(persistence.User{FirstName: "A", Email: email}); err != nil {
+					t.Errorf("users without a nickname clashed: %v", err)
+				}
+			}
+
+			if _, err := dbh.UpdateUser(persistence.User{ID: added[1].ID, Email: "Steph_Curry@mail.com", Country: "GB"}); conflictOn(err) != "email" {
+				t.Errorf("updated a user to a taken email: %v", err)
+			}
+
+			found, err := dbh.FindUserByID(added[1].ID)
+			if err != nil || found.Email != "serge_ibaka@mail.com" || found.Country != "cameroon" {
+				t.Errorf("a clashing update was stored: %v %v", found, err)
+			}
+
+			// Changing the case of your own email isn't a clash.
+			if _, err = dbh.UpdateUser(persistence.User{ID: added[1].ID, Email: "Serge_Ibaka@mail.com"}); err != nil {
+				t.Errorf("could not change the case of an email: %v", err)
+			}
+
+			for criteria, value := range map[string]string{"email": "SERGE_IBAKA@MAIL.COM", "nickname": "iblocka"} {
+				users, err := dbh.FindUserByCriteria(criteria, value)
+				if err != nil || len(users) != 1 || users[0].ID != added[1].ID {
+					t.Errorf("%s search was not case insensitive: %v %v", criteria, users, err)
+				}
+			}
+
+			// Case is folded beyond ASCII, the same in every database.
+			accented, err := dbh.AddUser(persistence.User{FirstName: "Émile", Email: "ÉMILE@mail.com", Nickname: "Élan"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = dbh.AddUser(persistence.User{FirstName: "Émile", Email: "émile@mail.com"}); conflictOn(err) != "email" {
+				t.Errorf("added a user with a taken accented email: %v", err)
+			}
+
+			if _, err = dbh.AddUser(persistence.User{FirstName: "Émile", Email: "emile@mail.com", Nickname: "éLAN"}); conflictOn(err) != "nickname" {
+				t.Errorf("added a user with a taken accented nickname: %v", err)
+			}
+
+			for criteria, value := range map[string]string{"email": "émile@MAIL.COM", "nickname": "ÉLAN"} {
+				users, err := dbh.FindUserByCriteria(criteria, value)
+				if err != nil || len(users) != 1 || users[0].ID != accented.ID {
+					t.Errorf("accented %s search was not case insensitive: %v %v", criteria, users, err)
+				}
+			}
+
+			// An email that was changed is free again.
+			if _, err = dbh.UpdateUser(persistence.User{ID: accented.ID, Email: "emile@mail.com"}); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = dbh.AddUser(persistence.User{FirstName: "Émile", Email: "Émile@mail.com"}); err != nil {
+				t.Errorf("could not reuse a changed email: %v", err)
+			}
+
+			if _, err = dbh.AddUser(persistence.User{FirstName: "Emile", Email: "EMILE@mail.com"}); conflictOn(err) != "email" {
+				t.Errorf("added a user with a taken changed email: %v", err)
+			}
+
+			// A deleted user's email and nickname are free again.
+			if err = dbh.DeleteUser(added[0].ID); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = dbh.AddUser(testUsers()[0]); err != nil {
+				t.Errorf("could not reuse a deleted user's email: %v", err)
+			}
+		})
+	}
+}
+
+func TestBoltIndexBackfill(t *testing.T) {
+	path := filepath.Join(tempDir(t), "users.bolt")
+	db, err := boltlayer.NewBoltDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addUsers(t, db)
+	db.Close()
+
+	// Drop an index, as if the file was created before it existed.
+	raw, err := bbolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = raw.Update(func(tx *bbolt.Tx) error {
+		return tx.DeleteBucket([]byte("index_email_verified"))
+	})
+	raw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = boltlayer.NewBoltDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	users, err := db.FindUserByCriteria("email_verified", "false")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(users) != 3 {
+		t.Errorf("existing users were not added to the new index: got %v want %v", len(users), 3)
+	}
+}
+
+func TestBoltZeroTokenTimes(t *testing.T) {
+	path := filepath.Join(tempDir(t), "users.bolt")
+	db, err := boltlayer.NewBoltDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := db.AddToken(persistence.Token{Kind: persistence.TokenAPIKey, Hash: "hash", CreatedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// Tokens used to be stored with zero times for the ones not set.
+	raw, err := bbolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = raw.Update(func(tx *bbolt.Tx) error {
+		id, _ := strconv.ParseUint(token.ID, 10, 64)
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, id)
+		record := `{"id":"` + token.ID + `","kind":"api_key","hash":"hash","created_at":"2020-04-01T12:00:00Z",` +
+			`"expires_at":"0001-01-01T00:00:00Z","revoked_at":"0001-01-01T00:00:00Z"}`
+		return tx.Bucket([]byte("tokens")).Put(key, []byte(record))
+	})
+	raw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = boltlayer.NewBoltDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	found, err := db.FindTokenByID(token.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if found.RevokedAt != nil || found.ExpiresAt != nil || found.Revoked() || found.Expired(time.Now()) {
+		t.Errorf("zero times were read as set: %+v", found)
+	}
+}
+
+func TestSQLiteReopen(t *testing.T) {
+	path := filepath.Join(tempDir(t), "users.db")
+	added := addUsers(t, newHandler(t, SQLITE, path))
+
+	// Opening the file again re-runs the migrations, which must be a no-op
+	// for an up to date database.
+	user, err := newHandler(t, SQLITE, path).FindUserByID(added[2].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *user != *added[2] {
+		t.Errorf("found wrong user: got %v want %v", user, added[2])
+	}
+}
+
+func TestSQLiteUniqueKeyBackfill(t *testing.T) {
+	path := filepath.Join(tempDir(t), "users.db")
+	added := addUsers(t, newHandler(t, SQLITE, path))
+
+	// Clear the keys, as if the users were added before they were stored.
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+
+	if _, err = raw.Exec(`UPDATE users SET email_key = '', nickname_key = ''`); err != nil {
+		t.Fatal(err)
+	}
+
+	dbh := newHandler(t, SQLITE, path)
+	users, err := dbh.FindUserByCriteria("email", "KLAY_THOMPSON@MAIL.COM")
+	if err != nil || len(users) != 1 || users[0].ID != added[0].ID {
+		t.Errorf("keys were not filled in: %v %v", users, err)
+	}
+
+	if _, err = dbh.AddUser(persistence.User{FirstName: "Klay", Email: "Klay_Thompson@mail.com"}); err == nil {
+		t.Error("added a user with a taken email")
+	}
+
+	// Users that only clash once their keys are filled in have to be
+	// resolved first.
+	_, err = raw.Exec(`INSERT INTO users (first_name, email) VALUES ('Klay', 'KLAY_THOMPSON@MAIL.COM')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = NewPersistenceLayer(SQLITE, path); err == nil {
+		t.Error("opened a database with users that clash")
+	}
+}
+
+func TestTokens(t *testing.T) {
+	for name, newDB := range backends(t) {
+		t.Run(string(name), func(t *testing.T) {
+			dbh := newDB()
+			created := time.Now().UTC().Truncate(time.Second)
+
+			added := make([]*persistence.Token, 0)
+			for _, n := range []string{"billing", "reports"} {
+				token, err := dbh.AddToken(persistence.Token{
+					Kind:      persistence.TokenAPIKey,
+					Hash:      "hash-" + n,
+					Name:      n,
+					Scopes:    []string{persistence.ScopeRead, persistence.ScopeSearch},
+					CreatedAt: created,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				added = append(added, token)
+			}
+
+			token, err := dbh.FindTokenByHash("hash-reports")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if token.ID != added[1].ID || token.Name != "reports" || !token.CreatedAt.Equal(created) {
+				t.Errorf("found wrong token: got %v want %v", token, added[1])
+			}
+
+			if !token.HasScope(persistence.ScopeSearch) || token.HasScope(persistence.ScopeDelete) {
+				t.Errorf("token has wrong scopes: %v", token.Scopes)
+			}
+
+			if token.Revoked() {
+				t.Error("new token is revoked")
+			}
+
+			// Rotating and revoking a token are both updates.
+			token.Hash = "hash-rotated"
+			revokedAt := created.Add(time.Minute)
+			token.RevokedAt = &revokedAt
+			if _, err = dbh.UpdateToken(*token); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = dbh.FindTokenByHash("hash-reports"); err != persistence.ErrTokenNotFound {
+				t.Errorf("found token by old hash: %v", err)
+			}
+
+			token, err = dbh.FindTokenByID(added[1].ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if token.Hash != "hash-rotated" || !token.Revoked() {
+				t.Errorf("token was not updated: %v", token)
+			}
+
+			tokens, err := dbh.FindTokensByKind(persistence.TokenAPIKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(tokens) != 2 || tokens[0].ID != added[0].ID {
+				t.Errorf("listed wrong tokens: %v", tokens)
+			}
+
+			if _, err = dbh.FindTokenByID("99"); err != persistence.ErrTokenNotFound {
+				t.Errorf("wrong error for missing token: got %v want %v", err, persistence.ErrTokenNotFound)
+			}
+
+			if _, err = dbh.UpdateToken(persistence.Token{ID: "99", Hash: "x"}); err != persistence.ErrTokenNotFound {
+				t.Errorf("wrong error updating missing token: got %v want %v", err, persistence.ErrTokenNotFound)
+			}
+		})
+	}
+}
+
+func TestRevokeTokens(t *testing.T) {
+	for name, newDB := range backends(t) {
+		t.Run(string(name), func(t *testing.T) {
+			dbh := newDB()
+			now := time.Now().UTC().Truncate(time.Second)
+
+			// Two sessions for the same user, the first rotated once.
+			expires := now.Add(time.Hour)
+			added := make([]*persistence.Token, 0)
+			for i, family := range []string{"a", "a", "b"} {
+				token, err := dbh.AddToken(persistence.Token{
+					Kind:      persistence.TokenRefresh,
+					Hash:      "hash-" + strconv.Itoa(i),
+					UserID:    "1",
+					Family:    family,
+					CreatedAt: now,
+					ExpiresAt: &expires,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				added = append(added, token)
+			}
+
+			if added[0].UserID != "1" || added[0].Family != "a" || added[0].ExpiresAt == nil || !added[0].ExpiresAt.Equal(expires) {
+				t.Errorf("token was not stored correctly: %v", added[0])
+			}
+
+			revoked, err := dbh.RevokeToken(added[0].ID, now)
+			if err != nil || !revoked {
+				t.Fatalf("token was not revoked: %v %v", revoked, err)
+			}
+
+			// Only the first call revokes it.
+			revoked, err = dbh.RevokeToken(added[0].ID, now.Add(time.Minute))
+			if err != nil || revoked {
+				t.Errorf("revoked token was revoked again: %v %v", revoked, err)
+			}
+
+			if _, err = dbh.RevokeToken("99", now); err != persistence.ErrTokenNotFound {
+				t.Errorf("wrong error revoking missing token: got %v want %v", err, persistence.ErrTokenNotFound)
+			}
+
+			if err = dbh.RevokeTokenFamily("a", now.Add(time.Minute)); err != nil {
+				t.Fatal(err)
+			}
+
+			for i, want := range []bool{true, true, false} {
+				token, err := dbh.FindTokenByHash("hash-" + strconv.Itoa(i))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if token.Revoked() != want {
+					t.Errorf("token %d: got revoked %v want %v", i, token.Revoked(), want)
+				}
+			}
+
+			// Revoking the family keeps the time the first token was
+			// revoked.
+			token, err := dbh.FindTokenByID(added[0].ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if token.RevokedAt == nil || !token.RevokedAt.Equal(now) {
+				t.Errorf("wrong revoked time: got %v want %v", token.RevokedAt, now)
+			}
+		})
+	}
+}
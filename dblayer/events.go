@@ -0,0 +1,121 @@
+package dblayer
+
+import (
+	"log"
+	"time"
+
+	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+	events "github.com/omgitsotis/user-service/events"
+)
+
+// eventLayer wraps a DatabaseHandler and emits an event after every
+// successful change to a user. Reads are passed straight through, so any
+// database type gets events without having to know about them.
+type eventLayer struct {
+	DatabaseHandler
+	emitter events.Emitter
+}
+
+// NewEventLayer returns a DatabaseHandler that emits user.created,
+// user.updated and user.deleted events through emitter. The change has
+// already been stored by the time the event is sent, so a failed emit is
+// logged rather than returned.
+func NewEventLayer(dbh DatabaseHandler, emitter events.Emitter) DatabaseHandler {
+	return &eventLayer{dbh, emitter}
+}
+
+func (el *eventLayer) AddUser(u persistence.User) (*persistence.User, error) {
+	user, err := el.DatabaseHandler.AddUser(u)
+	if err != nil {
+		return nil, err
+	}
+
+	el.emit(events.NewUserEvent(events.UserCreated, nil, user))
+	return user, nil
+}
+
+// UpdateUser looks the user up first so the event can say which fields
+// changed.
+func (el *eventLayer) UpdateUser(u persistence.User) (*persistence.User, error) {
+	before, err := el.DatabaseHandler.FindUserByID(u.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := el.DatabaseHandler.UpdateUser(u)
+	if err != nil {
+		return nil, err
+	}
+
+	el.emit(events.NewUserEvent(events.UserUpdated, before, user))
+	return user, nil
+}
+
+// ResetPassword looks the user up first, like UpdateUser.
+func (el *eventLayer) ResetPassword(tokenID, password string, at time.Time) (*persistence.User, error) {
+	token, err := el.DatabaseHandler.FindTokenByID(tokenID)
+	if err != nil {
+		return nil, err
+	}
+
+	before, err := el.DatabaseHandler.FindUserByID(token.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := el.DatabaseHandler.ResetPassword(tokenID, password, at)
+	if err != nil {
+		return nil, err
+	}
+
+	el.emit(events.NewUserEvent(events.UserUpdated, before, user))
+	return user, nil
+}
+
+// VerifyEmail looks the user up first, like UpdateUser.
+func (el *eventLayer) VerifyEmail(tokenID string, at time.Time) (*persistence.User, error) {
+	token, err := el.DatabaseHandler.FindTokenByID(tokenID)
+	if err != nil {
+		return nil, err
+	}
+
+	before, err := el.DatabaseHandler.FindUserByID(token.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := el.DatabaseHandler.VerifyEmail(tokenID, at)
+	if err != nil {
+		return nil, err
+	}
+
+	el.emit(events.NewUserEvent(events.UserUpdated, before, user))
+	return user, nil
+}
+
+// DeleteUser looks the user up first so the event can carry the user that
+// was deleted.
+func (el *eventLayer) DeleteUser(id string) error {
+	user, err := el.DatabaseHandler.FindUserByID(id)
+	if err != nil {
+		return err
+	}
+
+	if err = el.DatabaseHandler.DeleteUser(id); err != nil {
+		return err
+	}
+
+	el.emit(events.NewUserEvent(events.UserDeleted, user, nil))
+	return nil
+}
+
+func (el *eventLayer) emit(e events.Event) {
+	if e.Empty() {
+		return
+	}
+
+	if err := el.emitter.Emit(e); err != nil {
+		log.Printf("[EventLayer] failed to emit %s event for user %s: %s\n",
+			e.Type, e.UserID, err.Error())
+	}
+}
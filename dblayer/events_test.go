@@ -0,0 +1,146 @@
+package dblayer
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+	events "github.com/omgitsotis/user-service/events"
+)
+
+func TestEventLayer(t *testing.T) {
+	for name, newDB := range backends(t) {
+		t.Run(string(name), func(t *testing.T) {
+			recorder := &events.Recorder{}
+			dbh := NewEventLayer(newDB(), recorder)
+			added := addUsers(t, dbh)
+
+			update := persistence.User{ID: added[0].ID, Country: "UK"}
+			if _, err := dbh.UpdateUser(update); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := dbh.DeleteUser(added[1].ID); err != nil {
+				t.Fatal(err)
+			}
+
+			token, err := dbh.AddToken(persistence.Token{Kind: persistence.TokenPasswordReset, Hash: "reset", UserID: added[2].ID})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = dbh.ResetPassword(token.ID, "new hash", time.Now()); err != nil {
+				t.Fatal(err)
+			}
+
+			// Failed changes must not emit anything.
+			dbh.UpdateUser(persistence.User{ID: "1000", Country: "UK"})
+			dbh.DeleteUser("1000")
+			dbh.ResetPassword(token.ID, "another hash", time.Now())
+
+			want := []struct {
+				eventType string
+				userID    string
+				changed   []string
+			}{
+				{events.UserCreated, added[0].ID, allFields},
+				{events.UserCreated, added[1].ID, append(allFields, "role")},
+				{events.UserCreated, added[2].ID, allFields},
+				{events.UserUpdated, added[0].ID, []string{"country"}},
+				{events.UserDeleted, added[1].ID, nil},
+				{events.UserUpdated, added[2].ID, []string{"password"}},
+			}
+
+			got := recorder.Events()
+			if len(got) != len(want) {
+				t.Fatalf("wrong number of events: got %v want %v", len(got), len(want))
+			}
+
+			for i, w := range want {
+				if got[i].Type != w.eventType || got[i].UserID != w.userID {
+					t.Errorf("wrong event %v: got %s for user %s want %s for user %s",
+						i, got[i].Type, got[i].UserID, w.eventType, w.userID)
+				}
+
+				if !reflect.DeepEqual(got[i].Changed, w.changed) {
+					t.Errorf("wrong changed fields for event %v: got %v want %v",
+						i, got[i].Changed, w.changed)
+				}
+			}
+		})
+	}
+}
+
+var allFields = []string{"first_name", "last_name", "nickname", "password", "email", "country"}
+
+func TestOutbox(t *testing.T) {
+	for name, newDB := range backends(t) {
+		t.Run(string(name), func(t *testing.T) {
+			dbh := newDB()
+			outbox, ok := dbh.(events.Outbox)
+			if !ok {
+				t.Fatalf("%s does not implement an outbox", name)
+			}
+
+			added := addUsers(t, dbh)
+			if _, err := dbh.UpdateUser(persistence.User{ID: added[0].ID, Country: "UK"}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := dbh.DeleteUser(added[1].ID); err != nil {
+				t.Fatal(err)
+			}
+
+			// Failed changes must not write anything.
+			dbh.UpdateUser(persistence.User{ID: "1000", Country: "UK"})
+			dbh.DeleteUser("1000")
+
+			entries, err := outbox.PendingEvents(10)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := []string{
+				events.UserCreated, events.UserCreated, events.UserCreated,
+				events.UserUpdated, events.UserDeleted,
+			}
+			if len(entries) != len(want) {
+				t.Fatalf("wrong number of events: got %v want %v", len(entries), len(want))
+			}
+
+			for i, eventType := range want {
+				if entries[i].Event.Type != eventType {
+					t.Errorf("wrong type for event %v: got %v want %v",
+						i, entries[i].Event.Type, eventType)
+				}
+			}
+
+			if !reflect.DeepEqual(entries[3].Event.Changed, []string{"country"}) {
+				t.Errorf("wrong changed fields: got %v want %v",
+					entries[3].Event.Changed, []string{"country"})
+			}
+
+			if err = outbox.MarkSent(entries[0].ID); err != nil {
+				t.Fatal(err)
+			}
+
+			count, oldest, err := outbox.OutboxBacklog()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if count != len(want)-1 {
+				t.Errorf("wrong backlog: got %v want %v", count, len(want)-1)
+			}
+
+			if !oldest.Equal(entries[1].CreatedAt) {
+				t.Errorf("wrong oldest event: got %v want %v", oldest, entries[1].CreatedAt)
+			}
+
+			if entries, _ = outbox.PendingEvents(2); len(entries) != 2 {
+				t.Errorf("limit was ignored: got %v events want %v", len(entries), 2)
+			}
+		})
+	}
+}
@@ -3,137 +3,507 @@ package mockdblayer
 import (
 	"errors"
 	"log"
+	"sort"
 	"strconv"
+	"sync"
+	"time"
 
 	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+	events "github.com/omgitsotis/user-service/events"
 )
 
-type MockEventEmitter struct{}
-
-func (mee *MockEventEmitter) emitEvent(eventType, msg string) {
-	log.Printf("emiting %s event with msg %s\n", eventType, msg)
-}
-
+// MockDatabase keeps users in memory. It is safe for concurrent use: reads
+// share a read lock and anything that changes a user takes the write lock.
+// Users are copied in and out of the map so callers never hold a pointer to
+// a user another request could be changing.
+//
+// Events for each change are added to an in-memory outbox under the same lock
+// as the change, so it behaves like the outbox of the real databases.
+//
+// The unique keys of emails and nicknames are kept in maps next to the users,
+// like the unique indexes of the real databases, so they are checked without
+// looking at every user.
 type MockDatabase struct {
-	Users        []*persistence.User
-	EventEmitter MockEventEmitter
+	mu           sync.RWMutex
+	Users        map[string]*persistence.User
 	IDCount      int
+	emailKeys    map[string]string
+	nicknameKeys map[string]string
+	tokens       map[string]*persistence.Token
+	tokenCount   int
+	outbox       []events.OutboxEntry
+	outboxID     int64
 }
 
 func NewMockDatabase() *MockDatabase {
-	users := make([]*persistence.User, 0)
-	mockEmitter := MockEventEmitter{}
-	return &MockDatabase{users, mockEmitter, 1}
+	return &MockDatabase{
+		Users:        make(map[string]*persistence.User),
+		IDCount:      1,
+		emailKeys:    make(map[string]string),
+		nicknameKeys: make(map[string]string),
+		tokens:       make(map[string]*persistence.Token),
+	}
 }
 
 func (db *MockDatabase) AddUser(user persistence.User) (*persistence.User, error) {
+	db.mu.Lock()
+	if err := db.conflict(&user); err != nil {
+		db.mu.Unlock()
+		return nil, err
+	}
+
 	user.ID = strconv.Itoa(db.IDCount)
 	db.IDCount++
-	db.Users = append(db.Users, &user)
+	stored := copyUser(&user)
+	db.Users[user.ID] = stored
+	db.index(stored)
+	db.addEvent(events.NewUserEvent(events.UserCreated, nil, stored))
+	db.mu.Unlock()
 
 	log.Printf("[MockDB] added new user %s\n", user.ID)
-	db.EventEmitter.emitEvent("user created", "mock-user-json")
-
 	return &user, nil
 }
 
 func (db *MockDatabase) FindUserByID(id string) (*persistence.User, error) {
-	for _, user := range db.Users {
-		if user.ID == id {
-			log.Printf("[MockDB] found user %s\n", user.ID)
-			return user, nil
-		}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	user, ok := db.Users[id]
+	if !ok {
+		return nil, errors.New("no user found with ID")
 	}
 
-	return nil, errors.New("no user found with ID")
+	log.Printf("[MockDB] found user %s\n", user.ID)
+	return copyUser(user), nil
 }
 
 func (db *MockDatabase) DeleteUser(id string) error {
-	indexToDelete := -1
-	for i, user := range db.Users {
-		if user.ID == id {
-			indexToDelete = i
-			break
-		}
-	}
-
-	if indexToDelete == -1 {
+	db.mu.Lock()
+	user, ok := db.Users[id]
+	if !ok {
+		db.mu.Unlock()
 		return errors.New("no user found with ID")
 	}
 
-	db.Users = append(db.Users[:indexToDelete], db.Users[indexToDelete+1:]...)
+	delete(db.Users, id)
+	db.unindex(user)
+	db.addEvent(events.NewUserEvent(events.UserDeleted, user, nil))
+	db.mu.Unlock()
+
 	log.Printf("[MockDB] deleted user %s\n", id)
-	db.EventEmitter.emitEvent("user deleted", "mock-user-json")
 	return nil
 }
 
 func (db *MockDatabase) FindUserByCriteria(criteria string, value string) ([]*persistence.User, error) {
-	results := make([]*persistence.User, 0)
+	page, err := db.FindUsers(persistence.Query{Criteria: []persistence.Criterion{{Field: criteria, Value: value}}})
+	if err != nil {
+		return nil, err
+	}
+
+	return page.Users, nil
+}
+
+func (db *MockDatabase) FindUsers(q persistence.Query) (*persistence.Page, error) {
+	q, err := q.Normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	matches := make([]*persistence.User, 0)
 
+	db.mu.RLock()
 	for _, user := range db.Users {
-		switch criteria {
-		case "country":
-			if user.Country == value {
-				results = append(results, user)
-			}
-		case "first_name":
-			if user.FirstName == value {
-				results = append(results, user)
-			}
-		case "last_name":
-			if user.LastName == value {
-				results = append(results, user)
-			}
-		case "nickname":
-			if user.Nickname == value {
-				results = append(results, user)
-			}
-		case "email":
-			if user.Email == value {
-				results = append(results, user)
-			}
-		default:
-			return nil, errors.New("invalid search criteria")
+		if q.Match(user) {
+			matches = append(matches, copyUser(user))
 		}
 	}
+	db.mu.RUnlock()
 
-	log.Printf("[MockDB] found %v user(s) with %s %s",
-		len(results), criteria, value)
-	return results, nil
+	// Map order is random, so sort them the way the other databases
+	// return them.
+	sort.Slice(matches, func(i, j int) bool {
+		return q.Less(matches[i], matches[j])
+	})
+
+	page := &persistence.Page{Users: make([]*persistence.User, 0), Total: len(matches)}
+	for _, user := range matches {
+		if !q.Follows(user) {
+			continue
+		}
+
+		if q.Limit > 0 && len(page.Users) == q.Limit {
+			page.Next = q.CursorAfter(page.Users[len(page.Users)-1])
+			break
+		}
+
+		page.Users = append(page.Users, user)
+	}
+
+	log.Printf("[MockDB] found %v of %v user(s) with %s", len(page.Users), page.Total, q)
+	return page, nil
 }
 
 func (db *MockDatabase) UpdateUser(u persistence.User) (*persistence.User, error) {
-	for _, user := range db.Users {
-		if user.ID == u.ID {
-			if u.FirstName != "" {
-				user.FirstName = u.FirstName
-			}
-
-			if u.LastName != "" {
-				user.LastName = u.LastName
-			}
-
-			if u.Country != "" {
-				user.Country = u.Country
-			}
-
-			if u.Nickname != "" {
-				user.Nickname = u.Nickname
-			}
-
-			if u.Email != "" {
-				user.Email = u.Email
-			}
-
-			if u.Password != "" {
-				user.FirstName = u.Password
-			}
-
-			log.Printf("[MockDB] updated user %v", user)
-			db.EventEmitter.emitEvent("user updated", "mock-user-json")
-			return user, nil
+	db.mu.Lock()
+	user, ok := db.Users[u.ID]
+	if !ok {
+		db.mu.Unlock()
+		return nil, errors.New("no user found with ID")
+	}
+
+	merged := copyUser(user)
+	merged.Merge(u)
+	if err := db.conflict(merged); err != nil {
+		db.mu.Unlock()
+		return nil, err
+	}
+
+	before := *user
+	db.unindex(user)
+	*user = *merged
+	db.index(user)
+
+	updated := copyUser(user)
+	db.addEvent(events.NewUserEvent(events.UserUpdated, &before, updated))
+	db.mu.Unlock()
+
+	log.Printf("[MockDB] updated user %v", updated)
+	return updated, nil
+}
+
+func (db *MockDatabase) UseTOTPStep(id string, step int64) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	user, ok := db.Users[id]
+	if !ok {
+		return false, errors.New("no user found with ID")
+	}
+
+	if user.TOTP == nil || step <= user.TOTP.LastStep {
+		return false, nil
+	}
+
+	totp := *user.TOTP
+	totp.LastStep = step
+	user.TOTP = &totp
+	return true, nil
+}
+
+func (db *MockDatabase) UpdateLockout(id string, update func(persistence.Lockout) persistence.Lockout) (*persistence.Lockout, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	user, ok := db.Users[id]
+	if !ok {
+		return nil, errors.New("no user found with ID")
+	}
+
+	current := persistence.Lockout{}
+	if user.Lockout != nil {
+		current = *user.Lockout
+	}
+
+	user.Lockout = nil
+	if lockout := update(current); lockout.Failures > 0 {
+		user.Lockout = &lockout
+	} else {
+		log.Printf("[MockDB] cleared lockout for user %s\n", id)
+	}
+
+	return copyUser(user).Lockout, nil
+}
+
+func (db *MockDatabase) AddToken(token persistence.Token) (*persistence.Token, error) {
+	db.mu.Lock()
+	db.tokenCount++
+	token.ID = strconv.Itoa(db.tokenCount)
+	db.tokens[token.ID] = copyToken(&token)
+	db.mu.Unlock()
+
+	log.Printf("[MockDB] added new %s token %s\n", token.Kind, token.ID)
+	return copyToken(&token), nil
+}
+
+func (db *MockDatabase) FindTokenByID(id string) (*persistence.Token, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	token, ok := db.tokens[id]
+	if !ok {
+		return nil, persistence.ErrTokenNotFound
+	}
+
+	return copyToken(token), nil
+}
+
+func (db *MockDatabase) FindTokenByHash(hash string) (*persistence.Token, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for _, token := range db.tokens {
+		if token.Hash == hash {
+			return copyToken(token), nil
+		}
+	}
+
+	return nil, persistence.ErrTokenNotFound
+}
+
+func (db *MockDatabase) FindTokensByKind(kind string) ([]*persistence.Token, error) {
+	results := make([]*persistence.Token, 0)
+
+	db.mu.RLock()
+	for _, token := range db.tokens {
+		if token.Kind == kind {
+			results = append(results, copyToken(token))
+		}
+	}
+	db.mu.RUnlock()
+
+	sort.Slice(results, func(i, j int) bool {
+		return persistence.IDLess(results[i].ID, results[j].ID)
+	})
+
+	return results, nil
+}
+
+func (db *MockDatabase) UpdateToken(token persistence.Token) (*persistence.Token, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	stored, ok := db.tokens[token.ID]
+	if !ok {
+		return nil, persistence.ErrTokenNotFound
+	}
+
+	// The kind, owner, family and creation time of a token never change
+	token.Kind = stored.Kind
+	token.UserID = stored.UserID
+	token.Family = stored.Family
+	token.CreatedAt = stored.CreatedAt
+	db.tokens[token.ID] = copyToken(&token)
+
+	log.Printf("[MockDB] updated token %s\n", token.ID)
+	return copyToken(&token), nil
+}
+
+func (db *MockDatabase) RevokeToken(id string, at time.Time) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	token, ok := db.tokens[id]
+	if !ok {
+		return false, persistence.ErrTokenNotFound
+	}
+
+	if token.Revoked() {
+		return false, nil
+	}
+
+	token.RevokedAt = &at
+	log.Printf("[MockDB] revoked token %s\n", id)
+	return true, nil
+}
+
+func (db *MockDatabase) RevokeTokenFamily(family string, at time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, token := range db.tokens {
+		if token.Family == family && !token.Revoked() {
+			token.RevokedAt = &at
 		}
 	}
 
-	return nil, errors.New("invalid search criteria")
+	log.Printf("[MockDB] revoked token family %s\n", family)
+	return nil
+}
+
+func (db *MockDatabase) ResetPassword(tokenID, password string, at time.Time) (*persistence.User, error) {
+	db.mu.Lock()
+	token, ok := db.tokens[tokenID]
+	if !ok {
+		db.mu.Unlock()
+		return nil, persistence.ErrTokenNotFound
+	}
+
+	if token.Revoked() {
+		db.mu.Unlock()
+		return nil, persistence.ErrTokenUsed
+	}
+
+	user, ok := db.Users[token.UserID]
+	if !ok {
+		db.mu.Unlock()
+		return nil, errors.New("no user found with ID")
+	}
+
+	before := *user
+	token.RevokedAt = &at
+	user.Password = password
+	for _, t := range db.tokens {
+		if t.Kind == persistence.TokenRefresh && t.UserID == user.ID && !t.Revoked() {
+			t.RevokedAt = &at
+		}
+	}
+
+	updated := copyUser(user)
+	db.addEvent(events.NewUserEvent(events.UserUpdated, &before, updated))
+	db.mu.Unlock()
+
+	log.Printf("[MockDB] reset password of user %s with token %s\n", updated.ID, tokenID)
+	return updated, nil
+}
+
+func (db *MockDatabase) VerifyEmail(tokenID string, at time.Time) (*persistence.User, error) {
+	db.mu.Lock()
+	token, ok := db.tokens[tokenID]
+	if !ok {
+		db.mu.Unlock()
+		return nil, persistence.ErrTokenNotFound
+	}
+
+	if token.Revoked() {
+		db.mu.Unlock()
+		return nil, persistence.ErrTokenUsed
+	}
+
+	user, ok := db.Users[token.UserID]
+	if !ok {
+		db.mu.Unlock()
+		return nil, errors.New("no user found with ID")
+	}
+
+	if user.Email != token.Name {
+		db.mu.Unlock()
+		return nil, persistence.ErrTokenStale
+	}
+
+	before := *user
+	token.RevokedAt = &at
+	user.Merge(persistence.User{VerifiedAt: &at})
+
+	updated := copyUser(user)
+	db.addEvent(events.NewUserEvent(events.UserUpdated, &before, updated))
+	db.mu.Unlock()
+
+	log.Printf("[MockDB] verified email of user %s with token %s\n", updated.ID, tokenID)
+	return updated, nil
+}
+
+// conflict returns a persistence.ConflictError if another user has the
+// email or nickname of u. The lock must be held.
+func (db *MockDatabase) conflict(u *persistence.User) error {
+	if id, ok := db.emailKeys[persistence.UniqueKey(u.Email)]; ok && u.Email != "" && id != u.ID {
+		return &persistence.ConflictError{Field: "email"}
+	}
+
+	if id, ok := db.nicknameKeys[persistence.UniqueKey(u.Nickname)]; ok && u.Nickname != "" && id != u.ID {
+		return &persistence.ConflictError{Field: "nickname"}
+	}
+
+	return nil
+}
+
+// index adds the unique keys of u. The write lock must be held.
+func (db *MockDatabase) index(u *persistence.User) {
+	if u.Email != "" {
+		db.emailKeys[persistence.UniqueKey(u.Email)] = u.ID
+	}
+
+	if u.Nickname != "" {
+		db.nicknameKeys[persistence.UniqueKey(u.Nickname)] = u.ID
+	}
+}
+
+// unindex removes the unique keys of u. The write lock must be held.
+func (db *MockDatabase) unindex(u *persistence.User) {
+	delete(db.emailKeys, persistence.UniqueKey(u.Email))
+	delete(db.nicknameKeys, persistence.UniqueKey(u.Nickname))
+}
+
+// copyUser copies a user, including the values it points to, so callers
+// can't change a stored user through a pointer they were given.
+func copyUser(u *persistence.User) *persistence.User {
+	c := *u
+	if u.VerifiedAt != nil {
+		verifiedAt := *u.VerifiedAt
+		c.VerifiedAt = &verifiedAt
+	}
+
+	if u.TOTP != nil {
+		totp := *u.TOTP
+		c.TOTP = &totp
+	}
+
+	if u.Lockout != nil {
+		lockout := *u.Lockout
+		if u.Lockout.LockedUntil != nil {
+			lockedUntil := *u.Lockout.LockedUntil
+			lockout.LockedUntil = &lockedUntil
+		}
+
+		c.Lockout = &lockout
+	}
+
+	return &c
+}
+
+// copyToken copies a token, including its scopes, so callers can't change a
+// stored token through a slice they were given.
+func copyToken(t *persistence.Token) *persistence.Token {
+	c := *t
+	c.Scopes = append([]string(nil), t.Scopes...)
+	return &c
+}
+
+// addEvent adds an event to the outbox. The write lock must be held.
+func (db *MockDatabase) addEvent(e events.Event) {
+	if e.Empty() {
+		return
+	}
+
+	db.outboxID++
+	db.outbox = append(db.outbox, events.OutboxEntry{
+		ID:        db.outboxID,
+		Event:     e,
+		CreatedAt: time.Now().UTC(),
+	})
+}
+
+func (db *MockDatabase) PendingEvents(limit int) ([]events.OutboxEntry, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if limit > len(db.outbox) {
+		limit = len(db.outbox)
+	}
+
+	return append([]events.OutboxEntry(nil), db.outbox[:limit]...), nil
+}
+
+func (db *MockDatabase) MarkSent(id int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for i, entry := range db.outbox {
+		if entry.ID == id {
+			db.outbox = append(db.outbox[:i], db.outbox[i+1:]...)
+			return nil
+		}
+	}
+
+	return errors.New("no event found with ID")
+}
+
+func (db *MockDatabase) OutboxBacklog() (int, time.Time, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if len(db.outbox) == 0 {
+		return 0, time.Time{}, nil
+	}
+
+	return len(db.outbox), db.outbox[0].CreatedAt, nil
 }
@@ -0,0 +1,122 @@
+package mockdblayer
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+)
+
+// These tests are meant to be run with the race detector, go test -race,
+// which fails them if the database is accessed without the right locking.
+
+const workers = 50
+
+func TestConcurrentAddUser(t *testing.T) {
+	db := NewMockDatabase()
+
+	ids := make(chan string, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user, err := db.AddUser(persistence.User{Nickname: strconv.Itoa(i)})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			ids <- user.ID
+		}(i)
+	}
+
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[string]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Errorf("ID %s was handed out twice", id)
+		}
+
+		seen[id] = true
+	}
+
+	if len(db.Users) != workers {
+		t.Errorf("wrong number of users: got %v want %v", len(db.Users), workers)
+	}
+}
+
+func TestConcurrentReadsAndWrites(t *testing.T) {
+	db := NewMockDatabase()
+	for i := 0; i < workers; i++ {
+		db.AddUser(persistence.User{Country: "usa"})
+	}
+
+	var wg sync.WaitGroup
+	for i := 1; i <= workers; i++ {
+		id := strconv.Itoa(i)
+		wg.Add(4)
+
+		go func() {
+			defer wg.Done()
+			db.FindUserByID(id)
+		}()
+
+		go func() {
+			defer wg.Done()
+			if _, err := db.FindUserByCriteria("country", "usa"); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		go func(i int) {
+			defer wg.Done()
+			_, err := db.UpdateUser(persistence.User{ID: id, Country: "uk"})
+			// Even users may already have been deleted below.
+			if err != nil && i%2 == 1 {
+				t.Error(err)
+			}
+		}(i)
+
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				db.DeleteUser(id)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	users, err := db.FindUserByCriteria("country", "usa")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(users) != 0 {
+		t.Errorf("%v user(s) were not updated", len(users))
+	}
+}
+
+func TestReturnedUsersAreCopies(t *testing.T) {
+	db := NewMockDatabase()
+	added, _ := db.AddUser(persistence.User{FirstName: "Klay"})
+
+	found, err := db.FindUserByID(added.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changing a returned user must not change what is stored, otherwise
+	// handlers encoding it would race with later updates.
+	found.FirstName = "Steph"
+	added.FirstName = "Serge"
+
+	stored, _ := db.FindUserByID(added.ID)
+	if stored.FirstName != "Klay" {
+		t.Errorf("stored user was changed: got %v want %v", stored.FirstName, "Klay")
+	}
+}
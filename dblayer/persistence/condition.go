@@ -0,0 +1,234 @@
+package persistence
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The operators of a Condition. Comparisons test a field against a value,
+// apart from OpPresent which tests the field has one. OpAnd, OpOr and OpNot
+// combine other conditions.
+const (
+	OpEqual      = "eq"
+	OpNotEqual   = "ne"
+	OpContains   = "co"
+	OpStartsWith = "sw"
+	OpEndsWith   = "ew"
+	OpPresent    = "pr"
+	OpGreater    = "gt"
+	OpLess       = "lt"
+	OpAnd        = "and"
+	OpOr         = "or"
+	OpNot        = "not"
+)
+
+// The kinds of value a field can hold, which decide the operators it can
+// be compared with.
+const (
+	kindString = "string"
+	kindBool   = "bool"
+	kindTime   = "time"
+)
+
+// ConditionFields are the fields a Condition can compare, and the kind of
+// value each holds. They are the SearchFields and the times a user has.
+var ConditionFields = map[string]string{
+	"country":        kindString,
+	"first_name":     kindString,
+	"last_name":      kindString,
+	"nickname":       kindString,
+	"email":          kindString,
+	"email_verified": kindBool,
+	"verified_at":    kindTime,
+}
+
+var kindOperators = map[string]map[string]bool{
+	kindString: {OpEqual: true, OpNotEqual: true, OpContains: true, OpStartsWith: true, OpEndsWith: true, OpPresent: true},
+	kindBool:   {OpEqual: true, OpNotEqual: true, OpPresent: true},
+	kindTime:   {OpEqual: true, OpNotEqual: true, OpGreater: true, OpLess: true, OpPresent: true},
+}
+
+// Condition is a test users can be searched with. A comparison has a Field,
+// Op and Value, while and and or have two or more Conditions and not has
+// one. See the filter package for the language they are written in.
+//
+// Strings are compared as they are stored, apart from emails and nicknames
+// which ignore case. Times are RFC 3339, and a comparison with a time the
+// user doesn't have is false, even ne.
+type Condition struct {
+	Op         string
+	Field      string
+	Value      string
+	Conditions []Condition
+}
+
+// ConditionError is a condition that can't be used. Part is the part of
+// the comparison that is wrong, "field", "op" or "value".
+type ConditionError struct {
+	Part    string
+	Message string
+}
+
+func (e *ConditionError) Error() string {
+	return e.Message
+}
+
+// Normalize checks the condition and returns it with the values in the form
+// they are compared in: emails and nicknames lower cased, booleans true or
+// false and times in UTC.
+func (c Condition) Normalize() (Condition, error) {
+	switch c.Op {
+	case OpAnd, OpOr, OpNot:
+		if len(c.Conditions) == 0 || (c.Op == OpNot) != (len(c.Conditions) == 1) {
+			return Condition{}, &ConditionError{"op", "wrong number of conditions for " + c.Op}
+		}
+
+		normal := Condition{Op: c.Op, Conditions: make([]Condition, len(c.Conditions))}
+		for i, sub := range c.Conditions {
+			n, err := sub.Normalize()
+			if err != nil {
+				return Condition{}, err
+			}
+
+			normal.Conditions[i] = n
+		}
+
+		return normal, nil
+	}
+
+	kind, ok := ConditionFields[c.Field]
+	if !ok {
+		return Condition{}, &ConditionError{"field", "invalid search criteria"}
+	}
+
+	if !kindOperators[kind][c.Op] {
+		return Condition{}, &ConditionError{"op", "invalid operator for " + c.Field}
+	}
+
+	if c.Op == OpPresent {
+		return Condition{Op: c.Op, Field: c.Field}, nil
+	}
+
+	switch kind {
+	case kindBool:
+		b, err := strconv.ParseBool(c.Value)
+		if err != nil {
+			return Condition{}, &ConditionError{"value", "invalid " + c.Field + " value"}
+		}
+
+		c.Value = strconv.FormatBool(b)
+	case kindTime:
+		t, err := time.Parse(time.RFC3339Nano, c.Value)
+		if err != nil {
+			return Condition{}, &ConditionError{"value", "invalid " + c.Field + " value"}
+		}
+
+		c.Value = t.UTC().Format(time.RFC3339Nano)
+	default:
+		if c.Field == "email" || c.Field == "nickname" {
+			c.Value = UniqueKey(c.Value)
+		}
+	}
+
+	return Condition{Op: c.Op, Field: c.Field, Value: c.Value}, nil
+}
+
+// Time returns the value of a normalized comparison on a time.
+func (c Condition) Time() time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, c.Value)
+	return t
+}
+
+// Match reports whether u passes a normalized condition.
+func (c Condition) Match(u *User) bool {
+	switch c.Op {
+	case OpAnd:
+		for _, sub := range c.Conditions {
+			if !sub.Match(u) {
+				return false
+			}
+		}
+
+		return true
+	case OpOr:
+		for _, sub := range c.Conditions {
+			if sub.Match(u) {
+				return true
+			}
+		}
+
+		return false
+	case OpNot:
+		return !c.Conditions[0].Match(u)
+	}
+
+	if c.Field == "verified_at" {
+		return c.matchTime(u.VerifiedAt)
+	}
+
+	v := SearchFields[c.Field](u)
+	switch c.Op {
+	case OpEqual:
+		return v == c.Value
+	case OpNotEqual:
+		return v != c.Value
+	case OpContains:
+		return strings.Contains(v, c.Value)
+	case OpStartsWith:
+		return strings.HasPrefix(v, c.Value)
+	case OpEndsWith:
+		return strings.HasSuffix(v, c.Value)
+	case OpPresent:
+		return v != ""
+	}
+
+	return false
+}
+
+func (c Condition) matchTime(t *time.Time) bool {
+	if t == nil {
+		return false
+	}
+
+	switch c.Op {
+	case OpEqual:
+		return t.Equal(c.Time())
+	case OpNotEqual:
+		return !t.Equal(c.Time())
+	case OpGreater:
+		return t.After(c.Time())
+	case OpLess:
+		return t.Before(c.Time())
+	}
+
+	return c.Op == OpPresent
+}
+
+// String writes the condition in the filter language.
+func (c Condition) String() string {
+	switch c.Op {
+	case OpAnd, OpOr:
+		parts := make([]string, len(c.Conditions))
+		for i, sub := range c.Conditions {
+			parts[i] = sub.String()
+		}
+
+		return "(" + strings.Join(parts, " "+c.Op+" ") + ")"
+	case OpNot:
+		sub := c.Conditions[0].String()
+		if !strings.HasPrefix(sub, "(") {
+			sub = "(" + sub + ")"
+		}
+
+		return "not " + sub
+	case OpPresent:
+		return c.Field + " pr"
+	}
+
+	if ConditionFields[c.Field] == kindBool {
+		return c.Field + " " + c.Op + " " + c.Value
+	}
+
+	return c.Field + " " + c.Op + " " + strconv.Quote(c.Value)
+}
@@ -1,11 +1,156 @@
 package persistence
 
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// The roles a user can have. They are checked against the access policy, see
+// auth.Policy.
+const (
+	RoleAdmin   = "admin"
+	RoleUser    = "user"
+	RoleService = "service"
+)
+
+// User is a user of the service. Password holds the bcrypt hash of the
+// user's password and is never written out as JSON, so it can't leak through
+// an API response. Neither is the TOTP secret.
 type User struct {
 	ID        string `json:"ID"`
 	FirstName string `json:"first_name"`
 	LastName  string `json:"last_name"`
 	Nickname  string `json:"nickname"`
-	Password  string `json:"password"`
+	Password  string `json:"-"`
 	Email     string `json:"email"`
 	Country   string `json:"country"`
+	Role      string `json:"role"`
+	// EmailVerified is set once the user has followed the verification
+	// link sent to Email, at VerifiedAt.
+	EmailVerified bool       `json:"email_verified"`
+	VerifiedAt    *time.Time `json:"verified_at,omitempty"`
+	// TOTP is the user's authenticator app, or nil if they haven't set
+	// one up.
+	TOTP *TOTP `json:"totp,omitempty"`
+	// Lockout is the user's run of failed logins, or nil if the last one
+	// succeeded. It isn't changed by Merge, see
+	// DatabaseHandler.UpdateLockout.
+	Lockout *Lockout `json:"lockout,omitempty"`
+}
+
+// TOTP is a time based one time password authenticator (RFC 6238) used as a
+// second factor.
+type TOTP struct {
+	// Secret is the shared secret, encrypted so it is never stored in the
+	// clear. See auth.SecretBox.
+	Secret string `json:"-"`
+	// Enabled is set once the user has confirmed the authenticator with a
+	// code. Until then it isn't asked for.
+	Enabled bool `json:"enabled"`
+	// LastStep is the time step of the last code used, so a code can't be
+	// used twice.
+	LastStep int64 `json:"-"`
+}
+
+// ConflictError is returned when a change would give a user the same email
+// or nickname as another user. Field is the one that clashed.
+type ConflictError struct {
+	Field string
+}
+
+func (e *ConflictError) Error() string {
+	return e.Field + " is already taken"
+}
+
+// UniqueKey is the form of an email or nickname that no two users can
+// share, so the same one in a different case is still taken. Empty values
+// aren't unique.
+func UniqueKey(value string) string {
+	return strings.ToLower(value)
+}
+
+// Lockout is a run of failed password checks for a user, and how long they
+// have locked the user out for. See auth.LockoutPolicy.
+type Lockout struct {
+	Failures    int        `json:"failed_logins"`
+	LastFailure time.Time  `json:"last_failed_login"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+}
+
+// Locked reports whether the lockout stops the user logging in at now.
+func (l *Lockout) Locked(now time.Time) bool {
+	return l != nil && l.LockedUntil != nil && now.Before(*l.LockedUntil)
+}
+
+// MarshalJSON adds whether the user is locked out right now, so admins
+// don't have to compare locked_until with the time themselves.
+func (l Lockout) MarshalJSON() ([]byte, error) {
+	type lockout Lockout
+	return json.Marshal(struct {
+		lockout
+		Locked bool `json:"locked"`
+	}{lockout(l), l.Locked(time.Now())})
+}
+
+// MFAEnabled reports whether the user needs a second factor to log in.
+func (u *User) MFAEnabled() bool {
+	return u.TOTP != nil && u.TOTP.Enabled
+}
+
+// Merge overwrites the fields of u with the fields of changes that are set.
+// Every database layer uses it so partial updates behave the same whatever
+// the database. The ID is never changed. Changing the email makes the user
+// unverified again, and setting VerifiedAt verifies them. A TOTP replaces
+// the user's authenticator, or removes it if it has no secret. The step of
+// the last code used never goes back while the secret stays the same, so a
+// stale copy of the user can't make a used code valid again.
+func (u *User) Merge(changes User) {
+	if changes.FirstName != "" {
+		u.FirstName = changes.FirstName
+	}
+
+	if changes.LastName != "" {
+		u.LastName = changes.LastName
+	}
+
+	if changes.Country != "" {
+		u.Country = changes.Country
+	}
+
+	if changes.Nickname != "" {
+		u.Nickname = changes.Nickname
+	}
+
+	if changes.Email != "" && changes.Email != u.Email {
+		u.Email = changes.Email
+		u.EmailVerified = false
+		u.VerifiedAt = nil
+	}
+
+	if changes.VerifiedAt != nil {
+		u.EmailVerified = true
+		u.VerifiedAt = changes.VerifiedAt
+	}
+
+	if changes.TOTP != nil {
+		old := u.TOTP
+		u.TOTP = nil
+		if changes.TOTP.Secret != "" {
+			totp := *changes.TOTP
+			if old != nil && old.Secret == totp.Secret && old.LastStep > totp.LastStep {
+				totp.LastStep = old.LastStep
+			}
+
+			u.TOTP = &totp
+		}
+	}
+
+	if changes.Password != "" {
+		u.Password = changes.Password
+	}
+
+	if changes.Role != "" {
+		u.Role = changes.Role
+	}
 }
@@ -0,0 +1,242 @@
+package persistence
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+// SearchFields are the fields users can be searched by.
+var SearchFields = map[string]func(*User) string{
+	"country":    func(u *User) string { return u.Country },
+	"first_name": func(u *User) string { return u.FirstName },
+	"last_name":  func(u *User) string { return u.LastName },
+	"nickname":   func(u *User) string { return UniqueKey(u.Nickname) },
+	"email":      func(u *User) string { return UniqueKey(u.Email) },
+	// Searched for with true or false
+	"email_verified": func(u *User) string { return strconv.FormatBool(u.EmailVerified) },
+}
+
+// SortFields are the fields users can be sorted by. Values are compared as
+// they are stored, so emails and nicknames are sorted by case, and false
+// comes before true.
+var SortFields = map[string]func(*User) string{
+	"id":             func(u *User) string { return u.ID },
+	"first_name":     func(u *User) string { return u.FirstName },
+	"last_name":      func(u *User) string { return u.LastName },
+	"nickname":       func(u *User) string { return u.Nickname },
+	"email":          func(u *User) string { return u.Email },
+	"country":        func(u *User) string { return u.Country },
+	"role":           func(u *User) string { return u.Role },
+	"email_verified": func(u *User) string { return strconv.FormatBool(u.EmailVerified) },
+}
+
+// ErrInvalidCursor is returned for a cursor that wasn't made by Cursor.Encode,
+// or was made for a query sorted differently.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Criterion matches the users whose Field is Value. Emails and nicknames
+// are matched ignoring case, as no two users can share one in any case.
+type Criterion struct {
+	Field string
+	Value string
+}
+
+// Query finds the users that match every one of its criteria, and its
+// filter if it has one. A query without either matches every user.
+type Query struct {
+	Criteria []Criterion
+	Filter   *Condition
+	// Sort is the field users are ordered by, see SortFields. Users with
+	// the same value, and every user when it isn't set, are ordered by ID,
+	// which is the order they were added. Descending reverses both.
+	Sort       string
+	Descending bool
+	// Limit is the most users to return, or every match if it is 0.
+	Limit int
+	// After continues from the last user of a previous page, see
+	// Page.Next. It must be for the same sort.
+	After *Cursor
+}
+
+// Page is the users a query found.
+type Page struct {
+	Users []*User
+	// Total is how many users match the criteria, over every page.
+	Total int
+	// Next continues after the last user, or is nil if there are no more.
+	Next *Cursor
+}
+
+// Cursor is the position after a user in the order of a query. Positions
+// are by value rather than offset, so a page isn't shifted by users added or
+// deleted before it, and a cursor still works once its user is deleted.
+type Cursor struct {
+	Sort       string `json:"s"`
+	Descending bool   `json:"d,omitempty"`
+	Value      string `json:"v"`
+	ID         string `json:"i"`
+}
+
+// Encode returns the cursor as an opaque string to hand to clients.
+func (c *Cursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeCursor decodes a cursor made by Encode.
+func DecodeCursor(s string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	c := Cursor{}
+	if err = json.Unmarshal(data, &c); err != nil || c.ID == "" {
+		return nil, ErrInvalidCursor
+	}
+
+	if _, ok := SortFields[c.Sort]; !ok {
+		return nil, ErrInvalidCursor
+	}
+
+	return &c, nil
+}
+
+// Normalize checks the criteria and filter of q, see Condition.Normalize,
+// and returns the query with them combined into a single filter that
+// databases translate. The criteria are compared with OpEqual, and must be
+// on one of the SearchFields. It also checks the sort and cursor, and sorts
+// by ID if no sort is given.
+func (q Query) Normalize() (Query, error) {
+	conditions := make([]Condition, 0, len(q.Criteria)+1)
+	for _, c := range q.Criteria {
+		if _, ok := SearchFields[c.Field]; !ok {
+			return Query{}, &ConditionError{"field", "invalid search criteria"}
+		}
+
+		conditions = append(conditions, Condition{Op: OpEqual, Field: c.Field, Value: c.Value})
+	}
+
+	if q.Filter != nil {
+		conditions = append(conditions, *q.Filter)
+	}
+
+	normal := q
+	normal.Criteria = nil
+	normal.Filter = nil
+	if len(conditions) > 0 {
+		filter := Condition{Op: OpAnd, Conditions: conditions}
+		if len(conditions) == 1 {
+			filter = conditions[0]
+		}
+
+		filter, err := filter.Normalize()
+		if err != nil {
+			return Query{}, err
+		}
+
+		normal.Filter = &filter
+	}
+
+	if normal.Sort == "" {
+		normal.Sort = "id"
+	}
+
+	if _, ok := SortFields[normal.Sort]; !ok {
+		return Query{}, errors.New("invalid sort field")
+	}
+
+	if normal.Limit < 0 {
+		return Query{}, errors.New("invalid limit")
+	}
+
+	if a := normal.After; a != nil && (a.Sort != normal.Sort || a.Descending != normal.Descending) {
+		return Query{}, ErrInvalidCursor
+	}
+
+	return normal, nil
+}
+
+// Match reports whether u matches the filter of a normalized query.
+func (q Query) Match(u *User) bool {
+	return q.Filter == nil || q.Filter.Match(u)
+}
+
+// Equalities returns the fields a normalized query needs to equal a value,
+// which a database can look up in an index before checking the rest of the
+// filter.
+func (q Query) Equalities() []Condition {
+	if q.Filter == nil {
+		return nil
+	}
+
+	conditions := []Condition{*q.Filter}
+	if q.Filter.Op == OpAnd {
+		conditions = q.Filter.Conditions
+	}
+
+	equalities := make([]Condition, 0, len(conditions))
+	for _, c := range conditions {
+		if c.Op == OpEqual {
+			equalities = append(equalities, c)
+		}
+	}
+
+	return equalities
+}
+
+// Less reports whether a comes before b in the order of a normalized query.
+func (q Query) Less(a, b *User) bool {
+	return q.less(SortFields[q.Sort](a), a.ID, SortFields[q.Sort](b), b.ID)
+}
+
+// Follows reports whether u comes after the cursor of a normalized query,
+// so belongs on the page it asks for. Every user does without a cursor.
+func (q Query) Follows(u *User) bool {
+	if q.After == nil {
+		return true
+	}
+
+	return q.less(q.After.Value, q.After.ID, SortFields[q.Sort](u), u.ID)
+}
+
+// CursorAfter returns the cursor for the position after u.
+func (q Query) CursorAfter(u *User) *Cursor {
+	return &Cursor{q.Sort, q.Descending, SortFields[q.Sort](u), u.ID}
+}
+
+func (q Query) less(av, aid, bv, bid string) bool {
+	if q.Sort == "id" || av == bv {
+		if q.Descending {
+			return IDLess(bid, aid)
+		}
+
+		return IDLess(aid, bid)
+	}
+
+	if q.Descending {
+		return bv < av
+	}
+
+	return av < bv
+}
+
+// IDLess orders the numeric IDs given to users and tokens.
+func IDLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+
+	return a < b
+}
+
+// String describes the query for logging.
+func (q Query) String() string {
+	if q.Filter == nil {
+		return "any criteria"
+	}
+
+	return q.Filter.String()
+}
@@ -0,0 +1,79 @@
+package persistence
+
+import (
+	"errors"
+	"time"
+)
+
+// The kinds of token the service stores.
+const (
+	TokenAPIKey            = "api_key"
+	TokenRefresh           = "refresh"
+	TokenPasswordReset     = "password_reset"
+	TokenEmailVerification = "email_verification"
+	TokenRecoveryCode      = "recovery_code"
+)
+
+// The scopes an API key can be given. Each lets the key perform the actions
+// mapped to it in auth.ActionScopes.
+const (
+	ScopeRead   = "read"
+	ScopeWrite  = "write"
+	ScopeDelete = "delete"
+	ScopeSearch = "search"
+)
+
+// ErrTokenNotFound is returned when looking up a token that doesn't exist.
+var ErrTokenNotFound = errors.New("no token found")
+
+// ErrTokenUsed is returned when using a single use token that has already
+// been revoked.
+var ErrTokenUsed = errors.New("token already used")
+
+// ErrTokenStale is returned when using an email verification token after
+// the user's email has changed from the one it was sent to.
+var ErrTokenStale = errors.New("token is for another email")
+
+// Token is a secret credential issued by the service, such as an API key.
+// Only a hash of the secret is stored, the secret itself is shown once when
+// the token is created and can't be recovered.
+type Token struct {
+	ID     string   `json:"id"`
+	Kind   string   `json:"kind"`
+	Hash   string   `json:"-"`
+	Name   string   `json:"name,omitempty"`
+	Scopes []string `json:"scopes,omitempty"`
+	// UserID is the user the token was issued to, if any.
+	UserID string `json:"user_id,omitempty"`
+	// Family groups tokens that are revoked together, such as a refresh
+	// token and the tokens it was rotated from and into.
+	Family    string    `json:"family,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is when the token stops being valid, or nil if it never
+	// does.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// RevokedAt is when the token stopped being valid, or nil if it still
+	// is.
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Revoked reports whether the token has been revoked.
+func (t *Token) Revoked() bool {
+	return t.RevokedAt != nil
+}
+
+// Expired reports whether the token had expired at now.
+func (t *Token) Expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)
+}
+
+// HasScope reports whether the token was given scope.
+func (t *Token) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
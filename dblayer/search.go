@@ -0,0 +1,84 @@
+package dblayer
+
+import (
+	"time"
+
+	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+	search "github.com/omgitsotis/user-service/search"
+)
+
+// searchLayer wraps a DatabaseHandler and keeps a search index in step with
+// every successful change to a user, like eventLayer does for events.
+type searchLayer struct {
+	DatabaseHandler
+	index *search.Index
+}
+
+// NewSearchLayer returns a DatabaseHandler that adds, updates and removes
+// users in index as they are changed. The index starts out empty, see
+// Reindex.
+func NewSearchLayer(dbh DatabaseHandler, index *search.Index) DatabaseHandler {
+	return &searchLayer{dbh, index}
+}
+
+// Reindex rebuilds index from every user in dbh, and returns how many
+// there are.
+func Reindex(dbh DatabaseHandler, index *search.Index) (int, error) {
+	return index.Rebuild(func() ([]*persistence.User, error) {
+		page, err := dbh.FindUsers(persistence.Query{})
+		if err != nil {
+			return nil, err
+		}
+
+		return page.Users, nil
+	})
+}
+
+func (sl *searchLayer) AddUser(u persistence.User) (*persistence.User, error) {
+	user, err := sl.DatabaseHandler.AddUser(u)
+	if err != nil {
+		return nil, err
+	}
+
+	sl.index.Put(user)
+	return user, nil
+}
+
+func (sl *searchLayer) UpdateUser(u persistence.User) (*persistence.User, error) {
+	user, err := sl.DatabaseHandler.UpdateUser(u)
+	if err != nil {
+		return nil, err
+	}
+
+	sl.index.Put(user)
+	return user, nil
+}
+
+func (sl *searchLayer) ResetPassword(tokenID, password string, at time.Time) (*persistence.User, error) {
+	user, err := sl.DatabaseHandler.ResetPassword(tokenID, password, at)
+	if err != nil {
+		return nil, err
+	}
+
+	sl.index.Put(user)
+	return user, nil
+}
+
+func (sl *searchLayer) VerifyEmail(tokenID string, at time.Time) (*persistence.User, error) {
+	user, err := sl.DatabaseHandler.VerifyEmail(tokenID, at)
+	if err != nil {
+		return nil, err
+	}
+
+	sl.index.Put(user)
+	return user, nil
+}
+
+func (sl *searchLayer) DeleteUser(id string) error {
+	if err := sl.DatabaseHandler.DeleteUser(id); err != nil {
+		return err
+	}
+
+	sl.index.Delete(id)
+	return nil
+}
@@ -0,0 +1,72 @@
+package dblayer
+
+import (
+	"reflect"
+	"testing"
+
+	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+	search "github.com/omgitsotis/user-service/search"
+)
+
+func TestSearchLayer(t *testing.T) {
+	for name, newDB := range backends(t) {
+		t.Run(string(name), func(t *testing.T) {
+			db := newDB()
+			existing, err := db.AddUser(persistence.User{FirstName: "Kevon", LastName: "Looney", Email: "kevon@mail.com"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			index := search.NewIndex()
+			dbh := NewSearchLayer(db, index)
+			if n, err := Reindex(dbh, index); err != nil || n != 1 {
+				t.Fatalf("wrong reindex: got %v, %v want 1", n, err)
+			}
+
+			added := addUsers(t, dbh)
+			if _, err = dbh.UpdateUser(persistence.User{ID: added[0].ID, LastName: "Thompson-Green"}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err = dbh.DeleteUser(added[1].ID); err != nil {
+				t.Fatal(err)
+			}
+
+			// Failed changes leave the index alone.
+			dbh.UpdateUser(persistence.User{ID: "1000", LastName: "Nobody"})
+			dbh.AddUser(persistence.User{FirstName: "Clash", Email: "KLAY_THOMPSON@mail.com"})
+
+			tests := []struct {
+				query string
+				want  []string
+			}{
+				{"looney", []string{existing.ID}},
+				{"green", []string{added[0].ID}},
+				{"ibaka", nil},
+				{"curry", []string{added[2].ID}},
+				{"nobody", nil},
+				{"clash", nil},
+			}
+
+			for _, tt := range tests {
+				hits, _, err := index.Search(tt.query, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var got []string
+				for _, h := range hits {
+					got = append(got, h.ID)
+				}
+
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("%q: got %v want %v", tt.query, got, tt.want)
+				}
+			}
+
+			if n, err := Reindex(dbh, index); err != nil || n != 3 {
+				t.Errorf("wrong reindex: got %v, %v want 3", n, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package sqlitelayer
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+
+	// Registers the sqlite3 driver with database/sql
+	_ "github.com/mattn/go-sqlite3"
+	sqllayer "github.com/omgitsotis/user-service/dblayer/sqllayer"
+)
+
+// migrations is the schema history of the SQLite database. Never edit an
+// entry that has been released, add a new one to the end instead.
+var migrations = []string{
+	// 1: the users table. IF NOT EXISTS so database files created before
+	// migrations were tracked are picked up without an error.
+	`CREATE TABLE IF NOT EXISTS users (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		first_name TEXT NOT NULL DEFAULT '',
+		last_name  TEXT NOT NULL DEFAULT '',
+		nickname   TEXT NOT NULL DEFAULT '',
+		password   TEXT NOT NULL DEFAULT '',
+		email      TEXT NOT NULL DEFAULT '',
+		country    TEXT NOT NULL DEFAULT ''
+	)`,
+	// 2: the outbox of events waiting to be sent.
+	`CREATE TABLE outbox (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		payload    TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`,
+	// 3: the role of each user, for access control.
+	`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT ''`,
+	// 4: issued credentials, such as API keys. Only a hash of the secret is
+	// stored.
+	`CREATE TABLE tokens (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		kind       TEXT NOT NULL,
+		hash       TEXT NOT NULL UNIQUE,
+		name       TEXT NOT NULL DEFAULT '',
+		scopes     TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL,
+		revoked_at TIMESTAMP
+	)`,
+	// 5: listing tokens by kind.
+	`CREATE INDEX tokens_kind ON tokens (kind)`,
+	// 6-9: refresh tokens belong to a user and a family, and expire.
+	`ALTER TABLE tokens ADD COLUMN user_id TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE tokens ADD COLUMN family TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE tokens ADD COLUMN expires_at TIMESTAMP`,
+	`CREATE INDEX tokens_family ON tokens (family)`,
+	// 10-11: email verification. Existing users start unverified.
+	`ALTER TABLE users ADD COLUMN email_verified INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE users ADD COLUMN verified_at TIMESTAMP`,
+	// 12-14: the user's TOTP authenticator. The secret is encrypted by the
+	// service before it gets here.
+	`ALTER TABLE users ADD COLUMN totp_secret TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE users ADD COLUMN totp_enabled INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE users ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0`,
+	// 15-17: failed logins, see auth.LockoutPolicy.
+	`ALTER TABLE users ADD COLUMN failed_logins INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE users ADD COLUMN last_failed_login TIMESTAMP`,
+	`ALTER TABLE users ADD COLUMN locked_until TIMESTAMP`,
+	// 18-19: no two users can have the same email or nickname, ignoring
+	// case. Existing duplicates must be resolved before upgrading.
+	`CREATE UNIQUE INDEX users_email_lower ON users (lower(email)) WHERE email <> ''`,
+	`CREATE UNIQUE INDEX users_nickname_lower ON users (lower(nickname)) WHERE nickname <> ''`,
+	// 20-25: lower() only folds ASCII letters in SQLite, so the unique
+	// forms are worked out by the service with persistence.UniqueKey
+	// instead. Existing users get theirs when the database is opened.
+	`ALTER TABLE users ADD COLUMN email_key TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE users ADD COLUMN nickname_key TEXT NOT NULL DEFAULT ''`,
+	`DROP INDEX users_email_lower`,
+	`DROP INDEX users_nickname_lower`,
+	`CREATE UNIQUE INDEX users_email_key ON users (email_key) WHERE email_key <> ''`,
+	`CREATE UNIQUE INDEX users_nickname_key ON users (nickname_key) WHERE nickname_key <> ''`,
+}
+
+// Dialect is the SQLite flavour of SQL.
+var Dialect = sqllayer.Dialect{
+	Name:       "SQLiteDB",
+	Migrations: migrations,
+	Position:   "instr",
+}
+
+// NewSQLiteDatabase opens (or creates) the SQLite database at path and
+// migrates it to the latest schema.
+func NewSQLiteDatabase(path string) (*sqllayer.SQLDatabase, error) {
+	if path == "" {
+		return nil, errors.New("no sqlite database path provided")
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite only allows a single writer, so there is nothing to gain from
+	// holding more than one connection open.
+	db.SetMaxOpenConns(1)
+
+	sqlDB, err := sqllayer.NewSQLDatabase(db, Dialect)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	log.Printf("[SQLiteDB] opened database %s\n", path)
+	return sqlDB, nil
+}
@@ -0,0 +1,57 @@
+package sqllayer
+
+import (
+	"database/sql"
+	"log"
+)
+
+// migrate brings the schema up to date by running every migration in the
+// dialect that has not been applied yet. Migrations are forward only: the
+// version of a migration is its position in Dialect.Migrations, so once a
+// migration has shipped it must never be edited or reordered, only followed
+// by new ones.
+func migrate(db *sql.DB, d Dialect) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Stops two instances of the service starting at the same time from
+	// running the same migrations.
+	if d.LockMigrations != "" {
+		if _, err = tx.Exec(d.LockMigrations); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	var current int
+	err = tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	for i := current; i < len(d.Migrations); i++ {
+		version := i + 1
+		if _, err = tx.Exec(d.Migrations[i]); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(d.rebind(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, CURRENT_TIMESTAMP)`), version)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("[%s] applied migration %v\n", d.Name, version)
+	}
+
+	return tx.Commit()
+}
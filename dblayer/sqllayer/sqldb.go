@@ -0,0 +1,811 @@
+package sqllayer
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+	events "github.com/omgitsotis/user-service/events"
+)
+
+// Dialect holds the parts of talking to a database that differ between SQL
+// databases.
+type Dialect struct {
+	// Name is used to prefix log lines, e.g. SQLiteDB.
+	Name string
+
+	// Placeholder returns the bind parameter for the nth (1 based) argument
+	// of a query. Queries in this package are written with ? and rewritten
+	// with Placeholder before they are run.
+	Placeholder func(n int) string
+
+	// Migrations is the ordered list of schema changes for the database.
+	Migrations []string
+
+	// LockMigrations is an optional statement run at the start of the
+	// migration transaction to stop migrations running concurrently.
+	LockMigrations string
+
+	// Position is the function that returns the 1 based position of its
+	// second argument in its first, or 0 if it isn't there.
+	Position string
+}
+
+// rebind rewrites the ? placeholders in query to the dialect's placeholders.
+func (d Dialect) rebind(query string) string {
+	if d.Placeholder == nil {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString(d.Placeholder(n))
+			continue
+		}
+
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+const selectUser = `SELECT id, first_name, last_name, nickname, password, email, country, role, email_verified, verified_at, totp_secret, totp_enabled, totp_last_step,
+	failed_logins, last_failed_login, locked_until FROM users`
+
+// uniqueKeys maps the key column of each column no two users can share to
+// the column, so a violation can say which one clashed. A key column holds
+// persistence.UniqueKey of the column and has a unique index, so every
+// database folds case the same way.
+var uniqueKeys = map[string]string{
+	"email_key":    "email",
+	"nickname_key": "nickname",
+}
+
+// searchColumns maps the fields a persistence.Condition can compare to
+// their column. Only these columns may be interpolated into a query.
+var searchColumns = map[string]string{
+	"country":    "country",
+	"first_name": "first_name",
+	"last_name":  "last_name",
+	"nickname":   "nickname",
+	"email":      "email",
+	// Searched for with true or false
+	"email_verified": "email_verified",
+	"verified_at":    "verified_at",
+}
+
+// sortColumns maps the fields a persistence.Query can sort by to their
+// column. Only these columns may be interpolated into a query.
+var sortColumns = map[string]string{
+	"id":             "id",
+	"first_name":     "first_name",
+	"last_name":      "last_name",
+	"nickname":       "nickname",
+	"email":          "email",
+	"country":        "country",
+	"role":           "role",
+	"email_verified": "email_verified",
+}
+
+// SQLDatabase is a DatabaseHandler that keeps users in a SQL database. The
+// database specific details are provided by its Dialect. Every change to a
+// user also writes an event to the outbox table in the same transaction.
+type SQLDatabase struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+// NewSQLDatabase runs any outstanding migrations against db, fills in any
+// missing unique keys and returns a database layer that uses it.
+func NewSQLDatabase(db *sql.DB, d Dialect) (*SQLDatabase, error) {
+	if err := migrate(db, d); err != nil {
+		return nil, err
+	}
+
+	sqlDB := &SQLDatabase{db, d}
+	if err := sqlDB.fillUniqueKeys(); err != nil {
+		return nil, err
+	}
+
+	return sqlDB, nil
+}
+
+// fillUniqueKeys sets the key columns of every user whose keys aren't
+// persistence.UniqueKey of their email and nickname, such as users added
+// before the keys were stored. Like bolt, it fails if two users turn out to
+// share one, until that is resolved.
+func (db *SQLDatabase) fillUniqueKeys() error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	type keys struct {
+		id                    int64
+		emailKey, nicknameKey string
+	}
+
+	rows, err := tx.Query(`SELECT id, email, nickname, email_key, nickname_key FROM users`)
+	if err != nil {
+		return err
+	}
+
+	stale := make([]keys, 0)
+	for rows.Next() {
+		var k keys
+		var email, nickname, emailKey, nicknameKey string
+		if err = rows.Scan(&k.id, &email, &nickname, &emailKey, &nicknameKey); err != nil {
+			rows.Close()
+			return err
+		}
+
+		k.emailKey, k.nicknameKey = persistence.UniqueKey(email), persistence.UniqueKey(nickname)
+		if k.emailKey != emailKey || k.nicknameKey != nicknameKey {
+			stale = append(stale, k)
+		}
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, k := range stale {
+		_, err = tx.Exec(db.dialect.rebind(`UPDATE users SET email_key = ?, nickname_key = ? WHERE id = ?`),
+			k.emailKey, k.nicknameKey, k.id)
+		if err == nil {
+			continue
+		}
+
+		if clash, ok := conflict(err).(*persistence.ConflictError); ok {
+			return fmt.Errorf("user %d has the same %s as another user, resolve it before upgrading",
+				k.id, clash.Field)
+		}
+
+		return err
+	}
+
+	if len(stale) > 0 {
+		db.logf("filled in the unique keys of %v user(s)", len(stale))
+	}
+
+	return tx.Commit()
+}
+
+// Close closes the underlying database.
+func (db *SQLDatabase) Close() error {
+	return db.db.Close()
+}
+
+func (db *SQLDatabase) AddUser(user persistence.User) (*persistence.User, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	totp := totpColumns(user.TOTP)
+	var id int64
+	err = db.queryRow(tx,
+		`INSERT INTO users (first_name, last_name, nickname, password, email, country, role,
+		email_verified, verified_at, totp_secret, totp_enabled, totp_last_step, email_key, nickname_key)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`,
+		user.FirstName, user.LastName, user.Nickname,
+		user.Password, user.Email, user.Country, user.Role,
+		user.EmailVerified, nullTimePtr(user.VerifiedAt), totp.Secret, totp.Enabled, totp.LastStep,
+		persistence.UniqueKey(user.Email), persistence.UniqueKey(user.Nickname),
+	).Scan(&id)
+	if err != nil {
+		return nil, conflict(err)
+	}
+
+	user.ID = strconv.FormatInt(id, 10)
+	if err = db.addEvent(tx, events.NewUserEvent(events.UserCreated, nil, &user)); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	db.logf("added new user %s\n", user.ID)
+	return &user, nil
+}
+
+func (db *SQLDatabase) FindUserByID(id string) (*persistence.User, error) {
+	user, err := db.findUser(db.db, id)
+	if err != nil {
+		return nil, err
+	}
+
+	db.logf("found user %s\n", user.ID)
+	return user, nil
+}
+
+func (db *SQLDatabase) DeleteUser(id string) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	user, err := db.findUser(tx, id)
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(db.dialect.rebind(`DELETE FROM users WHERE id = ?`), user.ID); err != nil {
+		return err
+	}
+
+	if err = db.addEvent(tx, events.NewUserEvent(events.UserDeleted, user, nil)); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	db.logf("deleted user %s\n", id)
+	return nil
+}
+
+func (db *SQLDatabase) FindUserByCriteria(criteria string, value string) ([]*persistence.User, error) {
+	page, err := db.FindUsers(persistence.Query{Criteria: []persistence.Criterion{{Field: criteria, Value: value}}})
+	if err != nil {
+		return nil, err
+	}
+
+	return page.Users, nil
+}
+
+// FindUsers translates the query's filter into a WHERE clause. Pages are
+// read with a condition on the sorted columns rather than an offset, so the
+// database can seek straight to the page. The total is counted in the same
+// transaction so it agrees with the page.
+func (db *SQLDatabase) FindUsers(q persistence.Query) (*persistence.Page, error) {
+	q, err := q.Normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	var conds []string
+	var args []interface{}
+	if q.Filter != nil {
+		cond, condArgs := db.dialect.condition(*q.Filter)
+		conds, args = []string{cond}, condArgs
+	}
+
+	after, afterArgs, err := afterCondition(q)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	page := &persistence.Page{Users: make([]*persistence.User, 0)}
+	err = db.queryRow(tx, `SELECT COUNT(*) FROM users`+whereClause(conds), args...).Scan(&page.Total)
+	if err != nil {
+		return nil, err
+	}
+
+	if after != "" {
+		conds = append(conds, after)
+		args = append(args, afterArgs...)
+	}
+
+	query := selectUser + whereClause(conds) + orderBy(q)
+	if q.Limit > 0 {
+		// One more than the limit says whether there is another page.
+		query += ` LIMIT ?`
+		args = append(args, q.Limit+1)
+	}
+
+	rows, err := tx.Query(db.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		page.Users = append(page.Users, user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if q.Limit > 0 && len(page.Users) > q.Limit {
+		page.Users = page.Users[:q.Limit]
+		page.Next = q.CursorAfter(page.Users[q.Limit-1])
+	}
+
+	db.logf("found %v of %v user(s) with %s", len(page.Users), page.Total, q)
+	return page, nil
+}
+
+// UpdateUser only overwrites the fields of u that are set, see
+// persistence.User.Merge.
+func (db *SQLDatabase) UpdateUser(u persistence.User) (*persistence.User, error) {
+	rowID, err := strconv.ParseInt(u.ID, 10, 64)
+	if err != nil {
+		return nil, errors.New("no user found with ID")
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Every column is written back, so lock the row before reading it the
+	// way UpdateLockout does. Otherwise two updates read the same row and the
+	// second undoes the first, or a used TOTP step is written back lower.
+	res, err := tx.Exec(db.dialect.rebind(`UPDATE users SET failed_logins = failed_logins WHERE id = ?`), rowID)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	if n == 0 {
+		return nil, errors.New("no user found with ID")
+	}
+
+	user, err := db.findUser(tx, u.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	before := *user
+	user.Merge(u)
+	totp := totpColumns(user.TOTP)
+
+	_, err = tx.Exec(db.dialect.rebind(
+		`UPDATE users SET first_name = ?, last_name = ?, nickname = ?,
+		password = ?, email = ?, country = ?, role = ?,
+		email_verified = ?, verified_at = ?,
+		totp_secret = ?, totp_enabled = ?, totp_last_step = ?,
+		email_key = ?, nickname_key = ? WHERE id = ?`),
+		user.FirstName, user.LastName, user.Nickname,
+		user.Password, user.Email, user.Country, user.Role,
+		user.EmailVerified, nullTimePtr(user.VerifiedAt),
+		totp.Secret, totp.Enabled, totp.LastStep,
+		persistence.UniqueKey(user.Email), persistence.UniqueKey(user.Nickname), user.ID,
+	)
+	if err != nil {
+		return nil, conflict(err)
+	}
+
+	if err = db.addEvent(tx, events.NewUserEvent(events.UserUpdated, &before, user)); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	db.logf("updated user %v", user)
+	return user, nil
+}
+
+// UseTOTPStep only updates the step when it is after the stored one, in a
+// single statement, so of two requests with the same code only one changes
+// a row. Like UpdateLockout it doesn't write an event.
+func (db *SQLDatabase) UseTOTPStep(id string, step int64) (bool, error) {
+	rowID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return false, errors.New("no user found with ID")
+	}
+
+	res, err := db.db.Exec(db.dialect.rebind(`UPDATE users SET totp_last_step = ?
+		WHERE id = ? AND totp_secret <> '' AND totp_last_step < ?`),
+		step, rowID, step,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	if n == 0 {
+		if _, err = db.findUser(db.db, id); err != nil {
+			return false, err
+		}
+
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// UpdateLockout doesn't write an event, failed logins aren't a change to the
+// user other services need to know about.
+func (db *SQLDatabase) UpdateLockout(id string, update func(persistence.Lockout) persistence.Lockout) (*persistence.Lockout, error) {
+	rowID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, errors.New("no user found with ID")
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Writing to the row first locks it (and the whole database in SQLite)
+	// until the transaction ends, so a concurrent update waits for this
+	// one rather than reading the same count.
+	res, err := tx.Exec(db.dialect.rebind(`UPDATE users SET failed_logins = failed_logins WHERE id = ?`), rowID)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	if n == 0 {
+		return nil, errors.New("no user found with ID")
+	}
+
+	user, err := db.findUser(tx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	current := persistence.Lockout{}
+	if user.Lockout != nil {
+		current = *user.Lockout
+	}
+
+	lockout := update(current)
+	if lockout.Failures <= 0 {
+		lockout = persistence.Lockout{}
+	}
+
+	_, err = tx.Exec(db.dialect.rebind(
+		`UPDATE users SET failed_logins = ?, last_failed_login = ?, locked_until = ? WHERE id = ?`),
+		lockout.Failures, nullTime(lockout.LastFailure), nullTimePtr(lockout.LockedUntil), rowID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if lockout.Failures == 0 {
+		db.logf("cleared lockout for user %s\n", id)
+		return nil, nil
+	}
+
+	return &lockout, nil
+}
+
+// addEvent writes e to the outbox as part of tx, so the event is only stored
+// if the change it describes is.
+func (db *SQLDatabase) addEvent(tx *sql.Tx, e events.Event) error {
+	if e.Empty() {
+		return nil
+	}
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(db.dialect.rebind(`INSERT INTO outbox (payload, created_at) VALUES (?, ?)`),
+		string(payload), time.Now().UTC())
+	return err
+}
+
+func (db *SQLDatabase) PendingEvents(limit int) ([]events.OutboxEntry, error) {
+	rows, err := db.db.Query(db.dialect.rebind(
+		`SELECT id, payload, created_at FROM outbox ORDER BY id LIMIT ?`), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]events.OutboxEntry, 0)
+	for rows.Next() {
+		var entry events.OutboxEntry
+		var payload string
+		if err = rows.Scan(&entry.ID, &payload, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		if err = json.Unmarshal([]byte(payload), &entry.Event); err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+func (db *SQLDatabase) MarkSent(id int64) error {
+	_, err := db.db.Exec(db.dialect.rebind(`DELETE FROM outbox WHERE id = ?`), id)
+	return err
+}
+
+func (db *SQLDatabase) OutboxBacklog() (int, time.Time, error) {
+	var count int
+	var oldest time.Time
+	if err := db.db.QueryRow(`SELECT COUNT(*) FROM outbox`).Scan(&count); err != nil {
+		return 0, oldest, err
+	}
+
+	if count == 0 {
+		return 0, oldest, nil
+	}
+
+	err := db.db.QueryRow(`SELECT created_at FROM outbox ORDER BY id LIMIT 1`).Scan(&oldest)
+	if err == sql.ErrNoRows {
+		// Sent since it was counted
+		err = nil
+	}
+
+	return count, oldest, err
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx.
+type querier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (db *SQLDatabase) queryRow(q querier, query string, args ...interface{}) *sql.Row {
+	return q.QueryRow(db.dialect.rebind(query), args...)
+}
+
+func (db *SQLDatabase) findUser(q querier, id string) (*persistence.User, error) {
+	// IDs are always integers, anything else can't be in the table.
+	rowID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, errors.New("no user found with ID")
+	}
+
+	user, err := scanUser(db.queryRow(q, selectUser+` WHERE id = ?`, rowID))
+	if err == sql.ErrNoRows {
+		return nil, errors.New("no user found with ID")
+	}
+
+	return user, err
+}
+
+// condition translates a normalized persistence.Condition into SQL, and
+// returns its arguments. Emails and nicknames are compared by their unique
+// keys, and comparisons with a NULL time are made false rather than NULL, so
+// not treats them as the other databases do.
+func (d Dialect) condition(c persistence.Condition) (string, []interface{}) {
+	switch c.Op {
+	case persistence.OpAnd, persistence.OpOr:
+		conds := make([]string, len(c.Conditions))
+		var args []interface{}
+		for i, sub := range c.Conditions {
+			cond, subArgs := d.condition(sub)
+			conds[i] = cond
+			args = append(args, subArgs...)
+		}
+
+		return `(` + strings.Join(conds, ` `+strings.ToUpper(c.Op)+` `) + `)`, args
+	case persistence.OpNot:
+		cond, args := d.condition(c.Conditions[0])
+		return `NOT (` + cond + `)`, args
+	}
+
+	column := searchColumns[c.Field]
+	switch column {
+	case "verified_at":
+		if c.Op == persistence.OpPresent {
+			return column + ` IS NOT NULL`, nil
+		}
+
+		cond := `(` + column + ` IS NOT NULL AND ` + column + comparisons[c.Op] + `?)`
+		return cond, []interface{}{c.Time()}
+	case "email_verified":
+		if c.Op == persistence.OpPresent {
+			return column + ` IS NOT NULL`, nil
+		}
+
+		return column + comparisons[c.Op] + `?`, []interface{}{c.Value == "true"}
+	}
+
+	col, value := column, c.Value
+	if column == "email" || column == "nickname" {
+		col, value = column+`_key`, persistence.UniqueKey(c.Value)
+	}
+
+	// Lengths are passed in rather than worked out from the argument, which
+	// Postgres can't find the type of inside length().
+	n := utf8.RuneCountInString(value)
+	switch c.Op {
+	case persistence.OpContains:
+		return d.Position + `(` + col + `, ?) > 0`, []interface{}{value}
+	case persistence.OpStartsWith:
+		return `substr(` + col + `, 1, ?) = ?`, []interface{}{n, value}
+	case persistence.OpEndsWith:
+		cond := `(length(` + col + `) >= ? AND ` +
+			`substr(` + col + `, length(` + col + `) - ? + 1) = ?)`
+		return cond, []interface{}{n, n, value}
+	case persistence.OpPresent:
+		return column + ` <> ''`, nil
+	}
+
+	return col + comparisons[c.Op] + `?`, []interface{}{value}
+}
+
+// comparisons are the SQL operators for the persistence.Condition
+// comparisons that have one.
+var comparisons = map[string]string{
+	persistence.OpEqual:    ` = `,
+	persistence.OpNotEqual: ` <> `,
+	persistence.OpGreater:  ` > `,
+	persistence.OpLess:     ` < `,
+}
+
+// afterCondition returns the condition for the users after the cursor of a
+// normalized query, and its arguments, or nothing without a cursor.
+func afterCondition(q persistence.Query) (string, []interface{}, error) {
+	if q.After == nil {
+		return "", nil, nil
+	}
+
+	id, err := strconv.ParseInt(q.After.ID, 10, 64)
+	if err != nil {
+		return "", nil, persistence.ErrInvalidCursor
+	}
+
+	op := ` > `
+	if q.Descending {
+		op = ` < `
+	}
+
+	column := sortColumns[q.Sort]
+	if column == "id" {
+		return `id` + op + `?`, []interface{}{id}, nil
+	}
+
+	var value interface{} = q.After.Value
+	if column == "email_verified" {
+		value = q.After.Value == "true"
+	}
+
+	return `(` + column + op + `? OR (` + column + ` = ? AND id` + op + `?))`,
+		[]interface{}{value, value, id}, nil
+}
+
+func whereClause(conds []string) string {
+	if len(conds) == 0 {
+		return ""
+	}
+
+	return ` WHERE ` + strings.Join(conds, ` AND `)
+}
+
+func orderBy(q persistence.Query) string {
+	dir := ` ASC`
+	if q.Descending {
+		dir = ` DESC`
+	}
+
+	column := sortColumns[q.Sort]
+	if column == "id" {
+		return ` ORDER BY id` + dir
+	}
+
+	return ` ORDER BY ` + column + dir + `, id` + dir
+}
+
+// conflict turns a violation of one of the unique indexes into a
+// persistence.ConflictError. SQLite names the key column in the error and
+// Postgres the index, which is named after it.
+func conflict(err error) error {
+	for key, column := range uniqueKeys {
+		if strings.Contains(err.Error(), key) {
+			return &persistence.ConflictError{Field: column}
+		}
+	}
+
+	return err
+}
+
+// nullTime stores a zero time as NULL.
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t.UTC(), Valid: !t.IsZero()}
+}
+
+// totpColumns returns the TOTP columns for a user, which are empty when
+// they don't have an authenticator.
+func totpColumns(totp *persistence.TOTP) persistence.TOTP {
+	if totp == nil {
+		return persistence.TOTP{}
+	}
+
+	return *totp
+}
+
+// nullTimePtr stores a nil time as NULL.
+func nullTimePtr(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+
+	return nullTime(*t)
+}
+
+func (db *SQLDatabase) logf(format string, args ...interface{}) {
+	log.Printf("["+db.dialect.Name+"] "+format, args...)
+}
+
+// scanner is satisfied by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUser(s scanner) (*persistence.User, error) {
+	var id int64
+	var verifiedAt, lastFailure, lockedUntil sql.NullTime
+	totp := persistence.TOTP{}
+	lockout := persistence.Lockout{}
+	user := persistence.User{}
+	err := s.Scan(&id, &user.FirstName, &user.LastName, &user.Nickname,
+		&user.Password, &user.Email, &user.Country, &user.Role,
+		&user.EmailVerified, &verifiedAt, &totp.Secret, &totp.Enabled, &totp.LastStep,
+		&lockout.Failures, &lastFailure, &lockedUntil)
+	if err != nil {
+		return nil, err
+	}
+
+	if totp.Secret != "" {
+		user.TOTP = &totp
+	}
+
+	if lockout.Failures > 0 {
+		lockout.LastFailure = lastFailure.Time.UTC()
+		if lockedUntil.Valid {
+			t := lockedUntil.Time.UTC()
+			lockout.LockedUntil = &t
+		}
+
+		user.Lockout = &lockout
+	}
+
+	user.ID = strconv.FormatInt(id, 10)
+	if verifiedAt.Valid {
+		t := verifiedAt.Time.UTC()
+		user.VerifiedAt = &t
+	}
+
+	return &user, nil
+}
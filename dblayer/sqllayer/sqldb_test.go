@@ -0,0 +1,17 @@
+package sqllayer
+
+import "testing"
+
+func TestRebind(t *testing.T) {
+	d := Dialect{Placeholder: func(n int) string { return "$" + string(rune('0'+n)) }}
+
+	got := d.rebind(`UPDATE users SET email = ? WHERE id = ?`)
+	want := `UPDATE users SET email = $1 WHERE id = $2`
+	if got != want {
+		t.Errorf("wrong query: got %v want %v", got, want)
+	}
+
+	if got = (Dialect{}).rebind(want); got != want {
+		t.Errorf("query without a placeholder func changed: got %v want %v", got, want)
+	}
+}
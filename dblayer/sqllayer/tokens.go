@@ -0,0 +1,316 @@
+package sqllayer
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+	events "github.com/omgitsotis/user-service/events"
+)
+
+const selectToken = `SELECT id, kind, hash, name, scopes, user_id, family, created_at, expires_at, revoked_at FROM tokens`
+
+func (db *SQLDatabase) AddToken(token persistence.Token) (*persistence.Token, error) {
+	var id int64
+	err := db.queryRow(db.db,
+		`INSERT INTO tokens (kind, hash, name, scopes, user_id, family, created_at, expires_at, revoked_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`,
+		token.Kind, token.Hash, token.Name, strings.Join(token.Scopes, ","),
+		token.UserID, token.Family, token.CreatedAt.UTC(),
+		nullTimePtr(token.ExpiresAt), nullTimePtr(token.RevokedAt),
+	).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+
+	token.ID = strconv.FormatInt(id, 10)
+	db.logf("added new %s token %s\n", token.Kind, token.ID)
+	return &token, nil
+}
+
+func (db *SQLDatabase) FindTokenByID(id string) (*persistence.Token, error) {
+	rowID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, persistence.ErrTokenNotFound
+	}
+
+	return db.findToken(`WHERE id = ?`, rowID)
+}
+
+func (db *SQLDatabase) FindTokenByHash(hash string) (*persistence.Token, error) {
+	return db.findToken(`WHERE hash = ?`, hash)
+}
+
+func (db *SQLDatabase) FindTokensByKind(kind string) ([]*persistence.Token, error) {
+	rows, err := db.db.Query(db.dialect.rebind(selectToken+` WHERE kind = ? ORDER BY id`), kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]*persistence.Token, 0)
+	for rows.Next() {
+		token, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, token)
+	}
+
+	return results, rows.Err()
+}
+
+// UpdateToken replaces the hash, name, scopes, expiry and revocation time of
+// a token. The kind, owner, family and creation time of a token never
+// change.
+func (db *SQLDatabase) UpdateToken(token persistence.Token) (*persistence.Token, error) {
+	rowID, err := strconv.ParseInt(token.ID, 10, 64)
+	if err != nil {
+		return nil, persistence.ErrTokenNotFound
+	}
+
+	res, err := db.db.Exec(db.dialect.rebind(
+		`UPDATE tokens SET hash = ?, name = ?, scopes = ?, expires_at = ?, revoked_at = ? WHERE id = ?`),
+		token.Hash, token.Name, strings.Join(token.Scopes, ","),
+		nullTimePtr(token.ExpiresAt), nullTimePtr(token.RevokedAt), rowID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, persistence.ErrTokenNotFound
+	}
+
+	db.logf("updated token %s\n", token.ID)
+	return db.FindTokenByID(token.ID)
+}
+
+func (db *SQLDatabase) RevokeToken(id string, at time.Time) (bool, error) {
+	rowID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return false, persistence.ErrTokenNotFound
+	}
+
+	// The revoked_at check makes this a compare and set, so only one
+	// concurrent caller can revoke the token.
+	res, err := db.db.Exec(db.dialect.rebind(
+		`UPDATE tokens SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`),
+		at.UTC(), rowID,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	if n == 0 {
+		// Either it's already revoked or it doesn't exist
+		if _, err = db.FindTokenByID(id); err != nil {
+			return false, err
+		}
+
+		return false, nil
+	}
+
+	db.logf("revoked token %s\n", id)
+	return true, nil
+}
+
+func (db *SQLDatabase) RevokeTokenFamily(family string, at time.Time) error {
+	_, err := db.db.Exec(db.dialect.rebind(
+		`UPDATE tokens SET revoked_at = ? WHERE family = ? AND revoked_at IS NULL`),
+		at.UTC(), family,
+	)
+	if err != nil {
+		return err
+	}
+
+	db.logf("revoked token family %s\n", family)
+	return nil
+}
+
+// ResetPassword revokes the token with the same compare and set as
+// RevokeToken, in the transaction that sets the password and revokes the
+// user's refresh tokens, so a failed write leaves the token usable.
+func (db *SQLDatabase) ResetPassword(tokenID, password string, at time.Time) (*persistence.User, error) {
+	rowID, err := strconv.ParseInt(tokenID, 10, 64)
+	if err != nil {
+		return nil, persistence.ErrTokenNotFound
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	token, err := scanToken(db.queryRow(tx, selectToken+` WHERE id = ?`, rowID))
+	if err == sql.ErrNoRows {
+		return nil, persistence.ErrTokenNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	res, err := tx.Exec(db.dialect.rebind(
+		`UPDATE tokens SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`),
+		at.UTC(), rowID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, persistence.ErrTokenUsed
+	}
+
+	user, err := db.findUser(tx, token.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	before := *user
+	user.Password = password
+	_, err = tx.Exec(db.dialect.rebind(`UPDATE users SET password = ? WHERE id = ?`), password, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(db.dialect.rebind(
+		`UPDATE tokens SET revoked_at = ? WHERE user_id = ? AND kind = ? AND revoked_at IS NULL`),
+		at.UTC(), user.ID, persistence.TokenRefresh,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = db.addEvent(tx, events.NewUserEvent(events.UserUpdated, &before, user)); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	db.logf("reset password of user %s with token %s\n", user.ID, tokenID)
+	return user, nil
+}
+
+// VerifyEmail locks the user's row before comparing the email, like
+// UpdateUser, so the email can't change between the check and the write.
+func (db *SQLDatabase) VerifyEmail(tokenID string, at time.Time) (*persistence.User, error) {
+	rowID, err := strconv.ParseInt(tokenID, 10, 64)
+	if err != nil {
+		return nil, persistence.ErrTokenNotFound
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	token, err := scanToken(db.queryRow(tx, selectToken+` WHERE id = ?`, rowID))
+	if err == sql.ErrNoRows {
+		return nil, persistence.ErrTokenNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	res, err := tx.Exec(db.dialect.rebind(
+		`UPDATE tokens SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`),
+		at.UTC(), rowID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, persistence.ErrTokenUsed
+	}
+
+	_, err = tx.Exec(db.dialect.rebind(`UPDATE users SET failed_logins = failed_logins WHERE id = ?`), token.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := db.findUser(tx, token.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Email != token.Name {
+		return nil, persistence.ErrTokenStale
+	}
+
+	before := *user
+	verifiedAt := at.UTC()
+	user.Merge(persistence.User{VerifiedAt: &verifiedAt})
+	_, err = tx.Exec(db.dialect.rebind(`UPDATE users SET email_verified = ?, verified_at = ? WHERE id = ?`),
+		user.EmailVerified, nullTimePtr(user.VerifiedAt), user.ID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = db.addEvent(tx, events.NewUserEvent(events.UserUpdated, &before, user)); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	db.logf("verified email of user %s with token %s\n", user.ID, tokenID)
+	return user, nil
+}
+
+func (db *SQLDatabase) findToken(where string, arg interface{}) (*persistence.Token, error) {
+	token, err := scanToken(db.queryRow(db.db, selectToken+` `+where, arg))
+	if err == sql.ErrNoRows {
+		return nil, persistence.ErrTokenNotFound
+	}
+
+	return token, err
+}
+
+func scanToken(s scanner) (*persistence.Token, error) {
+	var id int64
+	var scopes string
+	var expiresAt, revokedAt sql.NullTime
+	token := persistence.Token{}
+	err := s.Scan(&id, &token.Kind, &token.Hash, &token.Name, &scopes,
+		&token.UserID, &token.Family, &token.CreatedAt, &expiresAt, &revokedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	token.ID = strconv.FormatInt(id, 10)
+	if scopes != "" {
+		token.Scopes = strings.Split(scopes, ",")
+	}
+
+	if expiresAt.Valid {
+		t := expiresAt.Time.UTC()
+		token.ExpiresAt = &t
+	}
+
+	if revokedAt.Valid {
+		t := revokedAt.Time.UTC()
+		token.RevokedAt = &t
+	}
+
+	return &token, nil
+}
@@ -0,0 +1,38 @@
+package events
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAMQPEmitterBrokerDown(t *testing.T) {
+	if _, err := NewAMQPEmitter("http://localhost", "users"); err == nil {
+		t.Error("expected an error for a url that isn't amqp")
+	}
+
+	// Nothing listens on a port that was just closed.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	e, err := NewAMQPEmitter("amqp://guest:guest@"+addr+"/", "users")
+	if err != nil {
+		t.Fatalf("the broker being down stopped the emitter: %v", err)
+	}
+
+	user := testUser()
+	if err = e.Emit(NewUserEvent(UserCreated, nil, &user)); err == nil {
+		t.Error("emitted an event without a broker")
+	}
+
+	if err = e.Close(); err != nil {
+		t.Error(err)
+	}
+
+	if err = e.Emit(NewUserEvent(UserCreated, nil, &user)); err == nil {
+		t.Error("emitted an event after close")
+	}
+}
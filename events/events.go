@@ -0,0 +1,175 @@
+package events
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+)
+
+// The event types published when a user changes. They are used as the
+// routing key, so consumers can bind to e.g. user.* or just user.deleted.
+const (
+	UserCreated = "user.created"
+	UserUpdated = "user.updated"
+	UserDeleted = "user.deleted"
+)
+
+// Event describes a change to a user.
+type Event struct {
+	Type      string    `json:"type"`
+	UserID    string    `json:"user_id"`
+	Timestamp time.Time `json:"timestamp"`
+	// Changed lists the JSON names of the fields that were set or changed.
+	// It is empty for deletes.
+	Changed []string `json:"changed,omitempty"`
+	// User is the user after the change, or before it for deletes.
+	User UserPayload `json:"user"`
+}
+
+// UserPayload is every field of the user apart from the password, which must
+// never leave the service.
+type UserPayload struct {
+	ID        string `json:"ID"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Nickname  string `json:"nickname"`
+	Email     string `json:"email"`
+	Country   string `json:"country"`
+	Role      string `json:"role"`
+	// EmailVerified is whether the user has verified their email.
+	EmailVerified bool `json:"email_verified"`
+	// MFAEnabled is whether the user needs a second factor to log in.
+	MFAEnabled bool `json:"mfa_enabled"`
+}
+
+func newUserPayload(u persistence.User) UserPayload {
+	return UserPayload{
+		ID:        u.ID,
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+		Nickname:  u.Nickname,
+		Email:     u.Email,
+		Country:   u.Country,
+		Role:      u.Role,
+
+		EmailVerified: u.EmailVerified,
+		MFAEnabled:    u.MFAEnabled(),
+	}
+}
+
+// NewUserEvent builds the event for a change from before to after. before is
+// nil for creates and after is nil for deletes.
+func NewUserEvent(eventType string, before, after *persistence.User) Event {
+	e := Event{Type: eventType, Timestamp: time.Now().UTC()}
+
+	current := after
+	if current == nil {
+		current = before
+	}
+
+	if current != nil {
+		e.UserID = current.ID
+		e.User = newUserPayload(*current)
+	}
+
+	if after != nil {
+		if before == nil {
+			before = &persistence.User{}
+		}
+
+		e.Changed = changedFields(*before, *after)
+	}
+
+	return e
+}
+
+// Empty reports whether e is an update that changed nothing in the user
+// other services see, such as starting mfa enrollment. Empty events aren't
+// sent.
+func (e Event) Empty() bool {
+	return e.Type == UserUpdated && len(e.Changed) == 0
+}
+
+// changedFields returns the JSON names of the fields that differ between a
+// and b. The password is listed by name only, its value never is.
+func changedFields(a, b persistence.User) []string {
+	changed := make([]string, 0)
+	fields := []struct {
+		name   string
+		before string
+		after  string
+	}{
+		{"first_name", a.FirstName, b.FirstName},
+		{"last_name", a.LastName, b.LastName},
+		{"nickname", a.Nickname, b.Nickname},
+		{"password", a.Password, b.Password},
+		{"email", a.Email, b.Email},
+		{"country", a.Country, b.Country},
+		{"role", a.Role, b.Role},
+		{"email_verified", strconv.FormatBool(a.EmailVerified), strconv.FormatBool(b.EmailVerified)},
+		{"mfa_enabled", strconv.FormatBool(a.MFAEnabled()), strconv.FormatBool(b.MFAEnabled())},
+	}
+
+	for _, f := range fields {
+		if f.before != f.after {
+			changed = append(changed, f.name)
+		}
+	}
+
+	return changed
+}
+
+// Emitter sends user events to whoever is interested in them.
+type Emitter interface {
+	Emit(Event) error
+}
+
+// LogEmitter writes events to the log. It is used when no broker is
+// configured.
+type LogEmitter struct{}
+
+func (le *LogEmitter) Emit(e Event) error {
+	log.Printf("[LogEmitter] %s event for user %s, changed %v\n",
+		e.Type, e.UserID, e.Changed)
+	return nil
+}
+
+// Recorder keeps every event it is given in memory. It stands in for a
+// broker in tests.
+type Recorder struct {
+	mu     sync.Mutex
+	events []Event
+	err    error
+}
+
+func (r *Recorder) Emit(e Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return r.err
+	}
+
+	r.events = append(r.events, e)
+	return nil
+}
+
+// SetError makes every Emit fail with err until it is set back to nil, as if
+// the broker was down.
+func (r *Recorder) SetError(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.err = err
+}
+
+// Events returns a copy of the events recorded so far, oldest first.
+func (r *Recorder) Events() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]Event(nil), r.events...)
+}
@@ -0,0 +1,88 @@
+package events
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+)
+
+func testUser() persistence.User {
+	return persistence.User{
+		ID:        "1",
+		FirstName: "Klay",
+		LastName:  "Thompson",
+		Nickname:  "Splash Brother",
+		Password:  "password",
+		Email:     "klay_thompson@mail.com",
+		Country:   "usa",
+	}
+}
+
+func TestEventHasNoPassword(t *testing.T) {
+	user := testUser()
+	user.Password = "s3cr3t-p4ssw0rd"
+	body, err := json.Marshal(NewUserEvent(UserCreated, nil, &user))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(body), user.Password) {
+		t.Errorf("event contains the password: %s", body)
+	}
+}
+
+func TestNewUserEvent(t *testing.T) {
+	before := testUser()
+	after := testUser()
+	after.Email = "otis_simon@mail.com"
+	after.Password = "p4ssw0rd"
+
+	tests := []struct {
+		name    string
+		event   Event
+		changed []string
+		email   string
+	}{
+		{
+			"created",
+			NewUserEvent(UserCreated, nil, &before),
+			[]string{"first_name", "last_name", "nickname", "password", "email", "country"},
+			before.Email,
+		},
+		{
+			"updated",
+			NewUserEvent(UserUpdated, &before, &after),
+			[]string{"password", "email"},
+			after.Email,
+		},
+		{
+			"deleted",
+			NewUserEvent(UserDeleted, &after, nil),
+			nil,
+			after.Email,
+		},
+	}
+
+	for _, tt := range tests {
+		if tt.event.UserID != "1" {
+			t.Errorf("%s: wrong user ID: got %v want %v", tt.name, tt.event.UserID, "1")
+		}
+
+		if tt.event.Timestamp.IsZero() {
+			t.Errorf("%s: event has no timestamp", tt.name)
+		}
+
+		if !reflect.DeepEqual(tt.event.Changed, tt.changed) {
+			t.Errorf("%s: wrong changed fields: got %v want %v",
+				tt.name, tt.event.Changed, tt.changed)
+		}
+
+		if tt.event.User.Email != tt.email {
+			t.Errorf("%s: wrong user email: got %v want %v",
+				tt.name, tt.event.User.Email, tt.email)
+		}
+	}
+}
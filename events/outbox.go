@@ -0,0 +1,182 @@
+package events
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// OutboxEntry is an event waiting in a database's outbox to be sent.
+type OutboxEntry struct {
+	ID        int64
+	Event     Event
+	CreatedAt time.Time
+}
+
+// Outbox is implemented by databases that store the event for a change in
+// the same transaction as the change itself, so an event is never lost or
+// sent for a change that didn't happen. A Dispatcher sends the events on.
+type Outbox interface {
+	// PendingEvents returns up to limit unsent events, oldest first.
+	PendingEvents(limit int) ([]OutboxEntry, error)
+	// MarkSent removes an event from the outbox once it has been sent.
+	MarkSent(id int64) error
+	// OutboxBacklog returns the number of unsent events and when the oldest
+	// of them was created.
+	OutboxBacklog() (int, time.Time, error)
+}
+
+// DispatcherStats are the metrics of a Dispatcher.
+type DispatcherStats struct {
+	// Backlog is the number of events waiting to be sent.
+	Backlog int `json:"backlog"`
+	// LagSeconds is how long the oldest waiting event has been waiting.
+	LagSeconds float64 `json:"lag_seconds"`
+	Sent       uint64  `json:"sent"`
+	Failures   uint64  `json:"failures"`
+	LastError  string  `json:"last_error,omitempty"`
+}
+
+// Dispatcher relays events from an Outbox to an Emitter in the background.
+// Events are sent in order and an event is only removed from the outbox
+// once it has been emitted, so delivery is at least once: if the service
+// stops between the two the event is sent again on the next start.
+type Dispatcher struct {
+	outbox  Outbox
+	emitter Emitter
+
+	// PollInterval is how often the outbox is checked for new events.
+	PollInterval time.Duration
+	// MaxBackoff caps how long the dispatcher waits between retries when
+	// emitting fails. The wait starts at PollInterval and doubles.
+	MaxBackoff time.Duration
+	// BatchSize is the most events read from the outbox at a time.
+	BatchSize int
+
+	mu       sync.Mutex
+	sent     uint64
+	failures uint64
+	lastErr  error
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewDispatcher returns a dispatcher with default settings. Call Start to
+// begin sending events.
+func NewDispatcher(outbox Outbox, emitter Emitter) *Dispatcher {
+	return &Dispatcher{
+		outbox:       outbox,
+		emitter:      emitter,
+		PollInterval: time.Second,
+		MaxBackoff:   time.Minute,
+		BatchSize:    100,
+	}
+}
+
+// Start runs the dispatcher in a new goroutine until Stop is called.
+func (d *Dispatcher) Start() {
+	d.stop = make(chan struct{})
+	d.done = make(chan struct{})
+	go d.run()
+}
+
+// Stop stops the dispatcher and waits for it to finish the event it is
+// sending.
+func (d *Dispatcher) Stop() {
+	close(d.stop)
+	<-d.done
+}
+
+func (d *Dispatcher) run() {
+	defer close(d.done)
+	log.Println("[Dispatcher] started")
+
+	wait := time.Duration(0)
+	backoff := d.PollInterval
+	for {
+		select {
+		case <-d.stop:
+			log.Println("[Dispatcher] stopped")
+			return
+		case <-time.After(wait):
+		}
+
+		n, err := d.Dispatch()
+		switch {
+		case err != nil:
+			log.Printf("[Dispatcher] failed to dispatch events, retrying in %s: %s\n",
+				backoff, err.Error())
+			wait = backoff
+			backoff *= 2
+			if backoff > d.MaxBackoff {
+				backoff = d.MaxBackoff
+			}
+		case n == d.BatchSize:
+			// There are probably more waiting, carry straight on.
+			wait = 0
+			backoff = d.PollInterval
+		default:
+			wait = d.PollInterval
+			backoff = d.PollInterval
+		}
+	}
+}
+
+// Dispatch sends one batch of pending events, returning how many were sent.
+// It stops at the first event that can't be sent so events keep their order.
+func (d *Dispatcher) Dispatch() (int, error) {
+	entries, err := d.outbox.PendingEvents(d.BatchSize)
+	if err != nil {
+		return 0, d.recordFailure(err)
+	}
+
+	for i, entry := range entries {
+		if err = d.emitter.Emit(entry.Event); err != nil {
+			return i, d.recordFailure(err)
+		}
+
+		if err = d.outbox.MarkSent(entry.ID); err != nil {
+			return i, d.recordFailure(err)
+		}
+
+		d.mu.Lock()
+		d.sent++
+		d.mu.Unlock()
+	}
+
+	return len(entries), nil
+}
+
+func (d *Dispatcher) recordFailure(err error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.failures++
+	d.lastErr = err
+	return err
+}
+
+// Stats returns the current metrics of the dispatcher. The backlog is read
+// from the outbox, so it includes events written by other instances.
+func (d *Dispatcher) Stats() DispatcherStats {
+	d.mu.Lock()
+	stats := DispatcherStats{Sent: d.sent, Failures: d.failures}
+	if d.lastErr != nil {
+		stats.LastError = d.lastErr.Error()
+	}
+	d.mu.Unlock()
+
+	backlog, oldest, err := d.outbox.OutboxBacklog()
+	if err != nil {
+		stats.LastError = err.Error()
+		return stats
+	}
+
+	stats.Backlog = backlog
+	if backlog > 0 {
+		stats.LagSeconds = time.Since(oldest).Seconds()
+	}
+
+	return stats
+}
@@ -0,0 +1,133 @@
+package events
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memOutbox is an in-memory Outbox for testing the dispatcher.
+type memOutbox struct {
+	mu      sync.Mutex
+	entries []OutboxEntry
+}
+
+func (o *memOutbox) add(eventType string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.entries = append(o.entries, OutboxEntry{
+		ID:        int64(len(o.entries) + 1),
+		Event:     Event{Type: eventType},
+		CreatedAt: time.Now().Add(-time.Minute),
+	})
+}
+
+func (o *memOutbox) PendingEvents(limit int) ([]OutboxEntry, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if limit > len(o.entries) {
+		limit = len(o.entries)
+	}
+
+	return append([]OutboxEntry(nil), o.entries[:limit]...), nil
+}
+
+func (o *memOutbox) MarkSent(id int64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for i, e := range o.entries {
+		if e.ID == id {
+			o.entries = append(o.entries[:i], o.entries[i+1:]...)
+			return nil
+		}
+	}
+
+	return errors.New("no event found with ID")
+}
+
+func (o *memOutbox) OutboxBacklog() (int, time.Time, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if len(o.entries) == 0 {
+		return 0, time.Time{}, nil
+	}
+
+	return len(o.entries), o.entries[0].CreatedAt, nil
+}
+
+func TestDispatchRetriesWhenBrokerIsDown(t *testing.T) {
+	outbox := &memOutbox{}
+	outbox.add(UserCreated)
+	outbox.add(UserUpdated)
+
+	broker := &Recorder{}
+	broker.SetError(errors.New("connection refused"))
+	d := NewDispatcher(outbox, broker)
+
+	if _, err := d.Dispatch(); err == nil {
+		t.Fatal("expected an error while the broker is down")
+	}
+
+	stats := d.Stats()
+	if stats.Backlog != 2 || stats.Failures != 1 || stats.Sent != 0 {
+		t.Errorf("wrong stats while the broker is down: %+v", stats)
+	}
+
+	if stats.LagSeconds < 60 {
+		t.Errorf("wrong lag: got %v want at least %v", stats.LagSeconds, 60)
+	}
+
+	broker.SetError(nil)
+	n, err := d.Dispatch()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 2 {
+		t.Errorf("wrong number of events sent: got %v want %v", n, 2)
+	}
+
+	got := broker.Events()
+	if len(got) != 2 || got[0].Type != UserCreated || got[1].Type != UserUpdated {
+		t.Errorf("events were not sent in order: %v", got)
+	}
+
+	stats = d.Stats()
+	if stats.Backlog != 0 || stats.LagSeconds != 0 || stats.Sent != 2 {
+		t.Errorf("wrong stats after sending: %+v", stats)
+	}
+}
+
+func TestDispatcherRunsInBackground(t *testing.T) {
+	outbox := &memOutbox{}
+	broker := &Recorder{}
+	broker.SetError(errors.New("connection refused"))
+
+	d := NewDispatcher(outbox, broker)
+	d.PollInterval = time.Millisecond
+	d.MaxBackoff = 5 * time.Millisecond
+	d.Start()
+	defer d.Stop()
+
+	outbox.add(UserCreated)
+	time.Sleep(20 * time.Millisecond)
+	broker.SetError(nil)
+
+	deadline := time.Now().Add(time.Second)
+	for len(broker.Events()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("event was not sent once the broker came back")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	if d.Stats().Failures == 0 {
+		t.Error("failed attempts were not counted")
+	}
+}
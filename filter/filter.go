@@ -0,0 +1,389 @@
+// Package filter parses the filters users can be searched with. They are
+// the SCIM filter language (RFC 7644 section 3.2.2.2) without complex
+// attributes, for example
+//
+//	country eq "US" and (email ew "@mail.com" or not (nickname pr))
+//
+// A filter is parsed into an AST, which is compiled to the
+// persistence.Condition the databases search with.
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+)
+
+// Node is a node of a parsed filter.
+type Node interface {
+	// Pos is the position of the first character of the node in the
+	// filter, counting from 1.
+	Pos() int
+}
+
+// Logical is two nodes joined by and or or.
+type Logical struct {
+	Op          string
+	Left, Right Node
+}
+
+// Not is a node negated by not.
+type Not struct {
+	X      Node
+	NotPos int
+}
+
+// Comparison compares an attribute with a value, or checks it has one.
+type Comparison struct {
+	Attr  string
+	Op    string
+	Value string
+
+	AttrPos, OpPos, ValuePos int
+	// OpText and ValueText are the operator and value as they were written.
+	OpText, ValueText string
+}
+
+func (n *Logical) Pos() int    { return n.Left.Pos() }
+func (n *Not) Pos() int        { return n.NotPos }
+func (n *Comparison) Pos() int { return n.AttrPos }
+
+// Error is a filter that can't be parsed or compiled. Pos is the position of
+// the token that is wrong, counting characters from 1.
+type Error struct {
+	Pos     int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Message, e.Pos)
+}
+
+// operators are the comparison operators of the language.
+var operators = map[string]bool{
+	persistence.OpEqual:      true,
+	persistence.OpNotEqual:   true,
+	persistence.OpContains:   true,
+	persistence.OpStartsWith: true,
+	persistence.OpEndsWith:   true,
+	persistence.OpPresent:    true,
+	persistence.OpGreater:    true,
+	persistence.OpLess:       true,
+}
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenWord
+	tokenString
+	tokenOpen
+	tokenClose
+)
+
+type token struct {
+	kind tokenKind
+	// text is the token as written, and value the string it stands for.
+	text  string
+	value string
+	pos   int
+}
+
+// is reports whether t is the keyword word, which is case insensitive.
+func (t token) is(word string) bool {
+	return t.kind == tokenWord && strings.EqualFold(t.text, word)
+}
+
+// describe names the token for an error.
+func (t token) describe() string {
+	if t.kind == tokenEnd {
+		return "the end of the filter"
+	}
+
+	return fmt.Sprintf("%q", t.text)
+}
+
+// lex splits a filter into tokens, ending with a tokenEnd.
+func lex(filter string) ([]token, error) {
+	var tokens []token
+	pos := 1
+	for i := 0; i < len(filter); {
+		r, size := utf8.DecodeRuneInString(filter[i:])
+		start, startPos := i, pos
+
+		switch {
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			i += size
+		case r == '(' || r == ')':
+			kind := tokenOpen
+			if r == ')' {
+				kind = tokenClose
+			}
+
+			tokens = append(tokens, token{kind, string(r), string(r), startPos})
+			i += size
+		case r == '"':
+			i += size
+			for i < len(filter) && filter[i] != '"' {
+				if filter[i] == '\\' {
+					i++
+				}
+
+				i++
+			}
+
+			if i >= len(filter) {
+				return nil, &Error{startPos, "unterminated string"}
+			}
+
+			i++
+			text := filter[start:i]
+			var value string
+			if err := json.Unmarshal([]byte(text), &value); err != nil {
+				return nil, &Error{startPos, fmt.Sprintf("invalid string %s", text)}
+			}
+
+			tokens = append(tokens, token{tokenString, text, value, startPos})
+		case isWordRune(r):
+			for i < len(filter) {
+				r, size := utf8.DecodeRuneInString(filter[i:])
+				if !isWordRune(r) {
+					break
+				}
+
+				i += size
+			}
+
+			tokens = append(tokens, token{tokenWord, filter[start:i], filter[start:i], startPos})
+		default:
+			return nil, &Error{startPos, fmt.Sprintf("unexpected %q", r)}
+		}
+
+		pos = startPos + utf8.RuneCountInString(filter[start:i])
+	}
+
+	return append(tokens, token{kind: tokenEnd, pos: pos}), nil
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || r == '.' || r == '-' || r == ':' || r == '+' ||
+		('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9')
+}
+
+// parser is a recursive descent parser for the grammar
+//
+//	filter     = and { "or" and }
+//	and        = unary { "and" unary }
+//	unary      = "not" "(" filter ")" | "(" filter ")" | comparison
+//	comparison = attribute "pr" | attribute operator value
+//	value      = string | "true" | "false"
+//
+// Keywords, operators and attributes are case insensitive.
+type parser struct {
+	tokens []token
+	next   int
+}
+
+// Parse parses a filter into its AST.
+func Parse(filter string) (Node, error) {
+	tokens, err := lex(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	if p.peek().kind == tokenEnd {
+		return nil, &Error{p.peek().pos, "empty filter"}
+	}
+
+	n, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind != tokenEnd {
+		return nil, &Error{t.pos, fmt.Sprintf("expected and or or, got %s", t.describe())}
+	}
+
+	return n, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.next]
+}
+
+func (p *parser) take() token {
+	t := p.tokens[p.next]
+	if t.kind != tokenEnd {
+		p.next++
+	}
+
+	return t
+}
+
+func (p *parser) or() (Node, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().is(persistence.OpOr) {
+		p.take()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &Logical{persistence.OpOr, left, right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) and() (Node, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().is(persistence.OpAnd) {
+		p.take()
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &Logical{persistence.OpAnd, left, right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) unary() (Node, error) {
+	t := p.peek()
+	switch {
+	case t.is(persistence.OpNot):
+		p.take()
+		if open := p.peek(); open.kind != tokenOpen {
+			return nil, &Error{open.pos, fmt.Sprintf("expected ( after not, got %s", open.describe())}
+		}
+
+		x, err := p.group()
+		if err != nil {
+			return nil, err
+		}
+
+		return &Not{x, t.pos}, nil
+	case t.kind == tokenOpen:
+		return p.group()
+	case t.kind == tokenWord:
+		return p.comparison()
+	}
+
+	return nil, &Error{t.pos, fmt.Sprintf("expected an attribute, got %s", t.describe())}
+}
+
+// group parses a filter in parentheses.
+func (p *parser) group() (Node, error) {
+	open := p.take()
+	x, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.take(); t.kind != tokenClose {
+		if t.kind == tokenEnd {
+			return nil, &Error{open.pos, "unclosed ("}
+		}
+
+		return nil, &Error{t.pos, fmt.Sprintf("expected ), got %s", t.describe())}
+	}
+
+	return x, nil
+}
+
+func (p *parser) comparison() (Node, error) {
+	attr := p.take()
+	op := p.take()
+	if op.kind != tokenWord || !operators[strings.ToLower(op.text)] {
+		return nil, &Error{op.pos, fmt.Sprintf("expected an operator after %s, got %s", attr.text, op.describe())}
+	}
+
+	c := &Comparison{
+		Attr:    strings.ToLower(attr.text),
+		Op:      strings.ToLower(op.text),
+		AttrPos: attr.pos,
+		OpPos:   op.pos,
+		OpText:  op.text,
+	}
+	if c.Op == persistence.OpPresent {
+		return c, nil
+	}
+
+	value := p.take()
+	switch {
+	case value.kind == tokenString:
+		c.Value = value.value
+	case value.is("true") || value.is("false"):
+		c.Value = strings.ToLower(value.text)
+	case value.is("null"):
+		return nil, &Error{value.pos, fmt.Sprintf("null isn't supported, use not (%s pr)", attr.text)}
+	default:
+		return nil, &Error{value.pos, fmt.Sprintf("expected a value after %s, got %s", op.text, value.describe())}
+	}
+
+	c.ValuePos, c.ValueText = value.pos, value.text
+	return c, nil
+}
+
+// Compile turns a parsed filter into the condition the databases search
+// with, checking every comparison can be made.
+func Compile(n Node) (persistence.Condition, error) {
+	switch n := n.(type) {
+	case *Logical:
+		left, err := Compile(n.Left)
+		if err != nil {
+			return persistence.Condition{}, err
+		}
+
+		right, err := Compile(n.Right)
+		if err != nil {
+			return persistence.Condition{}, err
+		}
+
+		// a and b and c is one condition rather than one inside another.
+		conditions := []persistence.Condition{left}
+		if left.Op == n.Op {
+			conditions = left.Conditions
+		}
+
+		return persistence.Condition{Op: n.Op, Conditions: append(conditions, right)}, nil
+	case *Not:
+		x, err := Compile(n.X)
+		if err != nil {
+			return persistence.Condition{}, err
+		}
+
+		return persistence.Condition{Op: persistence.OpNot, Conditions: []persistence.Condition{x}}, nil
+	case *Comparison:
+		c := persistence.Condition{Op: n.Op, Field: n.Attr, Value: n.Value}
+		normal, err := c.Normalize()
+		if ce, ok := err.(*persistence.ConditionError); ok {
+			switch ce.Part {
+			case "field":
+				return normal, &Error{n.AttrPos, fmt.Sprintf("unknown attribute %q", n.Attr)}
+			case "op":
+				return normal, &Error{n.OpPos, fmt.Sprintf("%s can't be used on %s", n.OpText, n.Attr)}
+			default:
+				return normal, &Error{n.ValuePos, fmt.Sprintf("%s %s", ce.Message, n.ValueText)}
+			}
+		}
+
+		return normal, err
+	}
+
+	return persistence.Condition{}, fmt.Errorf("unknown filter node %T", n)
+}
@@ -0,0 +1,96 @@
+package filter
+
+import (
+	"testing"
+)
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   string
+	}{
+		{`country eq "usa"`, `country eq "usa"`},
+		{`Country EQ "usa"`, `country eq "usa"`},
+		{`email eq "Klay@Mail.com"`, `email eq "klay@mail.com"`},
+		{`email_verified eq True`, `email_verified eq true`},
+		{`nickname pr`, `nickname pr`},
+		{`verified_at gt "2020-06-01T14:00:00+02:00"`, `verified_at gt "2020-06-01T12:00:00Z"`},
+		{`first_name eq "Klay \"Splash\" Thompson"`, `first_name eq "Klay \"Splash\" Thompson"`},
+		{`country eq "usa" and email ew "@mail.com"`, `(country eq "usa" and email ew "@mail.com")`},
+		{`a eq "1" or b eq "2" and c eq "3"`, ``},
+		{`country eq "a" or country eq "b" and last_name sw "c"`,
+			`(country eq "a" or (country eq "b" and last_name sw "c"))`},
+		{`(country eq "a" or country eq "b") and last_name sw "c"`,
+			`((country eq "a" or country eq "b") and last_name sw "c")`},
+		{`country eq "a" and country eq "b" and country eq "c"`,
+			`(country eq "a" and country eq "b" and country eq "c")`},
+		{`not (nickname pr) and NOT(country eq "usa")`, `(not (nickname pr) and not (country eq "usa"))`},
+	}
+
+	for _, tt := range tests {
+		node, err := Parse(tt.filter)
+		if err != nil {
+			t.Errorf("%s: %v", tt.filter, err)
+			continue
+		}
+
+		cond, err := Compile(node)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error for unknown attributes", tt.filter)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", tt.filter, err)
+			continue
+		}
+
+		if got := cond.String(); got != tt.want {
+			t.Errorf("%s: got %s want %s", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   string
+	}{
+		{``, "empty filter at position 1"},
+		{`country eqq "usa"`, `expected an operator after country, got "eqq" at position 9`},
+		{`country eq usa`, `expected a value after eq, got "usa" at position 12`},
+		{`country eq`, "expected a value after eq, got the end of the filter at position 11"},
+		{`country eq null`, "null isn't supported, use not (country pr) at position 12"},
+		{`country eq "usa`, "unterminated string at position 12"},
+		{`country eq "\q"`, `invalid string "\q" at position 12`},
+		{`country eq "usa" country eq "gb"`, `expected and or or, got "country" at position 18`},
+		{`country eq "usa" and`, "expected an attribute, got the end of the filter at position 21"},
+		{`(country eq "usa"`, "unclosed ( at position 1"},
+		{`country eq "usa")`, `expected and or or, got ")" at position 17`},
+		{`not country eq "usa"`, `expected ( after not, got "country" at position 5`},
+		{`country = "usa"`, `unexpected '=' at position 9`},
+		{`first_name eq "é" and password eq "x"`, `unknown attribute "password" at position 23`},
+		{`email_verified co "t"`, "co can't be used on email_verified at position 16"},
+		{`email_verified eq "maybe"`, `invalid email_verified value "maybe" at position 19`},
+		{`verified_at gt "yesterday"`, `invalid verified_at value "yesterday" at position 16`},
+	}
+
+	for _, tt := range tests {
+		node, err := Parse(tt.filter)
+		if err == nil {
+			_, err = Compile(node)
+		}
+
+		if err == nil {
+			t.Errorf("%s: expected an error", tt.filter)
+			continue
+		}
+
+		if _, ok := err.(*Error); !ok || err.Error() != tt.want {
+			t.Errorf("%s: wrong error: got %q want %q", tt.filter, err, tt.want)
+		}
+	}
+}
@@ -1,20 +1,176 @@
 package main
 
 import (
+    "context"
+    "expvar"
     "log"
     "flag"
+    "os"
+    "os/signal"
+    "syscall"
+    "time"
 
 
+    auth "github.com/omgitsotis/user-service/auth"
     configuration "github.com/omgitsotis/user-service/configuration"
     dblayer "github.com/omgitsotis/user-service/dblayer"
+    events "github.com/omgitsotis/user-service/events"
     client "github.com/omgitsotis/user-service/client"
+    notify "github.com/omgitsotis/user-service/notify"
+    search "github.com/omgitsotis/user-service/search"
 )
 
 func main() {
     confPath := flag.String("conf", `configuration\config.json`, "floag to set the path of the configuration json file")
+    reindex := flag.Bool("reindex", false, "flag to rebuild the search index of the service running with this configuration, then exit")
     flag.Parse()
-    config, _ := configuration.GetConfiguration(*confPath)
-    dbHandler, _ := dblayer.NewPersistenceLayer(config.DatabaseLayer, "")
+    // Without a file the defaults are used, but a file that is there has to
+    // be valid.
+    config, err := configuration.GetConfiguration(*confPath)
+    if err != nil && !os.IsNotExist(err) {
+        log.Fatal(err)
+    }
 
-    log.Fatal(client.ServeAPI(dbHandler, config.RestfulEP))
+    // The index is held by the running service, so reindexing asks it to
+    // rebuild, as an admin with a token signed with the configured secret.
+    if *reindex {
+        var authenticator *auth.Authenticator
+        if config.JWTSecret != "" || config.JWKSFile != "" {
+            authenticator, err = auth.NewAuthenticator(config.JWTSecret, config.JWKSFile)
+            if err != nil {
+                log.Fatal(err)
+            }
+        }
+
+        indexed, err := client.RequestReindex("http://"+config.RestfulEP, authenticator)
+        if err != nil {
+            log.Fatal(err)
+        }
+        log.Printf("Search index of %s rebuilt with %v user(s)\n", config.RestfulEP, indexed)
+        return
+    }
+
+    dbHandler, err := dblayer.NewPersistenceLayer(config.DatabaseLayer, config.DBConnection)
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    // Events are only sent to a broker when one is configured, otherwise
+    // they are just logged. The broker doesn't have to be up, the emitter
+    // connects when it can and events wait in the outbox until then.
+    var emitter events.Emitter = &events.LogEmitter{}
+    var amqpEmitter *events.AMQPEmitter
+    if config.AMQPBrooker != "" {
+        amqpEmitter, err = events.NewAMQPEmitter(config.AMQPBrooker, config.AMQPExchange)
+        if err != nil {
+            log.Fatal(err)
+        }
+
+        emitter = amqpEmitter
+    }
+
+    // Databases with an outbox store events with the change and a dispatcher
+    // sends them on, so they survive the broker being down. Anything else
+    // emits them straight after the change.
+    var dispatcher *events.Dispatcher
+    if outbox, ok := dbHandler.(events.Outbox); ok {
+        dispatcher = events.NewDispatcher(outbox, emitter)
+        dispatcher.Start()
+
+        expvar.Publish("outbox", expvar.Func(func() interface{} {
+            return dispatcher.Stats()
+        }))
+    } else {
+        dbHandler = dblayer.NewEventLayer(dbHandler, emitter)
+    }
+
+    // Full text search is served from an index held in memory. It is always
+    // rebuilt from the database here, before the server starts, and kept in
+    // step with every change made through this instance. Changes made by
+    // other instances need a reindex, see -reindex.
+    index := search.NewIndex()
+    dbHandler = dblayer.NewSearchLayer(dbHandler, index)
+    indexed, err := dblayer.Reindex(dbHandler, index)
+    if err != nil {
+        log.Fatal(err)
+    }
+    log.Printf("Search index built with %v user(s)\n", indexed)
+
+    opts := []client.Option{client.WithSearchIndex(index)}
+    if config.JWTSecret != "" || config.JWKSFile != "" {
+        authenticator, err := auth.NewAuthenticator(config.JWTSecret, config.JWKSFile)
+        if err != nil {
+            log.Fatal(err)
+        }
+
+        policy, err := auth.NewPolicy(config.Policies)
+        if err != nil {
+            log.Fatal(err)
+        }
+
+        opts = append(opts, client.WithAuthenticator(authenticator), client.WithPolicy(policy))
+    } else {
+        log.Println("No JWT secret or JWKS file configured, the API is open")
+    }
+
+    if config.SMTPServer != "" {
+        notifier, err := notify.NewSMTPNotifier(config.SMTPServer, config.SMTPFrom, config.SMTPUsername, config.SMTPPassword)
+        if err != nil {
+            log.Fatal(err)
+        }
+
+        opts = append(opts, client.WithNotifier(notifier))
+    } else {
+        log.Println("No SMTP server configured, messages to users will only be logged")
+    }
+
+    publicURL := config.PublicURL
+    if publicURL == "" {
+        publicURL = "http://" + config.RestfulEP
+    }
+
+    if config.MFAEncryptionKey != "" {
+        box, err := auth.NewSecretBox(config.MFAEncryptionKey)
+        if err != nil {
+            log.Fatal(err)
+        }
+
+        opts = append(opts, client.WithMFA(box, config.MFAIssuer))
+    } else {
+        log.Println("No MFA encryption key configured, two-factor authentication is disabled")
+    }
+
+    userLockout, ipLockout := auth.DefaultLockoutPolicy(), auth.DefaultIPLockoutPolicy()
+    userLockout.Threshold, ipLockout.Threshold = config.LockoutThreshold, config.IPLockoutThreshold
+    userLockout.Base = time.Duration(config.LockoutSeconds) * time.Second
+    userLockout.Max = time.Duration(config.LockoutMaxSeconds) * time.Second
+    ipLockout.Base = time.Duration(config.IPLockoutSeconds) * time.Second
+    ipLockout.Max = time.Duration(config.IPLockoutMaxSeconds) * time.Second
+    opts = append(opts, client.WithLockout(userLockout, ipLockout))
+
+    if config.TrustedProxy {
+        opts = append(opts, client.WithTrustedProxy())
+    }
+
+    opts = append(opts, client.WithPasswordResetURL(config.PasswordResetURL), client.WithPublicURL(publicURL))
+
+    // The server stops on an interrupt or SIGTERM. Requests in flight finish
+    // first, then the dispatcher finishes the event it is sending before the
+    // broker connection is closed. Events it hasn't got to stay in the outbox
+    // for the next start.
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+
+    serveErr := client.ServeAPI(ctx, dbHandler, config.RestfulEP, opts...)
+    if dispatcher != nil {
+        dispatcher.Stop()
+    }
+    if amqpEmitter != nil {
+        amqpEmitter.Close()
+    }
+
+    if serveErr != nil {
+        log.Fatal(serveErr)
+    }
+    log.Println("Server stopped")
 }
@@ -0,0 +1,52 @@
+// Package notify sends messages, such as password reset links, to users.
+package notify
+
+import (
+	"log"
+	"sync"
+)
+
+// Message is a plain text message to one recipient.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Notifier delivers messages to users.
+type Notifier interface {
+	Notify(Message) error
+}
+
+// LogNotifier writes who a message is to to the log. It is used when no mail
+// server is configured. The body isn't logged as it holds secrets such as
+// reset tokens, so nothing is actually delivered.
+type LogNotifier struct{}
+
+func (ln *LogNotifier) Notify(m Message) error {
+	log.Printf("[LogNotifier] not sending %q to %s, no mail server configured\n", m.Subject, m.To)
+	return nil
+}
+
+// Recorder keeps every message it is given in memory. It stands in for a
+// mail server in tests.
+type Recorder struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (r *Recorder) Notify(m Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.messages = append(r.messages, m)
+	return nil
+}
+
+// Messages returns a copy of the messages recorded so far, oldest first.
+func (r *Recorder) Messages() []Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]Message(nil), r.messages...)
+}
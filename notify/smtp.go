@@ -0,0 +1,74 @@
+package notify
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// SMTPNotifier sends messages as email through an SMTP server.
+type SMTPNotifier struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// NewSMTPNotifier creates a notifier that sends mail from the address from
+// through the server at addr, e.g. smtp.example.com:587. The username and
+// password are only used if username is set. The connection is upgraded to
+// TLS whenever the server supports it, and credentials are never sent over a
+// plain connection to anything but localhost.
+func NewSMTPNotifier(addr, from, username, password string) (*SMTPNotifier, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &SMTPNotifier{addr: addr, from: from}
+	if username != "" {
+		n.auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	log.Printf("[SMTPNotifier] sending mail through %s as %s\n", addr, from)
+	return n, nil
+}
+
+func (n *SMTPNotifier) Notify(m Message) error {
+	msg, err := n.format(m, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if err = smtp.SendMail(n.addr, n.auth, n.from, []string{m.To}, msg); err != nil {
+		return err
+	}
+
+	log.Printf("[SMTPNotifier] sent %q to %s\n", m.Subject, m.To)
+	return nil
+}
+
+// format builds the email for m. The address and subject are checked for
+// line breaks so they can't be used to add headers.
+func (n *SMTPNotifier) format(m Message, date time.Time) ([]byte, error) {
+	for _, v := range []string{n.from, m.To, m.Subject} {
+		if strings.ContainsAny(v, "\r\n") {
+			return nil, errors.New("line break in mail header")
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", n.from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", m.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+	return b.Bytes(), nil
+}
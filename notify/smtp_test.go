@@ -0,0 +1,46 @@
+package notify
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSMTPFormat(t *testing.T) {
+	n, err := NewSMTPNotifier("localhost:25", "users@example.com", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := n.format(Message{
+		To:      "klay_thompson@mail.com",
+		Subject: "Reset your password",
+		Body:    "line one\nline two",
+	}, time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "From: users@example.com\r\n" +
+		"To: klay_thompson@mail.com\r\n" +
+		"Subject: Reset your password\r\n" +
+		"Date: Thu, 02 Jan 2020 03:04:05 +0000\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" +
+		"line one\r\nline two"
+	if string(msg) != want {
+		t.Errorf("wrong message:\n%s\nwant\n%s", msg, want)
+	}
+
+	_, err = n.format(Message{To: "a@example.com\r\nBcc: everyone@example.com"}, time.Now())
+	if err == nil || !strings.Contains(err.Error(), "line break") {
+		t.Errorf("header injection was not refused: %v", err)
+	}
+}
+
+func TestNewSMTPNotifierNeedsAPort(t *testing.T) {
+	if _, err := NewSMTPNotifier("localhost", "users@example.com", "", ""); err == nil {
+		t.Error("expected an error for an address without a port")
+	}
+}
@@ -0,0 +1,69 @@
+// Package search finds users by roughly what they are called. Names are
+// compared folded, see Fold, and ranked by how closely they match a query,
+// allowing for typos. Index is an inverted index of users for full text
+// search with prefixes and highlighting.
+package search
+
+import (
+	"strings"
+	"unicode"
+)
+
+// unaccented maps the lower case letters with accents in Latin-1 and Latin
+// Extended-A to the letters they are written without. It only covers those
+// blocks, as there is no Unicode decomposition in the standard library:
+// accented letters from anywhere else, such as Vietnamese ạ or the Latin
+// Extended-B ǎ, are kept as they are, so they only match themselves.
+// Combining accents written as separate marks are dropped by Fold whatever
+// the letter.
+var unaccented = map[rune]string{}
+
+func init() {
+	for plain, accented := range map[string]string{
+		"a": "àáâãäåāăą", "c": "çćĉċč", "d": "ďđð", "e": "èéêëēĕėęě",
+		"g": "ĝğġģ", "h": "ĥħ", "i": "ìíîïĩīĭįı", "j": "ĵ", "k": "ķĸ",
+		"l": "ĺļľŀł", "n": "ñńņňŉŋ", "o": "òóôõöøōŏő", "r": "ŕŗř",
+		"s": "śŝşšș", "t": "ţťŧț", "u": "ùúûüũūŭůűų", "w": "ŵ", "y": "ýÿŷ",
+		"z": "źżž", "ae": "æ", "oe": "œ", "ss": "ß", "th": "þ", "ij": "ĳ",
+	} {
+		for _, r := range accented {
+			unaccented[r] = plain
+		}
+	}
+}
+
+// Fold returns s in the form names are compared in. Case is folded, accents
+// are removed as far as unaccented and combining marks go, apostrophes are
+// dropped so O'Neil is oneil, and every run of anything else that isn't a
+// letter or digit becomes a single space.
+func Fold(s string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range s {
+		r = unicode.ToLower(unicode.ToUpper(r))
+		switch {
+		case unicode.Is(unicode.Mn, r), r == '\'', r == '’':
+			continue
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if space && b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+
+			space = false
+			if plain, ok := unaccented[r]; ok {
+				b.WriteString(plain)
+			} else {
+				b.WriteRune(r)
+			}
+		default:
+			space = true
+		}
+	}
+
+	return b.String()
+}
+
+// Words splits s into its folded words.
+func Words(s string) []string {
+	return strings.Fields(Fold(s))
+}
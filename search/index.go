@@ -0,0 +1,414 @@
+package search
+
+import (
+	"fmt"
+	"html"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+)
+
+// IndexFields are the fields of a user an Index holds, and how much a match
+// in each counts for.
+var IndexFields = map[string]float64{
+	"first_name": 2,
+	"last_name":  2,
+	"nickname":   2,
+	"email":      1,
+	"country":    0.5,
+}
+
+// Index is an inverted index of users for full text search, held in memory.
+// It maps every folded word of the IndexFields of a user to the users that
+// have it, and keeps the words sorted so prefixes can be looked up. It only
+// holds IDs and the indexed fields, so hits are looked up in the database
+// for the rest of the user. It is safe for concurrent use.
+type Index struct {
+	mu sync.RWMutex
+	// postings maps each word to the users that have it, and the fields
+	// they have it in.
+	postings map[string]map[string][]string
+	words    []string
+	docs     map[string]map[string]string
+
+	// rebuilding serializes rebuilds, and while one is running every change
+	// is also added to pending so it can be applied to the new index.
+	rebuilding sync.Mutex
+	pending    []change
+	journal    bool
+}
+
+// change is a Put, or a Delete if user is nil.
+type change struct {
+	id   string
+	user *persistence.User
+}
+
+// Hit is a user matched by Index.Search. Highlights holds the indexed fields
+// that matched, HTML escaped with the matching words in <mark> tags.
+type Hit struct {
+	ID         string
+	Score      float64
+	Highlights map[string]string
+}
+
+// QueryError is a query that can't be searched for.
+type QueryError struct {
+	Message string
+}
+
+func (e *QueryError) Error() string {
+	return e.Message
+}
+
+// NewIndex returns an empty index.
+func NewIndex() *Index {
+	return &Index{postings: map[string]map[string][]string{}, docs: map[string]map[string]string{}}
+}
+
+// Len returns the number of users in the index.
+func (ix *Index) Len() int {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return len(ix.docs)
+}
+
+// Put adds a user to the index, replacing them if they are already in it.
+func (ix *Index) Put(u *persistence.User) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.record(change{u.ID, u})
+	ix.put(u)
+}
+
+// Delete removes a user from the index.
+func (ix *Index) Delete(id string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.record(change{id, nil})
+	ix.delete(id)
+}
+
+// Rebuild replaces everything in the index with the users load returns,
+// such as every user in the database. Changes made while load runs are kept,
+// so the index can be rebuilt while users are being changed as long as
+// every change goes through Put and Delete. It returns the number of users
+// indexed.
+func (ix *Index) Rebuild(load func() ([]*persistence.User, error)) (int, error) {
+	ix.rebuilding.Lock()
+	defer ix.rebuilding.Unlock()
+
+	ix.mu.Lock()
+	ix.journal, ix.pending = true, nil
+	ix.mu.Unlock()
+
+	users, err := load()
+	fresh := NewIndex()
+	if err == nil {
+		for _, u := range users {
+			fresh.put(u)
+		}
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.journal = false
+	if err != nil {
+		ix.pending = nil
+		return 0, err
+	}
+
+	for _, c := range ix.pending {
+		if c.user == nil {
+			fresh.delete(c.id)
+		} else {
+			fresh.put(c.user)
+		}
+	}
+
+	ix.postings, ix.words, ix.docs, ix.pending = fresh.postings, fresh.words, fresh.docs, nil
+	return len(ix.docs), nil
+}
+
+func (ix *Index) record(c change) {
+	if ix.journal {
+		ix.pending = append(ix.pending, c)
+	}
+}
+
+func (ix *Index) put(u *persistence.User) {
+	ix.delete(u.ID)
+
+	doc := make(map[string]string, len(IndexFields))
+	for field := range IndexFields {
+		text := persistence.SortFields[field](u)
+		if text == "" {
+			continue
+		}
+
+		doc[field] = text
+		for _, word := range Words(text) {
+			users, ok := ix.postings[word]
+			if !ok {
+				users = map[string][]string{}
+				ix.postings[word] = users
+				ix.insertWord(word)
+			}
+
+			if !contains(users[u.ID], field) {
+				users[u.ID] = append(users[u.ID], field)
+			}
+		}
+	}
+
+	ix.docs[u.ID] = doc
+}
+
+func (ix *Index) delete(id string) {
+	doc, ok := ix.docs[id]
+	if !ok {
+		return
+	}
+
+	for _, text := range doc {
+		for _, word := range Words(text) {
+			users := ix.postings[word]
+			delete(users, id)
+			if len(users) == 0 {
+				delete(ix.postings, word)
+				ix.removeWord(word)
+			}
+		}
+	}
+
+	delete(ix.docs, id)
+}
+
+func (ix *Index) insertWord(word string) {
+	i := sort.SearchStrings(ix.words, word)
+	ix.words = append(ix.words, "")
+	copy(ix.words[i+1:], ix.words[i:])
+	ix.words[i] = word
+}
+
+func (ix *Index) removeWord(word string) {
+	if i := sort.SearchStrings(ix.words, word); i < len(ix.words) && ix.words[i] == word {
+		ix.words = append(ix.words[:i], ix.words[i+1:]...)
+	}
+}
+
+// term is a word of a query, the fields it is looked for in, and whether it
+// matches any word it starts.
+type term struct {
+	word   string
+	fields []string
+	prefix bool
+}
+
+// parseQuery splits a query into its terms. A query is words separated by
+// spaces, each of which can be limited to one of the IndexFields with a
+// field: prefix, and can end in * to match any word it starts, as in
+// first_name:kl*. Words are folded, so a word such as an email address can
+// become several terms.
+func parseQuery(q string) ([]term, error) {
+	var terms []term
+	for _, part := range strings.Fields(q) {
+		fields := []string(nil)
+		if i := strings.Index(part, ":"); i > 0 {
+			field := strings.ToLower(part[:i])
+			if _, ok := IndexFields[field]; !ok {
+				return nil, &QueryError{fmt.Sprintf("unknown field %q", part[:i])}
+			}
+
+			fields, part = []string{field}, part[i+1:]
+		}
+
+		prefix := strings.HasSuffix(part, "*")
+		words := Words(strings.TrimSuffix(part, "*"))
+		for i, word := range words {
+			terms = append(terms, term{word, fields, prefix && i == len(words)-1})
+		}
+	}
+
+	if len(terms) == 0 {
+		return nil, &QueryError{"empty query"}
+	}
+
+	return terms, nil
+}
+
+// Search finds the users that match every term of the query q, see
+// parseQuery, best match first and then in the order they were added. It
+// returns at most limit hits, or all of them if limit is 0, and the number
+// of users that matched.
+//
+// Each term scores the best of the words it matches in a user, which is the
+// weight of the field the word is in, see IndexFields, times how rare the
+// word is in the index. A prefix counts for between half and all of the
+// word it starts, depending on how much of it it covers.
+func (ix *Index) Search(q string, limit int) ([]Hit, int, error) {
+	terms, err := parseQuery(q)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	var scores map[string]float64
+	for _, t := range terms {
+		termScores := map[string]float64{}
+		for _, word := range ix.matching(t) {
+			rarity := 1 + math.Log(float64(len(ix.docs))/float64(len(ix.postings[word])))
+			cover := 1.0
+			if word != t.word {
+				cover = 0.5 + 0.5*float64(utf8.RuneCountInString(t.word))/float64(utf8.RuneCountInString(word))
+			}
+
+			for id, fields := range ix.postings[word] {
+				for _, field := range fields {
+					if t.fields != nil && field != t.fields[0] {
+						continue
+					}
+
+					if s := IndexFields[field] * rarity * cover; s > termScores[id] {
+						termScores[id] = s
+					}
+				}
+			}
+		}
+
+		if scores == nil {
+			scores = termScores
+			continue
+		}
+
+		for id, s := range scores {
+			if ts, ok := termScores[id]; ok {
+				scores[id] = s + ts
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+
+	hits := make([]Hit, 0, len(scores))
+	for id, s := range scores {
+		hits = append(hits, Hit{ID: id, Score: s})
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+
+		return persistence.IDLess(hits[i].ID, hits[j].ID)
+	})
+
+	total := len(hits)
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+
+	for i := range hits {
+		hits[i].Highlights = ix.highlight(hits[i].ID, terms)
+	}
+
+	return hits, total, nil
+}
+
+// matching returns the words in the index a term matches.
+func (ix *Index) matching(t term) []string {
+	if !t.prefix {
+		if _, ok := ix.postings[t.word]; ok {
+			return []string{t.word}
+		}
+
+		return nil
+	}
+
+	var words []string
+	for i := sort.SearchStrings(ix.words, t.word); i < len(ix.words) && strings.HasPrefix(ix.words[i], t.word); i++ {
+		words = append(words, ix.words[i])
+	}
+
+	return words
+}
+
+// highlight marks the words of a user's fields that terms match.
+func (ix *Index) highlight(id string, terms []term) map[string]string {
+	highlights := map[string]string{}
+	for field, text := range ix.docs[id] {
+		match := func(word string) bool {
+			for _, t := range terms {
+				if t.fields != nil && t.fields[0] != field {
+					continue
+				}
+
+				if word == t.word || (t.prefix && strings.HasPrefix(word, t.word)) {
+					return true
+				}
+			}
+
+			return false
+		}
+
+		if marked, ok := mark(text, match); ok {
+			highlights[field] = marked
+		}
+	}
+
+	return highlights
+}
+
+// mark escapes text for HTML and wraps the words that match, once folded,
+// in <mark> tags. It reports whether any did.
+func mark(text string, match func(string) bool) (string, bool) {
+	var b strings.Builder
+	marked := false
+	for len(text) > 0 {
+		n := strings.IndexFunc(text, func(r rune) bool { return !isWordPart(r) })
+		if n < 0 {
+			n = len(text)
+		}
+
+		if n == 0 {
+			_, size := utf8.DecodeRuneInString(text)
+			b.WriteString(html.EscapeString(text[:size]))
+			text = text[size:]
+			continue
+		}
+
+		word := text[:n]
+		if folded := Fold(word); folded != "" && match(folded) {
+			b.WriteString("<mark>" + html.EscapeString(word) + "</mark>")
+			marked = true
+		} else {
+			b.WriteString(html.EscapeString(word))
+		}
+
+		text = text[n:]
+	}
+
+	return b.String(), marked
+}
+
+// isWordPart reports whether r is part of a word as Fold splits them.
+func isWordPart(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r) || r == '\'' || r == '’'
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
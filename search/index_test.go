@@ -0,0 +1,185 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+
+	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+)
+
+func indexUsers() []*persistence.User {
+	return []*persistence.User{
+		{ID: "1", FirstName: "Klay", LastName: "Thompson", Nickname: "Splash Brother", Email: "klay_thompson@mail.com", Country: "usa"},
+		{ID: "2", FirstName: "Serge", LastName: "Ibaka", Nickname: "Iblocka", Email: "serge_ibaka@mail.com", Country: "cameroon"},
+		{ID: "3", FirstName: "Steph", LastName: "Curry", Nickname: "Chef Curry", Email: "steph_curry@mail.com", Country: "usa"},
+		{ID: "4", FirstName: "Seth", LastName: "Curry", Email: "seth@curry.org", Country: "usa"},
+		{ID: "5", FirstName: "José", LastName: "Calderón", Email: "jose@mail.com", Country: "spain"},
+	}
+}
+
+func hitIDs(hits []Hit) []string {
+	var ids []string
+	for _, h := range hits {
+		ids = append(ids, h.ID)
+	}
+
+	return ids
+}
+
+func TestIndexSearch(t *testing.T) {
+	ix := NewIndex()
+	for _, u := range indexUsers() {
+		ix.Put(u)
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"klay", []string{"1"}},
+		{"KLAY thompson", []string{"1"}},
+		{"kl", nil},
+		{"kl*", []string{"1"}},
+		{"sp*", []string{"1", "5"}},
+		{"curry", []string{"3", "4"}},
+		{"curry st*", []string{"3"}},
+		{"last_name:curry", []string{"3", "4"}},
+		{"nickname:curry", []string{"3"}},
+		{"first_name:curry", nil},
+		{"calderon", []string{"5"}},
+		{"Calderón", []string{"5"}},
+		{"steph_curry@mail.com", []string{"3"}},
+		{"curry.org", []string{"4"}},
+		{"country:usa", []string{"1", "3", "4"}},
+		{"curry klay", nil},
+	}
+
+	for _, tt := range tests {
+		hits, total, err := ix.Search(tt.query, 0)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.query, err)
+		}
+
+		if got := hitIDs(hits); !reflect.DeepEqual(got, tt.want) || total != len(tt.want) {
+			t.Errorf("%q: got %v (%v) want %v", tt.query, got, total, tt.want)
+		}
+	}
+
+	hits, total, err := ix.Search("curry", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hits) != 1 || total != 2 {
+		t.Errorf("limit: got %v hits of %v want 1 of 2", len(hits), total)
+	}
+
+	for _, q := range []string{"", "  ", "*", "password:x"} {
+		if _, _, err := ix.Search(q, 0); err == nil {
+			t.Errorf("%q: expected an error", q)
+		} else if _, ok := err.(*QueryError); !ok {
+			t.Errorf("%q: wrong error type %T", q, err)
+		}
+	}
+}
+
+func TestIndexHighlights(t *testing.T) {
+	ix := NewIndex()
+	for _, u := range indexUsers() {
+		ix.Put(u)
+	}
+
+	ix.Put(&persistence.User{ID: "6", FirstName: "<b>Kevin</b>", LastName: "O'Neil"})
+
+	tests := []struct {
+		query string
+		id    string
+		want  map[string]string
+	}{
+		{"curry", "3", map[string]string{"last_name": "<mark>Curry</mark>", "nickname": "Chef <mark>Curry</mark>", "email": "steph_<mark>curry</mark>@mail.com"}},
+		{"nickname:curry", "3", map[string]string{"nickname": "Chef <mark>Curry</mark>"}},
+		{"jose calder*", "5", map[string]string{"first_name": "<mark>José</mark>", "last_name": "<mark>Calderón</mark>", "email": "<mark>jose</mark>@mail.com"}},
+		{"kev* oneil", "6", map[string]string{"first_name": "&lt;b&gt;<mark>Kevin</mark>&lt;/b&gt;", "last_name": "<mark>O&#39;Neil</mark>"}},
+	}
+
+	for _, tt := range tests {
+		hits, _, err := ix.Search(tt.query, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(hits) == 0 || hits[0].ID != tt.id {
+			t.Errorf("%q: wrong hits %v", tt.query, hitIDs(hits))
+			continue
+		}
+
+		if !reflect.DeepEqual(hits[0].Highlights, tt.want) {
+			t.Errorf("%q: wrong highlights: got %v want %v", tt.query, hits[0].Highlights, tt.want)
+		}
+	}
+}
+
+func TestIndexChanges(t *testing.T) {
+	ix := NewIndex()
+	users := indexUsers()
+	for _, u := range users {
+		ix.Put(u)
+	}
+
+	updated := *users[0]
+	updated.FirstName = "Klayton"
+	ix.Put(&updated)
+	ix.Delete(users[2].ID)
+	ix.Delete("1000")
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"first_name:klay", nil},
+		{"klay", []string{"1"}},
+		{"klayton thompson", []string{"1"}},
+		{"curry", []string{"4"}},
+		{"steph", nil},
+	}
+
+	for _, tt := range tests {
+		hits, _, err := ix.Search(tt.query, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := hitIDs(hits); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %v want %v", tt.query, got, tt.want)
+		}
+	}
+
+	if ix.Len() != 4 {
+		t.Errorf("wrong number of users: got %v want 4", ix.Len())
+	}
+
+	if _, ok := ix.postings["steph"]; ok {
+		t.Error("words of a deleted user were left in the index")
+	}
+
+	// Changes made while the users are loaded are applied on top of them.
+	n, err := ix.Rebuild(func() ([]*persistence.User, error) {
+		ix.Put(&persistence.User{ID: "7", FirstName: "Andrew", LastName: "Wiggins"})
+		ix.Delete(users[1].ID)
+		return users, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 5 || ix.Len() != 5 {
+		t.Errorf("wrong number of users after a rebuild: got %v and %v want 5", n, ix.Len())
+	}
+
+	for query, want := range map[string][]string{"steph": {"3"}, "klay": {"1"}, "wiggins": {"7"}, "ibaka": nil} {
+		hits, _, _ := ix.Search(query, 0)
+		if got := hitIDs(hits); !reflect.DeepEqual(got, want) {
+			t.Errorf("%q after a rebuild: got %v want %v", query, got, want)
+		}
+	}
+}
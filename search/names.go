@@ -0,0 +1,185 @@
+package search
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+)
+
+// NameFields are the fields Names searches when it isn't given any.
+var NameFields = []string{"first_name", "last_name", "nickname"}
+
+// MinScore is the lowest score a user can match a query with.
+const MinScore = 0.5
+
+// Result is a user found by Names, and how well they matched from MinScore
+// to 1, which is every word of the query matching exactly once folded.
+type Result struct {
+	User  *persistence.User
+	Score float64
+}
+
+// Names returns the users whose fields roughly match query, best match first
+// and then in the order they were added. fields must be NameFields or any
+// of the persistence.SortFields.
+//
+// Each word of the query scores the best it gets against any word of the
+// fields: 1 if they are the same, 0.75 to 0.95 if the query word starts
+// the field word, 0.7 for one typo and 0.55 for two, or, failing those,
+// by how many trigrams they share. A user scores the average of the words
+// of the query, so klay thompson matches Klay Thompson across first_name and
+// last_name, and kaly matches Klay with a score of 0.7.
+func Names(users []*persistence.User, query string, fields ...string) []Result {
+	if len(fields) == 0 {
+		fields = NameFields
+	}
+
+	queryWords := Words(query)
+	if len(queryWords) == 0 {
+		return nil
+	}
+
+	var results []Result
+	for _, u := range users {
+		var words []string
+		for _, field := range fields {
+			words = append(words, Words(persistence.SortFields[field](u))...)
+		}
+
+		total := 0.0
+		for _, q := range queryWords {
+			best := 0.0
+			for _, w := range words {
+				if s := wordScore(q, w); s > best {
+					best = s
+				}
+			}
+
+			total += best
+		}
+
+		if score := total / float64(len(queryWords)); score >= MinScore {
+			results = append(results, Result{u, score})
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+
+		return persistence.IDLess(results[i].User.ID, results[j].User.ID)
+	})
+
+	return results
+}
+
+// wordScore scores how well the folded query word q matches the word w.
+func wordScore(q, w string) float64 {
+	if q == w {
+		return 1
+	}
+
+	best := 0.0
+	qn, wn := utf8.RuneCountInString(q), utf8.RuneCountInString(w)
+	if qn >= 2 && strings.HasPrefix(w, q) {
+		best = 0.75 + 0.2*float64(qn)/float64(wn)
+	}
+
+	if d := Distance(q, w); d <= maxTypos(qn) && 0.85-0.15*float64(d) > best {
+		best = 0.85 - 0.15*float64(d)
+	}
+
+	if t := 0.7 * Trigrams(q, w); t > best {
+		best = t
+	}
+
+	return best
+}
+
+// maxTypos is how many typos a word of n letters can have and still match,
+// which is none for the shortest words as anything would match them.
+func maxTypos(n int) int {
+	switch {
+	case n < 3:
+		return 0
+	case n < 5:
+		return 1
+	}
+
+	return 2
+}
+
+// Distance is the number of letters that have to be inserted, deleted,
+// changed or swapped with the next one to turn a into b, counting each
+// letter once (the optimal string alignment distance).
+func Distance(a, b string) int {
+	ar, br := []rune(a), []rune(b)
+
+	// Only the last three rows of the table are needed.
+	prev2 := make([]int, len(br)+1)
+	prev := make([]int, len(br)+1)
+	row := make([]int, len(br)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ar); i++ {
+		row[0] = i
+		for j := 1; j <= len(br); j++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+
+			row[j] = prev[j-1] + cost
+			if prev[j]+1 < row[j] {
+				row[j] = prev[j] + 1
+			}
+
+			if row[j-1]+1 < row[j] {
+				row[j] = row[j-1] + 1
+			}
+
+			if i > 1 && j > 1 && ar[i-1] == br[j-2] && ar[i-2] == br[j-1] && prev2[j-2]+1 < row[j] {
+				row[j] = prev2[j-2] + 1
+			}
+		}
+
+		prev2, prev, row = prev, row, prev2
+	}
+
+	return prev[len(br)]
+}
+
+// Trigrams is the share of the three letter runs of a and b that they have
+// in common, from 0 to 1. Words are padded with two spaces at the start and
+// one at the end, so their beginnings count for more.
+func Trigrams(a, b string) float64 {
+	at, bt := trigrams(a), trigrams(b)
+	shared := 0
+	for t := range at {
+		if bt[t] {
+			shared++
+		}
+	}
+
+	all := len(at) + len(bt) - shared
+	if all == 0 {
+		return 0
+	}
+
+	return float64(shared) / float64(all)
+}
+
+func trigrams(s string) map[string]bool {
+	r := []rune("  " + s + " ")
+	t := make(map[string]bool, len(r))
+	for i := 0; i+3 <= len(r); i++ {
+		t[string(r[i:i+3])] = true
+	}
+
+	return t
+}
@@ -0,0 +1,107 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+
+	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+)
+
+func TestFold(t *testing.T) {
+	tests := map[string]string{
+		"Klay":               "klay",
+		"  José  Calderón ":  "jose calderon",
+		"Nikola Jokić":       "nikola jokic",
+		"Dirk Nowitzki":      "dirk nowitzki",
+		"Shaquille O'Neal":   "shaquille oneal",
+		"Karl-Anthony Towns": "karl anthony towns",
+		"GROSSE Straße":      "grosse strasse",
+		"Łukasz Żółć":        "lukasz zolc",
+		"Zoé":               "zoe",
+		"ΟΔΥΣΣΕΥΣ":           "οδυσσευσ",
+		"Splash_Brother 11":  "splash brother 11",
+		// Outside Latin-1 and Latin Extended-A accents are only removed
+		// when written as combining marks.
+		"Nguyễn Ǎ":           "nguyễn ǎ",
+		"Nguye\u0302\u0303n": "nguyen",
+	}
+
+	for in, want := range tests {
+		if got := Fold(in); got != want {
+			t.Errorf("Fold(%q): got %q want %q", in, got, want)
+		}
+	}
+}
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"klay", "klay", 0},
+		{"klay", "clay", 1},
+		{"klay", "kaly", 1},
+		{"klay", "kla", 1},
+		{"steph", "steff", 2},
+		{"", "curry", 5},
+		{"jokić", "jokic", 1},
+		{"ca", "abc", 3},
+	}
+
+	for _, tt := range tests {
+		if got := Distance(tt.a, tt.b); got != tt.want {
+			t.Errorf("Distance(%q, %q): got %v want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestNames(t *testing.T) {
+	users := []*persistence.User{
+		{ID: "1", FirstName: "Klay", LastName: "Thompson", Nickname: "Splash Brother"},
+		{ID: "2", FirstName: "Serge", LastName: "Ibaka", Nickname: "Iblocka"},
+		{ID: "3", FirstName: "Steph", LastName: "Curry", Nickname: "Chef Curry"},
+		{ID: "4", FirstName: "José", LastName: "Calderón"},
+		{ID: "5", FirstName: "Seth", LastName: "Curry"},
+	}
+
+	tests := []struct {
+		query  string
+		fields []string
+		want   []string
+	}{
+		{"klay", []string{"first_name"}, []string{"1"}},
+		{"KLAY", nil, []string{"1"}},
+		{"kaly", nil, []string{"1"}},
+		{"thomson", []string{"last_name"}, []string{"1"}},
+		{"klay thompson", nil, []string{"1"}},
+		{"klay thompson", []string{"first_name"}, []string{"1"}},
+		{"jose calderon", nil, []string{"4"}},
+		{"Calderon", []string{"first_name"}, nil},
+		{"curry", nil, []string{"3", "5"}},
+		{"steff curry", nil, []string{"3", "5"}},
+		{"chef", []string{"nickname"}, []string{"3"}},
+		{"ibak", nil, []string{"2"}},
+		{"zzz", nil, nil},
+		{" ", nil, nil},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for _, r := range Names(users, tt.query, tt.fields...) {
+			if r.Score < MinScore || r.Score > 1 {
+				t.Errorf("%q: score out of range: %v", tt.query, r.Score)
+			}
+
+			got = append(got, r.User.ID)
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q in %v: got %v want %v", tt.query, tt.fields, got, tt.want)
+		}
+	}
+
+	results := Names(users, "klay")
+	if len(results) != 1 || results[0].Score != 1 {
+		t.Errorf("an exact match should score 1: %v", results)
+	}
+}
@@ -0,0 +1,256 @@
+// Package validation checks the users sent to the service before they are
+// stored. Every rule that fails is reported, each with a machine readable
+// code, so a client can show them all at once.
+package validation
+
+import (
+	"net/mail"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+)
+
+// The codes a FieldError can have.
+const (
+	CodeRequired          = "required"
+	CodeTooShort          = "too_short"
+	CodeTooLong           = "too_long"
+	CodeInvalidCharacters = "invalid_characters"
+	CodeInvalidEmail      = "invalid_email"
+	CodeInvalidCountry    = "invalid_country"
+	CodeCommonPassword    = "common_password"
+	CodePasswordMatches   = "password_matches_user"
+	// CodeTaken is for an email or nickname another user already has. It
+	// comes from storing the user rather than from User.
+	CodeTaken = "taken"
+	// CodeUnknownField and CodeInvalidType are for JSON bodies with fields
+	// a user doesn't have, or with the wrong type of value.
+	CodeUnknownField = "unknown_field"
+	CodeInvalidType  = "invalid_type"
+)
+
+// The length limits of each field, in characters apart from
+// MaxPasswordBytes. bcrypt ignores anything past 72 bytes, so a longer
+// password would be checked by its start alone.
+const (
+	MaxNameLength     = 100
+	MinNicknameLength = 3
+	MaxNicknameLength = 50
+	MaxEmailLength    = 254
+	MinPasswordLength = 8
+	MaxPasswordBytes  = 72
+)
+
+// FieldError is a rule a field of a user broke.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Errors are all the rules a user broke, in the order of the fields.
+type Errors []FieldError
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fe.Field + " " + fe.Message
+	}
+
+	return strings.Join(msgs, ", ")
+}
+
+func (e *Errors) add(field, code, message string) {
+	*e = append(*e, FieldError{field, code, message})
+}
+
+// User checks a user that is about to be created or updated, with Password
+// holding the plaintext password. The same rules apply to both, but an
+// update only changes the fields it has so only they are checked, while
+// creating a user also needs first_name, email and password. Names, emails
+// and countries are tidied up in place: surrounding spaces are trimmed and
+// countries are upper cased. It returns nil if the user is valid.
+func User(u *persistence.User, create bool) Errors {
+	u.FirstName = strings.TrimSpace(u.FirstName)
+	u.LastName = strings.TrimSpace(u.LastName)
+	u.Nickname = strings.TrimSpace(u.Nickname)
+	u.Email = strings.TrimSpace(u.Email)
+	u.Country = strings.ToUpper(strings.TrimSpace(u.Country))
+
+	var errs Errors
+	if required(&errs, "first_name", u.FirstName, create) {
+		name(&errs, "first_name", u.FirstName)
+	}
+
+	if u.LastName != "" {
+		name(&errs, "last_name", u.LastName)
+	}
+
+	if u.Nickname != "" {
+		nickname(&errs, u.Nickname)
+	}
+
+	if required(&errs, "email", u.Email, create) {
+		email(&errs, u.Email)
+	}
+
+	if u.Country != "" && !countries[u.Country] {
+		errs.add("country", CodeInvalidCountry, "must be an ISO 3166-1 alpha-2 country code")
+	}
+
+	if required(&errs, "password", u.Password, create) {
+		password(&errs, u)
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return errs
+}
+
+// required reports whether value has been given and so needs checking,
+// adding an error if it hasn't and it must be.
+func required(errs *Errors, field, value string, must bool) bool {
+	if value != "" {
+		return true
+	}
+
+	if must {
+		errs.add(field, CodeRequired, "is required")
+	}
+
+	return false
+}
+
+func name(errs *Errors, field, value string) {
+	if utf8.RuneCountInString(value) > MaxNameLength {
+		errs.add(field, CodeTooLong, "must be at most 100 characters")
+	}
+
+	if strings.IndexFunc(value, unicode.IsControl) >= 0 {
+		errs.add(field, CodeInvalidCharacters, "must not contain control characters")
+	}
+}
+
+func nickname(errs *Errors, value string) {
+	switch n := utf8.RuneCountInString(value); {
+	case n < MinNicknameLength:
+		errs.add("nickname", CodeTooShort, "must be at least 3 characters")
+	case n > MaxNicknameLength:
+		errs.add("nickname", CodeTooLong, "must be at most 50 characters")
+	}
+
+	if strings.IndexFunc(value, unicode.IsControl) >= 0 {
+		errs.add("nickname", CodeInvalidCharacters, "must not contain control characters")
+	}
+}
+
+// email checks value is a bare RFC 5322 address, without a display name or
+// angle brackets.
+func email(errs *Errors, value string) {
+	if len(value) > MaxEmailLength {
+		errs.add("email", CodeTooLong, "must be at most 254 characters")
+		return
+	}
+
+	// ParseAddress also accepts a name, comments or angle brackets around
+	// the address, which aren't part of it, so each part must only have the
+	// characters an address can.
+	addr, err := mail.ParseAddress(value)
+	at := strings.LastIndex(value, "@")
+	if err != nil || addr.Name != "" || at < 0 || !localPart(value[:at]) || !domain(value[at+1:]) {
+		errs.add("email", CodeInvalidEmail, "must be an email address")
+		return
+	}
+
+	if at > 64 {
+		errs.add("email", CodeTooLong, "must have at most 64 characters before the @")
+	}
+}
+
+// atextSpecials are the characters other than letters and digits allowed in
+// an unquoted local part (RFC 5322 atext).
+const atextSpecials = "!#$%&'*+-/=?^_`{|}~"
+
+// localPart reports whether value is a quoted string, whose contents
+// ParseAddress has already checked, or only has atext and dots.
+func localPart(value string) bool {
+	if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+		return true
+	}
+
+	return value != "" && strings.IndexFunc(value, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '.' && !strings.ContainsRune(atextSpecials, r)
+	}) < 0
+}
+
+// domain reports whether value only has the characters of a host name.
+func domain(value string) bool {
+	return value != "" && strings.IndexFunc(value, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '.' && r != '-'
+	}) < 0
+}
+
+// password checks the password is long enough, isn't one of the passwords
+// tried first when guessing, and isn't the user's email or nickname.
+func password(errs *Errors, u *persistence.User) {
+	if utf8.RuneCountInString(u.Password) < MinPasswordLength {
+		errs.add("password", CodeTooShort, "must be at least 8 characters")
+	}
+
+	if len(u.Password) > MaxPasswordBytes {
+		errs.add("password", CodeTooLong, "must be at most 72 bytes")
+	}
+
+	lower := strings.ToLower(u.Password)
+	if commonPasswords[lower] {
+		errs.add("password", CodeCommonPassword, "is too common")
+	}
+
+	local := u.Email
+	if at := strings.LastIndex(local, "@"); at >= 0 {
+		local = local[:at]
+	}
+
+	for _, s := range []string{u.Email, local, u.Nickname} {
+		if s != "" && lower == strings.ToLower(s) {
+			errs.add("password", CodePasswordMatches, "must not be your email or nickname")
+			break
+		}
+	}
+}
+
+// commonPasswords are the passwords long enough to pass the length check
+// that are tried first when guessing.
+var commonPasswords = toSet(`password password1 password123 passw0rd p@ssw0rd
+	12345678 123456789 1234567890 87654321 11111111 00000000 12341234
+	qwertyui qwertyuiop qwerty123 asdfghjk 1q2w3e4r 1qaz2wsx zaq12wsx
+	iloveyou sunshine princess football baseball superman trustno1
+	letmein1 welcome1 abc12345 abcd1234 aa123456 changeme`)
+
+// countries are the ISO 3166-1 alpha-2 codes.
+var countries = toSet(`AD AE AF AG AI AL AM AO AQ AR AS AT AU AW AX AZ
+	BA BB BD BE BF BG BH BI BJ BL BM BN BO BQ BR BS BT BV BW BY BZ
+	CA CC CD CF CG CH CI CK CL CM CN CO CR CU CV CW CX CY CZ
+	DE DJ DK DM DO DZ EC EE EG EH ER ES ET FI FJ FK FM FO FR
+	GA GB GD GE GF GG GH GI GL GM GN GP GQ GR GS GT GU GW GY
+	HK HM HN HR HT HU ID IE IL IM IN IO IQ IR IS IT JE JM JO JP
+	KE KG KH KI KM KN KP KR KW KY KZ LA LB LC LI LK LR LS LT LU LV LY
+	MA MC MD ME MF MG MH MK ML MM MN MO MP MQ MR MS MT MU MV MW MX MY MZ
+	NA NC NE NF NG NI NL NO NP NR NU NZ OM
+	PA PE PF PG PH PK PL PM PN PR PS PT PW PY QA RE RO RS RU RW
+	SA SB SC SD SE SG SH SI SJ SK SL SM SN SO SR SS ST SV SX SY SZ
+	TC TD TF TG TH TJ TK TL TM TN TO TR TT TV TW TZ UA UG UM US UY UZ
+	VA VC VE VG VI VN VU WF WS YE YT ZA ZM ZW`)
+
+func toSet(words string) map[string]bool {
+	set := make(map[string]bool)
+	for _, w := range strings.Fields(words) {
+		set[w] = true
+	}
+
+	return set
+}
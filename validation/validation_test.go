@@ -0,0 +1,87 @@
+package validation
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	persistence "github.com/omgitsotis/user-service/dblayer/persistence"
+)
+
+func validUser() persistence.User {
+	return persistence.User{
+		FirstName: "Otis",
+		LastName:  "Simon",
+		Nickname:  "omgitsotis",
+		Email:     "otis_simon@mail.com",
+		Country:   "GB",
+		Password:  "correct horse",
+	}
+}
+
+func TestUser(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*persistence.User)
+		want   []string
+	}{
+		{"valid", func(u *persistence.User) {}, nil},
+		{"no last name or nickname", func(u *persistence.User) { u.LastName, u.Nickname = "", "" }, nil},
+		{"no first name", func(u *persistence.User) { u.FirstName = " " }, []string{"first_name:required"}},
+		{"long name", func(u *persistence.User) { u.LastName = strings.Repeat("é", 101) }, []string{"last_name:too_long"}},
+		{"control characters", func(u *persistence.User) { u.FirstName = "Otis\x00" }, []string{"first_name:invalid_characters"}},
+		{"short nickname", func(u *persistence.User) { u.Nickname = "ot" }, []string{"nickname:too_short"}},
+		{"no email", func(u *persistence.User) { u.Email = "" }, []string{"email:required"}},
+		{"bad email", func(u *persistence.User) { u.Email = "otis.mail.com" }, []string{"email:invalid_email"}},
+		{"display name", func(u *persistence.User) { u.Email = "Otis <otis@mail.com>" }, []string{"email:invalid_email"}},
+		{"angle brackets", func(u *persistence.User) { u.Email = "<otis@mail.com>" }, []string{"email:invalid_email"}},
+		{"trailing comment", func(u *persistence.User) { u.Email = "otis@mail.com (Otis)" }, []string{"email:invalid_email"}},
+		{"leading comment", func(u *persistence.User) { u.Email = "(Otis)otis@mail.com" }, []string{"email:invalid_email"}},
+		{"comment in domain", func(u *persistence.User) { u.Email = "otis@(Otis)mail.com" }, []string{"email:invalid_email"}},
+		{"comment before domain", func(u *persistence.User) { u.Email = "otis(Otis)@mail.com" }, []string{"email:invalid_email"}},
+		{"quoted local part", func(u *persistence.User) { u.Email = `"otis simon"@mail.com` }, nil},
+		{"special characters", func(u *persistence.User) { u.Email = "otis+users@mail-server.com" }, nil},
+		{"accented", func(u *persistence.User) { u.Email = "émile@mail.com" }, nil},
+		{"long local part", func(u *persistence.User) { u.Email = strings.Repeat("a", 65) + "@mail.com" }, []string{"email:too_long"}},
+		{"lower case country", func(u *persistence.User) { u.Country = "gb" }, nil},
+		{"country name", func(u *persistence.User) { u.Country = "UK" }, []string{"country:invalid_country"}},
+		{"short password", func(u *persistence.User) { u.Password = "p4ss" }, []string{"password:too_short"}},
+		{"long password", func(u *persistence.User) { u.Password = strings.Repeat("p", 73) }, []string{"password:too_long"}},
+		{"common password", func(u *persistence.User) { u.Password = "Password1" }, []string{"password:common_password"}},
+		{"password is email", func(u *persistence.User) { u.Password = "OTIS_SIMON" }, []string{"password:password_matches_user"}},
+		{"everything", func(u *persistence.User) { *u = persistence.User{Country: "XX"} },
+			[]string{"first_name:required", "email:required", "country:invalid_country", "password:required"}},
+	}
+
+	for _, tt := range tests {
+		u := validUser()
+		tt.change(&u)
+
+		var got []string
+		for _, fe := range User(&u, true) {
+			got = append(got, fe.Field+":"+fe.Code)
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUserUpdate(t *testing.T) {
+	// Updates only check what they change, with the same rules.
+	u := persistence.User{Country: " us "}
+	if errs := User(&u, false); errs != nil {
+		t.Errorf("partial update was invalid: %v", errs)
+	}
+
+	if u.Country != "US" {
+		t.Errorf("country was not tidied: %q", u.Country)
+	}
+
+	u = persistence.User{Email: "otis", Password: "short"}
+	errs := User(&u, false)
+	if len(errs) != 2 || errs[0].Code != CodeInvalidEmail || errs[1].Code != CodeTooShort {
+		t.Errorf("wrong errors for an update: %v", errs)
+	}
+}